@@ -4,22 +4,29 @@ package main
 import (
 	"context"
 	"crypto/rand"
-	"crypto/rsa"
 	"fmt"
 	"log"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/jawaracloud/waiting-room-demo/internal/broker"
+	"github.com/jawaracloud/waiting-room-demo/internal/challenge"
+	"github.com/jawaracloud/waiting-room-demo/internal/gateway"
 	"github.com/jawaracloud/waiting-room-demo/internal/handler"
+	"github.com/jawaracloud/waiting-room-demo/internal/hub"
 	custommw "github.com/jawaracloud/waiting-room-demo/internal/middleware"
-	"github.com/jawaracloud/waiting-room-demo/internal/service"
-	"github.com/jawaracloud/waiting-room-demo/internal/store"
+	"github.com/jawaracloud/waiting-room-demo/internal/queue"
+	"github.com/jawaracloud/waiting-room-demo/internal/storage"
+	"github.com/jawaracloud/waiting-room-demo/internal/token"
+	"github.com/jawaracloud/waiting-room-demo/internal/waitpage"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
@@ -27,32 +34,38 @@ func main() {
 	// Load configuration
 	config := loadConfig()
 
-	// Initialize RSA key pair for JWT
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		log.Fatalf("Failed to generate RSA key: %v", err)
+	if !token.ValidBinding(config.ClientBinding) {
+		log.Fatalf("Invalid client binding configuration: unknown mode %q", config.ClientBinding)
+	}
+	if config.HeartbeatTimeout <= config.HeartbeatInterval {
+		log.Fatalf("HEARTBEAT_TIMEOUT must be longer than HEARTBEAT_INTERVAL")
+	}
+	if config.ChallengeBits < 1 || config.ChallengeMaxBits < config.ChallengeBits || config.ChallengeMaxBits > 64 {
+		log.Fatalf("CHALLENGE_DIFFICULTY must be at least 1 and at most CHALLENGE_MAX_DIFFICULTY, which must be at most 64")
+	}
+	if config.ChallengeTTL <= 0 {
+		log.Fatalf("CHALLENGE_TTL must be positive")
 	}
 
-	// Initialize Redis client
-	redisClient := store.NewRedisClient(config.DragonFlyDBURL, 100)
-	ctx := context.Background()
+	// Load JWT signing keys
+	keys, err := loadKeys(config)
+	if err != nil {
+		log.Fatalf("Failed to load signing keys: %v", err)
+	}
 
-	// Test Redis connection
-	if err := redisClient.Ping(ctx).Err(); err != nil {
+	// Initialize storage
+	redisStorage, err := storage.NewRedisStorage(config.DragonFlyDBURL)
+	if err != nil {
 		log.Fatalf("Failed to connect to DragonFlyDB: %v", err)
 	}
 	log.Println("Connected to DragonFlyDB")
-
-	// Initialize store
-	redisStore := store.NewRedisStore(redisClient, store.StoreConfig{
-		PositionTTL: 30 * time.Minute,
-		SessionTTL:  1 * time.Hour,
-	})
+	ctx := context.Background()
 
 	// Initialize NATS broker
 	natsBroker, err := broker.NewNATSBroker(broker.NATSConfig{
-		URL:    config.NatsURL,
-		Source: "waitingroom-server",
+		URL:        config.NatsURL,
+		Source:     "waitingroom-server",
+		MaxPending: config.NatsMaxPending,
 	})
 	if err != nil {
 		log.Fatalf("Failed to connect to NATS: %v", err)
@@ -66,25 +79,52 @@ func main() {
 	}
 
 	// Initialize services
-	tokenService := service.NewTokenService(service.TokenServiceConfig{
-		PrivateKey: privateKey,
-		KeyID:      "key-2024-01",
-		QueueTTL:   30 * time.Minute,
-		SessionTTL: 1 * time.Hour,
-		IPSalt:     config.IPSalt,
-	}, redisStore)
-
-	queueService := service.NewQueueService(redisStore, natsBroker, tokenService, service.QueueServiceConfig{
-		DefaultPositionTTL: 30 * time.Minute,
-		DefaultSessionTTL:  1 * time.Hour,
-		HeartbeatTimeout:   60 * time.Second,
-		HeartbeatInterval:  10 * time.Second,
+	tokenService := token.NewService(redisStorage, token.Config{
+		Keys:          keys,
+		QueueTTL:      config.QueueTokenTTL,
+		SessionTTL:    config.SessionTTL,
+		RefreshWindow: config.RefreshWindow,
+		RefreshGrace:  config.RefreshGrace,
+		IPSalt:        config.IPSalt,
+		Cookie: token.CookieConfig{
+			Domain:   config.CookieDomain,
+			Insecure: !config.CookieSecure,
+			CSRFKey:  csrfKey(config),
+		},
 	})
 
-	heartbeatService := service.NewHeartbeatService(redisStore, natsBroker, service.HeartbeatConfig{
-		Timeout:         60 * time.Second,
-		CleanupInterval: 5 * time.Second,
-		BatchSize:       100,
+	// Challenges queues can require before enqueueing. Nonces are signed
+	// with CHALLENGE_SECRET, so without one no queue can require them.
+	var challenges []challenge.Challenge
+	if config.ChallengeSecret != "" {
+		challenges = append(challenges, challenge.NewHashcash(redisStorage, challenge.HashcashConfig{
+			Secret:        config.ChallengeSecret,
+			Difficulty:    config.ChallengeBits,
+			MaxDifficulty: config.ChallengeMaxBits,
+			Pressure:      float64(config.ChallengeRate),
+			TTL:           config.ChallengeTTL,
+		}))
+	}
+
+	queueService := queue.NewService(redisStorage, tokenService, natsBroker, queue.Config{
+		DefaultPositionTTL: config.PositionTTL,
+		DefaultSessionTTL:  config.SessionTTL,
+		HeartbeatTimeout:   config.HeartbeatTimeout,
+		HeartbeatInterval:  config.HeartbeatInterval,
+		AdmissionRate:      float64(config.AdmissionRate),
+		MaxActiveUsers:     int64(config.MaxActiveUsers),
+		MaxQueueSize:       int64(config.MaxQueueSize),
+		ClientBinding:      config.ClientBinding,
+		ResumeGrace:        config.ResumeGrace,
+		Challenges:         challenges,
+	})
+	if err := queueService.CheckChallenges(ctx); err != nil {
+		log.Fatalf("Set CHALLENGE_SECRET to run queues with challenges: %v", err)
+	}
+
+	heartbeatService := queue.NewHeartbeatService(redisStorage, queueService, queue.HeartbeatConfig{
+		Timeout:         config.HeartbeatTimeout,
+		CleanupInterval: config.CleanupInterval,
 	})
 
 	// Start heartbeat cleanup worker
@@ -93,40 +133,108 @@ func main() {
 	}
 	defer heartbeatService.Stop()
 
+	// Start admission worker
+	admissionController := queue.NewAdmissionController(redisStorage, natsBroker, queue.AdmissionConfig{
+		AdmissionRate:  float64(config.AdmissionRate),
+		MaxActiveUsers: int64(config.MaxActiveUsers),
+		NormalMinShare: float64(config.NormalMinSharePct) / 100,
+		Interval:       1 * time.Second,
+	})
+	if err := admissionController.Start(ctx); err != nil {
+		log.Fatalf("Failed to start admission controller: %v", err)
+	}
+	defer admissionController.Stop()
+
+	// Start live update hub
+	updateHub := hub.New(queueService, natsBroker, hub.Config{
+		Interval: 1 * time.Second,
+	})
+	if err := updateHub.Start(ctx); err != nil {
+		log.Fatalf("Failed to start update hub: %v", err)
+	}
+	defer updateHub.Stop()
+
+	// Rate limits, shared across replicas
+	rateLimiter := custommw.NewRateLimiter(redisStorage, tokenService, config.AdminKey, config.RateLimits)
+
 	// Initialize handlers
-	h := handler.NewHandler(queueService, tokenService, heartbeatService, handler.HandlerConfig{
-		HeartbeatInterval:  10 * time.Second,
-		HeartbeatTimeout:   60 * time.Second,
-		DefaultPositionTTL: 30 * time.Minute,
+	h := handler.NewHandler(queueService, tokenService, heartbeatService, updateHub, rateLimiter, handler.HandlerConfig{
+		HeartbeatInterval:  config.HeartbeatInterval,
+		HeartbeatTimeout:   config.HeartbeatTimeout,
+		DefaultPositionTTL: config.PositionTTL,
+		AdminKey:           config.AdminKey,
 	})
 
+	// Built-in waiting page, with any overrides
+	pages, err := waitpage.New(config.WaitingPageDir)
+	if err != nil {
+		log.Fatalf("Failed to load waiting page: %v", err)
+	}
+	room := waitpage.NewRoom(queueService, tokenService, pages, rateLimiter, config.HeartbeatInterval)
+
 	// Setup router
 	r := chi.NewRouter()
 
 	// Global middleware
 	r.Use(middleware.RequestID)
-	r.Use(middleware.RealIP)
+	r.Use(custommw.RealIP(config.TrustedProxies))
 	r.Use(middleware.Recoverer)
-	r.Use(middleware.Timeout(60 * time.Second))
 
 	// Custom middleware
 	r.Use(custommw.Logger)
 	r.Use(custommw.Recovery)
-	r.Use(custommw.CORS([]string{"*"}))
 
-	// API routes
-	r.Route("/api/v1", func(r chi.Router) {
-		h.RegisterRoutes(r)
-	})
+	// Unknown routes answer in the error envelope too
+	r.NotFound(handler.NotFound)
+	r.MethodNotAllowed(handler.MethodNotAllowed)
 
-	// Health check
-	r.Get("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("OK"))
+	r.Group(func(r chi.Router) {
+		// The gateway's proxied responses belong to the origin, so these
+		// only apply to the waiting room's own routes
+		r.Use(custommw.CORS(config.CORSOrigins))
+
+		// Live position updates stay open as long as the client does, so
+		// they are left out of the request timeout
+		timeout := middleware.Timeout(60 * time.Second)
+		r.Get("/ws/queues/{queue_id}", h.QueueSocket)
+
+		// API routes
+		r.Route("/api/v1", func(r chi.Router) {
+			h.RegisterStreamRoutes(r)
+			r.Group(func(r chi.Router) {
+				r.Use(timeout)
+				h.RegisterRoutes(r)
+			})
+		})
+
+		r.Group(func(r chi.Router) {
+			r.Use(timeout)
+
+			// Waiting page for browsers
+			r.Route(waitpage.Prefix, room.RegisterRoutes)
+
+			// Public keys for offline token verification
+			r.Get("/.well-known/jwks.json", h.JWKS)
+
+			// Health check
+			r.Get("/health", func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("OK"))
+			})
+
+			// Prometheus metrics
+			r.Handle("/metrics", promhttp.Handler())
+		})
 	})
 
-	// Prometheus metrics
-	r.Handle("/metrics", promhttp.Handler())
+	// Gateway mode: every other path is the origin site behind the queue
+	if config.GatewayQueue != "" {
+		r.Handle("/*", gateway.New(room, queueService, gateway.Config{
+			QueueID: config.GatewayQueue,
+			Rules:   config.GatewayRules,
+		}))
+		log.Printf("Gateway mode: proxying through queue %s", config.GatewayQueue)
+	}
 
 	// Start server
 	server := &http.Server{
@@ -160,22 +268,118 @@ func main() {
 
 // Config holds application configuration.
 type Config struct {
-	Port           int
-	DragonFlyDBURL string
-	NatsURL        string
-	IPSalt         string
-	LogLevel       string
+	Port              int
+	DragonFlyDBURL    string
+	NatsURL           string
+	NatsMaxPending    int
+	IPSalt            string
+	CSRFSecret        string
+	JWTKeysDir        string
+	JWTPrivateKey     string
+	JWTKeyID          string
+	AdminKey          string
+	ClientBinding     string
+	LogLevel          string
+	AdmissionRate     int
+	MaxActiveUsers    int
+	MaxQueueSize      int
+	NormalMinSharePct int
+	QueueTokenTTL     time.Duration
+	PositionTTL       time.Duration
+	SessionTTL        time.Duration
+	RefreshWindow     time.Duration
+	RefreshGrace      time.Duration
+	ResumeGrace       time.Duration
+	ChallengeSecret   string
+	ChallengeBits     int
+	ChallengeMaxBits  int
+	ChallengeRate     int
+	ChallengeTTL      time.Duration
+	HeartbeatInterval time.Duration
+	HeartbeatTimeout  time.Duration
+	CleanupInterval   time.Duration
+	RateLimits        map[string]custommw.Limit
+	GatewayQueue      string
+	GatewayRules      []gateway.Rule
+	WaitingPageDir    string
+	CookieDomain      string
+	CookieSecure      bool
+	CORSOrigins       []string
+	TrustedProxies    []netip.Prefix
 }
 
 // loadConfig loads configuration from environment variables.
 func loadConfig() Config {
 	return Config{
-		Port:           getEnvInt("PORT", 8080),
-		DragonFlyDBURL: getEnv("DRAGONFLYDB_URL", "localhost:6379"),
-		NatsURL:        getEnv("NATS_URL", "nats://localhost:4222"),
-		IPSalt:         getEnv("IP_SALT", "default-salt-change-in-production"),
-		LogLevel:       getEnv("LOG_LEVEL", "info"),
+		Port:              getEnvInt("PORT", 8080),
+		DragonFlyDBURL:    getEnv("DRAGONFLYDB_URL", "localhost:6379"),
+		NatsURL:           getEnv("NATS_URL", "nats://localhost:4222"),
+		NatsMaxPending:    getEnvInt("NATS_MAX_PENDING", broker.DefaultMaxPending),
+		IPSalt:            getEnv("IP_SALT", "default-salt-change-in-production"),
+		CSRFSecret:        getEnv("CSRF_SECRET", ""),
+		JWTKeysDir:        getEnv("JWT_KEYS_DIR", ""),
+		JWTPrivateKey:     getEnv("JWT_PRIVATE_KEY", ""),
+		JWTKeyID:          getEnv("JWT_KEY_ID", ""),
+		AdminKey:          getEnv("ADMIN_API_KEY", ""),
+		ClientBinding:     getEnv("CLIENT_BINDING", ""),
+		LogLevel:          getEnv("LOG_LEVEL", "info"),
+		AdmissionRate:     getEnvInt("ADMISSION_RATE", 10),
+		MaxActiveUsers:    getEnvInt("MAX_ACTIVE_USERS", 1000),
+		MaxQueueSize:      getEnvInt("MAX_QUEUE_SIZE", 0),
+		NormalMinSharePct: getEnvInt("NORMAL_MIN_SHARE_PCT", 0),
+		QueueTokenTTL:     getEnvDuration("QUEUE_TOKEN_TTL", 24*time.Hour),
+		PositionTTL:       getEnvDuration("POSITION_TTL", 30*time.Minute),
+		SessionTTL:        getEnvDuration("SESSION_TTL", 1*time.Hour),
+		RefreshWindow:     getEnvDuration("TOKEN_REFRESH_WINDOW", 5*time.Minute),
+		RefreshGrace:      getEnvDuration("TOKEN_REFRESH_GRACE", 30*time.Second),
+		ResumeGrace:       getEnvDuration("RESUME_GRACE", 0),
+		ChallengeSecret:   getEnv("CHALLENGE_SECRET", ""),
+		ChallengeBits:     getEnvInt("CHALLENGE_DIFFICULTY", 18),
+		ChallengeMaxBits:  getEnvInt("CHALLENGE_MAX_DIFFICULTY", 22),
+		ChallengeRate:     getEnvInt("CHALLENGE_PRESSURE", 600),
+		ChallengeTTL:      getEnvDuration("CHALLENGE_TTL", 2*time.Minute),
+		HeartbeatInterval: getEnvDuration("HEARTBEAT_INTERVAL", 10*time.Second),
+		HeartbeatTimeout:  getEnvDuration("HEARTBEAT_TIMEOUT", 60*time.Second),
+		CleanupInterval:   getEnvDuration("CLEANUP_INTERVAL", 5*time.Second),
+		RateLimits:        getEnvLimits("RATE_LIMITS"),
+		GatewayQueue:      getEnv("GATEWAY_QUEUE", ""),
+		GatewayRules:      getEnvRules("GATEWAY_RULES"),
+		WaitingPageDir:    getEnv("WAITING_PAGE_DIR", ""),
+		CookieDomain:      getEnv("COOKIE_DOMAIN", ""),
+		CookieSecure:      getEnvBool("COOKIE_SECURE", true),
+		CORSOrigins:       getEnvList("CORS_ALLOWED_ORIGINS", []string{"*"}),
+		TrustedProxies:    getEnvProxies("TRUSTED_PROXIES"),
+	}
+}
+
+// loadKeys loads the signing keys from JWT_KEYS_DIR or JWT_PRIVATE_KEY. With
+// neither set it falls back to a throwaway key, which only suits a single
+// development replica.
+func loadKeys(config Config) (*token.KeyManager, error) {
+	if config.JWTKeysDir == "" && config.JWTPrivateKey == "" {
+		log.Println("Warning: no JWT keys configured, generating an ephemeral signing key")
+		return token.GenerateKeys("dev-" + time.Now().UTC().Format("20060102150405"))
 	}
+	return token.LoadKeys(token.KeySource{
+		Dir:           config.JWTKeysDir,
+		PrivateKeyPEM: config.JWTPrivateKey,
+		ActiveKeyID:   config.JWTKeyID,
+	})
+}
+
+// csrfKey returns the key CSRF tokens are derived with. Without CSRF_SECRET
+// it falls back to a throwaway key, which only suits a single development
+// replica: tokens stop working on restart.
+func csrfKey(config Config) []byte {
+	if config.CSRFSecret != "" {
+		return []byte(config.CSRFSecret)
+	}
+	log.Println("Warning: CSRF_SECRET not set, generating an ephemeral CSRF key")
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatalf("Failed to generate CSRF key: %v", err)
+	}
+	return key
 }
 
 func getEnv(key, defaultValue string) string {
@@ -193,3 +397,78 @@ func getEnvInt(key string, defaultValue int) int {
 	}
 	return defaultValue
 }
+
+func getEnvBool(key string, defaultValue bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("Invalid %s: %q", key, value)
+	}
+	return b
+}
+
+// getEnvList parses a comma-separated list.
+func getEnvList(key string, defaultValue []string) []string {
+	var result []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	if len(result) == 0 {
+		return defaultValue
+	}
+	return result
+}
+
+// getEnvDuration parses a duration such as "90s" or "1h".
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Fatalf("Invalid %s: %q", key, value)
+	}
+	return d
+}
+
+// getEnvRules parses the gateway's path rules.
+func getEnvRules(key string) []gateway.Rule {
+	rules, err := gateway.ParseRules(os.Getenv(key))
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", key, err)
+	}
+	return rules
+}
+
+// getEnvProxies parses the networks whose X-Forwarded-For is believed.
+func getEnvProxies(key string) []netip.Prefix {
+	proxies, err := custommw.ParseTrustedProxies(os.Getenv(key))
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", key, err)
+	}
+	return proxies
+}
+
+// getEnvLimits returns the default rate limits with any limits set in key
+// overriding them. A limit of 0 requests disables that limit.
+func getEnvLimits(key string) map[string]custommw.Limit {
+	limits := make(map[string]custommw.Limit, len(custommw.DefaultLimits))
+	for name, limit := range custommw.DefaultLimits {
+		limits[name] = limit
+	}
+
+	overrides, err := custommw.ParseLimits(os.Getenv(key))
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", key, err)
+	}
+	for name, limit := range overrides {
+		limits[name] = limit
+	}
+	return limits
+}
@@ -0,0 +1,91 @@
+// Package apierror writes the JSON error envelope every endpoint responds
+// with, mapping domain error codes to HTTP statuses in one place.
+package apierror
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/jawaracloud/waiting-room-demo/pkg/models"
+)
+
+var statusByCode = map[string]int{
+	models.CodeInvalidRequest:   http.StatusBadRequest,
+	models.CodeUnauthorized:     http.StatusUnauthorized,
+	models.CodeTokenExpired:     http.StatusUnauthorized,
+	models.CodeTokenRevoked:     http.StatusUnauthorized,
+	models.CodeForbidden:        http.StatusForbidden,
+	models.CodeClientMismatch:   http.StatusForbidden,
+	models.CodeNotFound:         http.StatusNotFound,
+	models.CodeQueueExists:      http.StatusConflict,
+	models.CodeUpdateConflict:   http.StatusConflict,
+	models.CodeQueueClosed:      http.StatusGone,
+	models.CodeMethodNotAllowed: http.StatusMethodNotAllowed,
+	models.CodePositionExpired:  http.StatusGone,
+	models.CodeSessionExpired:   http.StatusGone,
+	models.CodeRateLimited:      http.StatusTooManyRequests,
+	models.CodeQueueFull:        http.StatusServiceUnavailable,
+	models.CodeMaintenanceMode:  http.StatusServiceUnavailable,
+	models.CodeQueueNotOpen:     http.StatusServiceUnavailable,
+	models.CodeAlreadyQueued:    http.StatusConflict,
+	models.CodeChallengeFailed:  http.StatusForbidden,
+	models.CodeInternalError:    http.StatusInternalServerError,
+}
+
+var errInternal = models.NewError(models.CodeInternalError, "Internal server error")
+
+// Envelope is the body of every error response.
+type Envelope struct {
+	Error     Body   `json:"error"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// Body describes the error.
+type Body struct {
+	Code    string         `json:"code"`
+	Message string         `json:"message"`
+	Details map[string]any `json:"details,omitempty"`
+}
+
+// Status returns the HTTP status for an error code.
+func Status(code string) int {
+	if status, ok := statusByCode[code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// Write responds with err in the error envelope. Errors other than
+// *models.Error are logged and reported as INTERNAL_ERROR, so their text
+// never reaches the client. A retry_after_seconds detail is also sent as
+// Retry-After.
+func Write(w http.ResponseWriter, r *http.Request, err error) {
+	requestID := middleware.GetReqID(r.Context())
+
+	var domainErr *models.Error
+	if !errors.As(err, &domainErr) {
+		log.Printf("internal error: %v request_id=%s", err, requestID)
+		domainErr = errInternal
+	}
+
+	if retryAfter, ok := domainErr.Details["retry_after_seconds"].(int64); ok {
+		w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(Status(domainErr.Code))
+	body := Envelope{
+		Error: Body{
+			Code:    domainErr.Code,
+			Message: domainErr.Message,
+			Details: domainErr.Details,
+		},
+		RequestID: requestID,
+	}
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("writing response: %v", err)
+	}
+}
@@ -0,0 +1,228 @@
+// Package broker publishes waiting room lifecycle events to NATS JetStream.
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// EventVersion is the envelope schema version stamped on every event.
+const EventVersion = "1.0"
+
+const (
+	// DefaultMaxPending is how many publishes may await their ack before
+	// further events are dropped.
+	DefaultMaxPending = 4096
+
+	// ackTimeout is how long a publish waits for its ack before it counts as
+	// failed and frees its place in the pending window.
+	ackTimeout = 5 * time.Second
+
+	// closeTimeout bounds how long Close waits for pending acks.
+	closeTimeout = 5 * time.Second
+)
+
+// eventsDropped counts events that were never stored in JetStream, because
+// the pending window was full or the publish failed.
+var eventsDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "waitingroom_events_dropped_total",
+	Help: "Events dropped because too many publishes were pending or a publish failed",
+}, []string{"reason"})
+
+// Event is the base envelope every event is published in, see docs/NATS_EVENTS.md.
+type Event struct {
+	ID        string    `json:"id"`
+	Version   string    `json:"version"`
+	Type      string    `json:"type"`
+	Timestamp time.Time `json:"timestamp"`
+	Source    string    `json:"source"`
+	TraceID   string    `json:"trace_id,omitempty"`
+	QueueID   string    `json:"queue_id,omitempty"`
+	Data      any       `json:"data"`
+}
+
+// NATSConfig holds NATS connection configuration.
+type NATSConfig struct {
+	URL        string
+	Source     string // service name stamped on published events
+	Replicas   int    // stream replicas, 1 when unset
+	MaxPending int    // publishes awaiting their ack before events are dropped, DefaultMaxPending when unset
+}
+
+// NATSBroker publishes events to JetStream.
+type NATSBroker struct {
+	nc     *nats.Conn
+	js     jetstream.JetStream
+	config NATSConfig
+}
+
+// NewNATSBroker connects to NATS and opens a JetStream context.
+func NewNATSBroker(config NATSConfig) (*NATSBroker, error) {
+	if config.Replicas <= 0 {
+		config.Replicas = 1
+	}
+	if config.MaxPending <= 0 {
+		config.MaxPending = DefaultMaxPending
+	}
+
+	nc, err := nats.Connect(config.URL,
+		nats.Name(config.Source),
+		nats.MaxReconnects(-1),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	js, err := jetstream.New(nc,
+		jetstream.WithPublishAsyncMaxPending(config.MaxPending),
+		jetstream.WithPublishAsyncTimeout(ackTimeout),
+		jetstream.WithPublishAsyncErrHandler(func(_ jetstream.JetStream, msg *nats.Msg, err error) {
+			eventsDropped.WithLabelValues("failed").Inc()
+			log.Printf("publishing %s: %v", msg.Subject, err)
+		}),
+	)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	return &NATSBroker{nc: nc, js: js, config: config}, nil
+}
+
+// streams mirrors the stream definitions in docs/NATS_EVENTS.md.
+var streams = []jetstream.StreamConfig{
+	{
+		Name:       "POSITION_EVENTS",
+		Subjects:   []string{"waitingroom.position.*.v1"},
+		Retention:  jetstream.LimitsPolicy,
+		MaxMsgs:    1_000_000,
+		MaxBytes:   1 << 30,
+		MaxAge:     7 * 24 * time.Hour,
+		Duplicates: 5 * time.Minute,
+	},
+	{
+		Name:       "SESSION_EVENTS",
+		Subjects:   []string{"waitingroom.session.*.v1"},
+		Retention:  jetstream.LimitsPolicy,
+		MaxMsgs:    500_000,
+		MaxBytes:   512 << 20,
+		MaxAge:     7 * 24 * time.Hour,
+		Duplicates: 5 * time.Minute,
+	},
+	{
+		Name:       "QUEUE_EVENTS",
+		Subjects:   []string{"waitingroom.queue.*.v1"},
+		Retention:  jetstream.LimitsPolicy,
+		MaxMsgs:    100_000,
+		MaxBytes:   100 << 20,
+		MaxAge:     30 * 24 * time.Hour,
+		Duplicates: 5 * time.Minute,
+	},
+	{
+		Name:       "SYSTEM_EVENTS",
+		Subjects:   []string{"waitingroom.system.*.v1"},
+		Retention:  jetstream.LimitsPolicy,
+		MaxMsgs:    100_000,
+		MaxBytes:   100 << 20,
+		MaxAge:     24 * time.Hour,
+		Duplicates: time.Minute,
+	},
+}
+
+// SetupStreams creates the event streams, or updates them to the current
+// definitions if they already exist.
+func (b *NATSBroker) SetupStreams(ctx context.Context) error {
+	for _, cfg := range streams {
+		cfg.Replicas = b.config.Replicas
+		if _, err := b.js.CreateOrUpdateStream(ctx, cfg); err != nil {
+			return fmt.Errorf("stream %s: %w", cfg.Name, err)
+		}
+	}
+	return nil
+}
+
+// Publish wraps data in the event envelope and publishes it on subject. The
+// event ID doubles as the JetStream message ID, so retried publishes are
+// deduplicated within the stream's duplicate window.
+//
+// Publishing doesn't wait for JetStream's ack, so a slow or unreachable
+// server never holds up enqueues or admissions. Once MaxPending publishes
+// await their ack, further events are dropped and counted in
+// waitingroom_events_dropped_total, as are publishes that fail.
+func (b *NATSBroker) Publish(ctx context.Context, subject, queueID string, data any) error {
+	event := Event{
+		ID:        uuid.New().String(),
+		Version:   EventVersion,
+		Type:      eventType(subject),
+		Timestamp: time.Now().UTC(),
+		Source:    b.config.Source,
+		QueueID:   queueID,
+		Data:      data,
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	if b.js.PublishAsyncPending() >= b.config.MaxPending {
+		eventsDropped.WithLabelValues("overflow").Inc()
+		return nil
+	}
+	// Another caller can take the last place first; the stall wait keeps
+	// that from blocking for more than a moment
+	_, err = b.js.PublishAsync(subject, payload, jetstream.WithMsgID(event.ID), jetstream.WithStallWait(time.Millisecond))
+	if errors.Is(err, jetstream.ErrTooManyStalledMsgs) {
+		eventsDropped.WithLabelValues("overflow").Inc()
+		return nil
+	}
+	return err
+}
+
+// Subscribe delivers the raw payload of every message on subject, published
+// by any replica, to handle. Subscriptions are plain NATS, not JetStream
+// consumers, so each replica sees every message. The returned function
+// unsubscribes.
+func (b *NATSBroker) Subscribe(subject string, handle func(data []byte)) (func(), error) {
+	sub, err := b.nc.Subscribe(subject, func(msg *nats.Msg) {
+		handle(msg.Data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return func() { _ = sub.Unsubscribe() }, nil
+}
+
+// Close waits briefly for pending publishes to be acked, then drains and
+// closes the connection.
+func (b *NATSBroker) Close() {
+	select {
+	case <-b.js.PublishAsyncComplete():
+	case <-time.After(closeTimeout):
+		log.Printf("closing NATS with %d publishes pending", b.js.PublishAsyncPending())
+	}
+	if err := b.nc.Drain(); err != nil {
+		b.nc.Close()
+	}
+}
+
+// eventType turns a subject such as waitingroom.position.enqueued.v1 into
+// the envelope type position.enqueued.
+func eventType(subject string) string {
+	parts := strings.Split(subject, ".")
+	if len(parts) != 4 {
+		return subject
+	}
+	return parts[1] + "." + parts[2]
+}
@@ -0,0 +1,39 @@
+// Package challenge makes clients prove some effort before they may join a
+// queue, to slow down bots that rate limits per IP address can't stop.
+package challenge
+
+import (
+	"context"
+	"time"
+
+	"github.com/jawaracloud/waiting-room-demo/pkg/models"
+)
+
+var (
+	ErrChallengeRequired = models.NewError(models.CodeChallengeFailed, "This queue requires a solved challenge")
+	ErrInvalidSolution   = models.NewError(models.CodeChallengeFailed, "Challenge solution is invalid")
+	ErrChallengeExpired  = models.NewError(models.CodeChallengeFailed, "Challenge has expired")
+	ErrChallengeUsed     = models.NewError(models.CodeChallengeFailed, "Challenge has already been used")
+)
+
+// Challenge issues puzzles that a client must solve before it may enqueue,
+// and verifies their solutions. Queues pick a challenge by its Type.
+type Challenge interface {
+	// Type names the challenge in queue configurations.
+	Type() string
+
+	// Issue creates a challenge for an enqueue into a queue.
+	Issue(ctx context.Context, queueID string, now time.Time) (*models.Challenge, error)
+
+	// Verify checks a solution to a challenge issued for the queue, which it
+	// then uses up.
+	Verify(ctx context.Context, queueID string, solution *models.ChallengeSolution, now time.Time) error
+
+	// Release gives back a solution Verify used up, for an enqueue that
+	// failed afterwards, so the client can send it again.
+	Release(ctx context.Context, queueID string, solution *models.ChallengeSolution) error
+
+	// Accept records that a solution Verify used up got its client a
+	// position in the queue.
+	Accept(ctx context.Context, queueID string, now time.Time) error
+}
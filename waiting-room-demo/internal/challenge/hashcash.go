@@ -0,0 +1,194 @@
+package challenge
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jawaracloud/waiting-room-demo/pkg/models"
+)
+
+// maxSolution is the longest solution accepted, in decimal digits.
+const maxSolution = 20
+
+// HashcashStore counts accepted solutions and remembers used challenges,
+// across every replica.
+type HashcashStore interface {
+	RecordSolution(ctx context.Context, queueID string, now time.Time) error
+	SolutionRate(ctx context.Context, queueID string, now time.Time) (float64, error)
+	UseChallenge(ctx context.Context, queueID, challengeID string, ttl time.Duration) (bool, error)
+	ReleaseChallenge(ctx context.Context, queueID, challengeID string) error
+}
+
+// HashcashConfig configures hashcash challenges.
+type HashcashConfig struct {
+	Secret        string        // signs nonces, shared by every replica
+	Difficulty    int           // leading zero bits required at low pressure
+	MaxDifficulty int           // leading zero bits required at most
+	Pressure      float64       // solutions accepted per minute above which difficulty rises
+	TTL           time.Duration // how long a challenge can be solved for
+}
+
+// Hashcash is a proof-of-work challenge: the client must find a decimal
+// solution such that the SHA-256 hash of nonce:solution starts with as many
+// zero bits as the difficulty, which takes about 2^difficulty tries. The
+// difficulty goes up a bit, doubling the work, each time the rate of
+// solutions accepted for the queue doubles past the configured pressure.
+// Only solutions that got their client a position count, so neither fetching
+// challenges nor sending solutions to a full queue can drive the difficulty
+// up for everyone else.
+//
+// Nonces are queue_id.difficulty.expiry.id.signature, so that none of it has
+// to be stored until a solution is accepted.
+type Hashcash struct {
+	store  HashcashStore
+	config HashcashConfig
+}
+
+// NewHashcash creates a hashcash challenge.
+func NewHashcash(store HashcashStore, config HashcashConfig) *Hashcash {
+	return &Hashcash{store: store, config: config}
+}
+
+// Type implements Challenge.
+func (h *Hashcash) Type() string {
+	return models.ChallengeHashcash
+}
+
+// Issue implements Challenge.
+func (h *Hashcash) Issue(ctx context.Context, queueID string, now time.Time) (*models.Challenge, error) {
+	rate, err := h.store.SolutionRate(ctx, queueID, now)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	difficulty := h.difficulty(rate)
+	expiresAt := now.Add(h.config.TTL).Truncate(time.Millisecond)
+	payload := fmt.Sprintf("%s.%d.%d.%s", queueID, difficulty, expiresAt.UnixMilli(), hex.EncodeToString(id))
+	return &models.Challenge{
+		Type:       models.ChallengeHashcash,
+		Nonce:      payload + "." + h.sign(payload),
+		Difficulty: difficulty,
+		ExpiresAt:  expiresAt.UTC(),
+	}, nil
+}
+
+// Verify implements Challenge.
+func (h *Hashcash) Verify(ctx context.Context, queueID string, solution *models.ChallengeSolution, now time.Time) error {
+	if solution == nil || solution.Nonce == "" {
+		return ErrChallengeRequired
+	}
+	parts, ok := h.parse(queueID, solution.Nonce)
+	if !ok {
+		return ErrInvalidSolution
+	}
+	difficulty, _ := strconv.Atoi(parts[1])
+	expiresMillis, _ := strconv.ParseInt(parts[2], 10, 64)
+	if now.UnixMilli() >= expiresMillis {
+		return ErrChallengeExpired
+	}
+	if !validSolution(solution.Solution) || leadingZeros(solution.Nonce+":"+solution.Solution) < difficulty {
+		return ErrInvalidSolution
+	}
+
+	used, err := h.store.UseChallenge(ctx, queueID, parts[3], time.UnixMilli(expiresMillis).Sub(now))
+	if err != nil {
+		return err
+	}
+	if !used {
+		return ErrChallengeUsed
+	}
+	return nil
+}
+
+// Release implements Challenge.
+func (h *Hashcash) Release(ctx context.Context, queueID string, solution *models.ChallengeSolution) error {
+	parts, ok := h.parse(queueID, solution.Nonce)
+	if !ok {
+		return ErrInvalidSolution
+	}
+	return h.store.ReleaseChallenge(ctx, queueID, parts[3])
+}
+
+// Accept implements Challenge.
+func (h *Hashcash) Accept(ctx context.Context, queueID string, now time.Time) error {
+	return h.store.RecordSolution(ctx, queueID, now)
+}
+
+// parse checks a nonce's signature and that it was issued for the queue, and
+// returns its payload's parts.
+func (h *Hashcash) parse(queueID, nonce string) ([]string, bool) {
+	payload, signature, ok := cut(nonce)
+	if !ok || subtle.ConstantTimeCompare([]byte(signature), []byte(h.sign(payload))) != 1 {
+		return nil, false
+	}
+	parts := strings.Split(payload, ".")
+	if len(parts) != 4 || parts[0] != queueID {
+		return nil, false
+	}
+	return parts, true
+}
+
+// difficulty is the number of zero bits to ask for at a rate of solutions
+// per minute.
+func (h *Hashcash) difficulty(rate float64) int {
+	difficulty := h.config.Difficulty
+	if h.config.Pressure > 0 && rate > h.config.Pressure {
+		difficulty += int(math.Ceil(math.Log2(rate / h.config.Pressure)))
+	}
+	return min(difficulty, h.config.MaxDifficulty)
+}
+
+func (h *Hashcash) sign(payload string) string {
+	mac := hmac.New(sha256.New, []byte(h.config.Secret))
+	mac.Write([]byte("challenge:" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// cut splits a nonce into its payload and signature.
+func cut(nonce string) (payload, signature string, ok bool) {
+	i := strings.LastIndexByte(nonce, '.')
+	if i < 0 {
+		return "", "", false
+	}
+	return nonce[:i], nonce[i+1:], true
+}
+
+func validSolution(solution string) bool {
+	if solution == "" || len(solution) > maxSolution {
+		return false
+	}
+	for _, c := range solution {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// leadingZeros counts the zero bits at the start of the SHA-256 hash of s.
+func leadingZeros(s string) int {
+	sum := sha256.Sum256([]byte(s))
+	zeros := 0
+	for _, b := range sum {
+		if b != 0 {
+			return zeros + bits.LeadingZeros8(b)
+		}
+		zeros += 8
+	}
+	return zeros
+}
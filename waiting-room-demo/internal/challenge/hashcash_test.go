@@ -0,0 +1,171 @@
+package challenge
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jawaracloud/waiting-room-demo/pkg/models"
+)
+
+// memoryStore is a HashcashStore for a single process.
+type memoryStore struct {
+	rate      float64
+	solutions int
+	used      map[string]bool
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{used: make(map[string]bool)}
+}
+
+func (m *memoryStore) RecordSolution(ctx context.Context, queueID string, now time.Time) error {
+	m.solutions++
+	return nil
+}
+
+func (m *memoryStore) SolutionRate(ctx context.Context, queueID string, now time.Time) (float64, error) {
+	return m.rate, nil
+}
+
+func (m *memoryStore) UseChallenge(ctx context.Context, queueID, challengeID string, ttl time.Duration) (bool, error) {
+	key := queueID + ":" + challengeID
+	if m.used[key] {
+		return false, nil
+	}
+	m.used[key] = true
+	return true, nil
+}
+
+func (m *memoryStore) ReleaseChallenge(ctx context.Context, queueID, challengeID string) error {
+	delete(m.used, queueID+":"+challengeID)
+	return nil
+}
+
+var testConfig = HashcashConfig{Secret: "secret", Difficulty: 4, MaxDifficulty: 8, Pressure: 60, TTL: time.Minute}
+
+// solve returns the first solution to a nonce with at least, or with fewer
+// than, difficulty leading zero bits.
+func solve(nonce string, difficulty int, enough bool) string {
+	for i := 0; ; i++ {
+		solution := strconv.Itoa(i)
+		if (leadingZeros(nonce+":"+solution) >= difficulty) == enough {
+			return solution
+		}
+	}
+}
+
+func TestHashcashVerify(t *testing.T) {
+	ctx := context.Background()
+	now := time.UnixMilli(1704067200000)
+	store := newMemoryStore()
+	h := NewHashcash(store, testConfig)
+
+	issued, err := h.Issue(ctx, "q", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := h.Issue(ctx, "other", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err := NewHashcash(store, HashcashConfig{Secret: "forged", Difficulty: 4, MaxDifficulty: 8, TTL: time.Minute}).Issue(ctx, "q", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	solution := func(c *models.Challenge) *models.ChallengeSolution {
+		return &models.ChallengeSolution{Nonce: c.Nonce, Solution: solve(c.Nonce, c.Difficulty, true)}
+	}
+
+	for _, tt := range []struct {
+		name     string
+		solution *models.ChallengeSolution
+		at       time.Time
+		want     error
+	}{
+		{"missing", nil, now, ErrChallengeRequired},
+		{"bad signature", solution(forged), now, ErrInvalidSolution},
+		{"tampered", &models.ChallengeSolution{Nonce: issued.Nonce + "x", Solution: solution(issued).Solution}, now, ErrInvalidSolution},
+		{"another queue's nonce", solution(other), now, ErrInvalidSolution},
+		{"expired", solution(issued), issued.ExpiresAt, ErrChallengeExpired},
+		{"too few zero bits", &models.ChallengeSolution{Nonce: issued.Nonce, Solution: solve(issued.Nonce, issued.Difficulty, false)}, now, ErrInvalidSolution},
+		{"not a number", &models.ChallengeSolution{Nonce: issued.Nonce, Solution: "-1"}, now, ErrInvalidSolution},
+		{"valid", solution(issued), now, nil},
+		{"reused", solution(issued), now, ErrChallengeUsed},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := h.Verify(ctx, "q", tt.solution, tt.at); !errors.Is(err, tt.want) {
+				t.Fatalf("Verify = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	// Verifying alone doesn't count a solution
+	if store.solutions != 0 {
+		t.Fatalf("%d solutions counted before any was accepted", store.solutions)
+	}
+
+	// A released solution can be sent again
+	if err := h.Release(ctx, "q", solution(issued)); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Verify(ctx, "q", solution(issued), now); err != nil {
+		t.Fatalf("Verify after Release = %v", err)
+	}
+}
+
+func TestHashcashDifficulty(t *testing.T) {
+	h := NewHashcash(newMemoryStore(), testConfig)
+	for _, tt := range []struct {
+		rate float64
+		want int
+	}{
+		{0, 4},
+		{60, 4},  // at the pressure
+		{61, 5},  // just past it
+		{120, 5}, // double
+		{121, 6}, // past double
+		{480, 7}, // 8x
+		{960, 8}, // 16x, at the maximum
+		{1e9, 8}, // capped
+	} {
+		if got := h.difficulty(tt.rate); got != tt.want {
+			t.Errorf("difficulty(%v) = %d, want %d", tt.rate, got, tt.want)
+		}
+	}
+
+	// Without a pressure, the difficulty never rises
+	flat := NewHashcash(newMemoryStore(), HashcashConfig{Difficulty: 4, MaxDifficulty: 8})
+	if got := flat.difficulty(1e9); got != 4 {
+		t.Errorf("difficulty without pressure = %d, want 4", got)
+	}
+}
+
+func TestHashcashIssue(t *testing.T) {
+	ctx := context.Background()
+	now := time.UnixMilli(1704067200000)
+	store := newMemoryStore()
+	h := NewHashcash(store, testConfig)
+
+	// The difficulty follows the rate of accepted solutions
+	store.rate = 240
+	issued, err := h.Issue(ctx, "q", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issued.Difficulty != 6 || !issued.ExpiresAt.Equal(now.Add(time.Minute)) {
+		t.Fatalf("Issue = %+v", *issued)
+	}
+	if err := h.Verify(ctx, "q", &models.ChallengeSolution{Nonce: issued.Nonce, Solution: solve(issued.Nonce, 6, true)}, now); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Accept(ctx, "q", now); err != nil {
+		t.Fatal(err)
+	}
+	if store.solutions != 1 {
+		t.Fatalf("%d solutions counted, want 1", store.solutions)
+	}
+}
@@ -0,0 +1,126 @@
+// Package gateway puts a queue in front of an origin site as a reverse
+// proxy. Visitors to protected paths wait in the queue on the waiting page
+// and, once admitted, are proxied to the origin with a session cookie.
+package gateway
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/jawaracloud/waiting-room-demo/internal/queue"
+	"github.com/jawaracloud/waiting-room-demo/internal/waitpage"
+	"github.com/jawaracloud/waiting-room-demo/pkg/models"
+)
+
+// proxyTimeout bounds how long a proxied response may take to write, in
+// place of the server's write timeout, which is sized for the API.
+const proxyTimeout = 60 * time.Second
+
+var errNoOrigin = models.NewError(models.CodeInternalError, "Queue has no target_url to proxy to")
+
+// Config holds gateway configuration.
+type Config struct {
+	QueueID string
+	Rules   []Rule
+}
+
+// Gateway is an http.Handler that admits visitors through a queue before
+// proxying them to the queue's target_url origin.
+type Gateway struct {
+	room    *waitpage.Room
+	queue   *queue.Service
+	config  Config
+	proxies sync.Map // origin -> *httputil.ReverseProxy
+}
+
+// New creates a gateway that admits visitors to protected paths through room.
+func New(room *waitpage.Room, queueService *queue.Service, config Config) *Gateway {
+	return &Gateway{
+		room:   room,
+		queue:  queueService,
+		config: config,
+	}
+}
+
+// ServeHTTP proxies requests for unprotected paths and requests from admitted
+// visitors. Everyone else is shown the waiting page in place of the requested
+// URL until they are admitted.
+//
+// The path is cleaned before it is matched and proxied, so the origin is
+// sent the very path the rules were checked against.
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r = cleanRequest(r)
+	if Protected(g.config.Rules, r.URL.Path) && !g.room.Admit(w, r, g.config.QueueID, "/") {
+		return
+	}
+	g.proxy(w, r)
+}
+
+// cleanRequest returns r with its path cleaned, or r itself if the path is
+// clean. A cleaned path drops its escaped form, which may hide the dot
+// segments or slashes it resolved, such as "/static%2F..%2Fcheckout".
+func cleanRequest(r *http.Request) *http.Request {
+	cleaned := CleanPath(r.URL.Path)
+	if cleaned == r.URL.Path {
+		return r
+	}
+	r = r.Clone(r.Context())
+	r.URL.Path, r.URL.RawPath = cleaned, ""
+	return r
+}
+
+// proxy forwards a request to the origin of the queue's target_url.
+func (g *Gateway) proxy(w http.ResponseWriter, r *http.Request) {
+	q, err := g.queue.Queue(r.Context(), g.config.QueueID)
+	if err != nil && !errors.Is(err, queue.ErrQueueNotFound) {
+		g.room.Error(w, r, g.config.QueueID, err)
+		return
+	}
+	if q == nil || q.TargetURL == "" {
+		g.room.Error(w, r, g.config.QueueID, errNoOrigin)
+		return
+	}
+	target, err := url.Parse(q.TargetURL)
+	if err != nil {
+		g.room.Error(w, r, g.config.QueueID, err)
+		return
+	}
+	origin := &url.URL{Scheme: target.Scheme, Host: target.Host}
+
+	rc := http.NewResponseController(w)
+	if r.Header.Get("Upgrade") != "" {
+		// Upgraded connections, such as the origin's WebSockets, last as long
+		// as either side keeps them open
+		_ = rc.SetReadDeadline(time.Time{})
+		_ = rc.SetWriteDeadline(time.Time{})
+		r = r.WithContext(context.WithoutCancel(r.Context()))
+	} else {
+		_ = rc.SetWriteDeadline(time.Now().Add(proxyTimeout))
+	}
+	g.reverseProxy(origin).ServeHTTP(w, r)
+}
+
+// reverseProxy returns the proxy for an origin, creating it on first use.
+func (g *Gateway) reverseProxy(origin *url.URL) *httputil.ReverseProxy {
+	if proxy, ok := g.proxies.Load(origin.String()); ok {
+		return proxy.(*httputil.ReverseProxy)
+	}
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(origin)
+			pr.SetXForwarded()
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("gateway: proxying %s to %s: %v", r.URL.Path, origin, err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	actual, _ := g.proxies.LoadOrStore(origin.String(), proxy)
+	return actual.(*httputil.ReverseProxy)
+}
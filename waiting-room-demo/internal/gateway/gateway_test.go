@@ -0,0 +1,42 @@
+package gateway
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCleanRequest(t *testing.T) {
+	rules, err := ParseRules("bypass:/,protect:/checkout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		target        string
+		path, escaped string
+		protected     bool
+	}{
+		{"/static/app.js", "/static/app.js", "/static/app.js", false},
+		{"/static/../checkout", "/checkout", "/checkout", true},
+		{"//checkout", "/checkout", "/checkout", true},
+		// The escaped form hides the dot segments, so it is dropped
+		{"/static%2F..%2Fcheckout", "/checkout", "/checkout", true},
+		// A clean path keeps its escaped slash, which decodes to the path
+		// that was matched
+		{"/static/a%2Fb", "/static/a/b", "/static/a%2Fb", false},
+		{"/checkout%2Fpay", "/checkout/pay", "/checkout%2Fpay", true},
+	} {
+		r := httptest.NewRequest("GET", tt.target, nil)
+		original := *r.URL
+		cleaned := cleanRequest(r)
+		if cleaned.URL.Path != tt.path || cleaned.URL.EscapedPath() != tt.escaped {
+			t.Errorf("cleanRequest(%q) path = %q escaped %q, want %q escaped %q",
+				tt.target, cleaned.URL.Path, cleaned.URL.EscapedPath(), tt.path, tt.escaped)
+		}
+		if got := Protected(rules, cleaned.URL.Path); got != tt.protected {
+			t.Errorf("Protected(%q) = %v, want %v", tt.target, got, tt.protected)
+		}
+		if *r.URL != original {
+			t.Errorf("cleanRequest(%q) changed the original request", tt.target)
+		}
+	}
+}
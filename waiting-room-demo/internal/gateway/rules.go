@@ -0,0 +1,78 @@
+package gateway
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Rule actions
+const (
+	ActionProtect = "protect" // Visitors wait in the queue first
+	ActionBypass  = "bypass"  // Proxied straight to the origin
+)
+
+// Rule protects or bypasses the paths under Prefix.
+type Rule struct {
+	Prefix  string
+	Protect bool
+}
+
+// Protected reports whether path is behind the queue. The rule with the
+// longest prefix matching the cleaned path decides, so "/static/../checkout"
+// is matched as "/checkout"; paths no rule matches are protected.
+func Protected(rules []Rule, urlPath string) bool {
+	urlPath = CleanPath(urlPath)
+	protect, longest := true, -1
+	for _, rule := range rules {
+		if matches(rule.Prefix, urlPath) && len(rule.Prefix) > longest {
+			protect, longest = rule.Protect, len(rule.Prefix)
+		}
+	}
+	return protect
+}
+
+// matches reports whether prefix matches path on a segment boundary, so
+// "/static" matches "/static" and "/static/app.js" but not "/staticky".
+func matches(prefix, path string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// CleanPath resolves the dot segments and repeated slashes in a URL path the
+// way the origin would, keeping a trailing slash.
+func CleanPath(urlPath string) string {
+	if urlPath == "" {
+		return "/"
+	}
+	cleaned := path.Clean("/" + urlPath)
+	if strings.HasSuffix(urlPath, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// ParseRules parses rules written as action:prefix, separated by commas,
+// e.g. "bypass:/,protect:/checkout".
+func ParseRules(s string) ([]Rule, error) {
+	var rules []Rule
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		action, prefix, ok := strings.Cut(entry, ":")
+		if !ok || !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("gateway rule %q: want action:/path", entry)
+		}
+		switch action {
+		case ActionProtect, ActionBypass:
+		default:
+			return nil, fmt.Errorf("gateway rule %q: unknown action %q", entry, action)
+		}
+		rules = append(rules, Rule{Prefix: prefix, Protect: action == ActionProtect})
+	}
+	return rules, nil
+}
@@ -0,0 +1,91 @@
+package gateway
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRules(t *testing.T) {
+	for _, tt := range []struct {
+		in      string
+		want    []Rule
+		wantErr bool
+	}{
+		{in: "", want: nil},
+		{in: "protect:/checkout", want: []Rule{{Prefix: "/checkout", Protect: true}}},
+		{in: " bypass:/ , protect:/checkout ,", want: []Rule{{Prefix: "/"}, {Prefix: "/checkout", Protect: true}}},
+		{in: "protect:/a:b", want: []Rule{{Prefix: "/a:b", Protect: true}}},
+		{in: "protect", wantErr: true},
+		{in: "protect:checkout", wantErr: true},
+		{in: "allow:/checkout", wantErr: true},
+		{in: "bypass:/,protect", wantErr: true},
+	} {
+		got, err := ParseRules(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseRules(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseRules(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCleanPath(t *testing.T) {
+	for _, tt := range []struct {
+		in, want string
+	}{
+		{"", "/"},
+		{"/", "/"},
+		{"/shop", "/shop"},
+		{"/shop/", "/shop/"},
+		{"shop", "/shop"},
+		{"//shop//cart", "/shop/cart"},
+		{"/static/../checkout", "/checkout"},
+		{"/static/./app.js", "/static/app.js"},
+		{"/../../checkout/", "/checkout/"},
+		{"/shop/..", "/"},
+		{"/shop/../", "/"},
+	} {
+		if got := CleanPath(tt.in); got != tt.want {
+			t.Errorf("CleanPath(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestProtected(t *testing.T) {
+	rules, err := ParseRules("bypass:/,protect:/shop,bypass:/shop/static,protect:/shop/static/private/,bypass:/api/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		path string
+		want bool
+	}{
+		{"/", false},
+		{"/about", false},
+		{"/shop", true},
+		{"/shop/cart", true},
+		{"/shopping", false},    // not on a segment boundary
+		{"/shop/static", false}, // longest prefix wins
+		{"/shop/static/app.js", false},
+		{"/shop/staticky", true},
+		{"/shop/static/private/key", true},
+		{"/shop/static/private", false}, // the rule ends in a slash, so only paths under it match
+		{"/api/", false},
+		{"/api", false}, // falls back to bypass:/
+		{"/shop/static/../cart", true},
+		{"/shop/static/..", true},
+		{"//shop", true},
+		{"/shopping/../shop/cart", true},
+	} {
+		if got := Protected(rules, tt.path); got != tt.want {
+			t.Errorf("Protected(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+
+	// Paths no rule matches are protected
+	if !Protected([]Rule{{Prefix: "/static"}}, "/checkout") {
+		t.Error("unmatched path bypassed the queue")
+	}
+}
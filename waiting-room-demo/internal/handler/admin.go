@@ -0,0 +1,166 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jawaracloud/waiting-room-demo/internal/apierror"
+	"github.com/jawaracloud/waiting-room-demo/pkg/models"
+)
+
+// RevokeRequest is the optional body of the admin revocation endpoints.
+type RevokeRequest struct {
+	Reason string `json:"reason"`
+}
+
+// TerminateSessionResponse reports a terminated session.
+type TerminateSessionResponse struct {
+	SessionID    string    `json:"session_id"`
+	Status       string    `json:"status"`
+	TerminatedAt time.Time `json:"terminated_at"`
+	Reason       string    `json:"reason"`
+}
+
+// RevokePositionResponse reports a revoked position.
+type RevokePositionResponse struct {
+	PositionID string    `json:"position_id"`
+	QueueID    string    `json:"queue_id"`
+	Status     string    `json:"status"`
+	RevokedAt  time.Time `json:"revoked_at"`
+	Reason     string    `json:"reason"`
+}
+
+// requireAdminKey rejects requests without the configured X-Admin-Key. Admin
+// routes stay closed when no key is configured.
+func (h *Handler) requireAdminKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !h.isAdmin(r) {
+			apierror.Write(w, r, errAdminKey)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isAdmin reports whether the request carries the configured X-Admin-Key.
+func (h *Handler) isAdmin(r *http.Request) bool {
+	key := r.Header.Get("X-Admin-Key")
+	return h.config.AdminKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(h.config.AdminKey)) == 1
+}
+
+// TerminateSession handles DELETE /admin/sessions/{session_id}.
+func (h *Handler) TerminateSession(w http.ResponseWriter, r *http.Request) {
+	reason := revokeReason(r)
+
+	session, err := h.queue.TerminateSession(r.Context(), chi.URLParam(r, "session_id"), reason)
+	if err != nil {
+		apierror.Write(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, TerminateSessionResponse{
+		SessionID:    session.ID,
+		Status:       session.Status,
+		TerminatedAt: time.Now(),
+		Reason:       reason,
+	})
+}
+
+// RevokePosition handles DELETE /admin/queues/{queue_id}/positions/{position_id}.
+func (h *Handler) RevokePosition(w http.ResponseWriter, r *http.Request) {
+	queueID := chi.URLParam(r, "queue_id")
+	positionID := chi.URLParam(r, "position_id")
+	reason := revokeReason(r)
+
+	if err := h.queue.RevokePosition(r.Context(), queueID, positionID, reason); err != nil {
+		apierror.Write(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, RevokePositionResponse{
+		PositionID: positionID,
+		QueueID:    queueID,
+		Status:     "revoked",
+		RevokedAt:  time.Now(),
+		Reason:     reason,
+	})
+}
+
+// revokeReason reads the reason from the request body, defaulting to admin_revoked.
+func revokeReason(r *http.Request) string {
+	var req RevokeRequest
+	if r.ContentLength != 0 {
+		_ = json.NewDecoder(r.Body).Decode(&req)
+	}
+	if req.Reason == "" {
+		return models.ReasonAdminRevoked
+	}
+	return req.Reason
+}
+
+// CreateQueue handles POST /admin/queues.
+func (h *Handler) CreateQueue(w http.ResponseWriter, r *http.Request) {
+	var req models.QueueCreate
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apierror.Write(w, r, errInvalidBody)
+		return
+	}
+
+	queue, err := h.queue.CreateQueue(r.Context(), &req)
+	if err != nil {
+		apierror.Write(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, queue)
+}
+
+// GetQueue handles GET /admin/queues/{queue_id}.
+func (h *Handler) GetQueue(w http.ResponseWriter, r *http.Request) {
+	queue, err := h.queue.Queue(r.Context(), chi.URLParam(r, "queue_id"))
+	if err != nil {
+		apierror.Write(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, queue)
+}
+
+// UpdateQueue handles PATCH /admin/queues/{queue_id}, including pausing,
+// resuming, maintenance and closing through the status field.
+func (h *Handler) UpdateQueue(w http.ResponseWriter, r *http.Request) {
+	var req models.QueueUpdate
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apierror.Write(w, r, errInvalidBody)
+		return
+	}
+
+	queue, err := h.queue.UpdateQueue(r.Context(), chi.URLParam(r, "queue_id"), &req)
+	if err != nil {
+		apierror.Write(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, queue)
+}
+
+// QueueLottery handles GET /admin/queues/{queue_id}/lottery, the audit
+// record of a lottery queue's draw.
+func (h *Handler) QueueLottery(w http.ResponseWriter, r *http.Request) {
+	lottery, err := h.queue.Lottery(r.Context(), chi.URLParam(r, "queue_id"))
+	if err != nil {
+		apierror.Write(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, lottery)
+}
+
+// QueueStats handles GET /admin/queues/{queue_id}/stats.
+func (h *Handler) QueueStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := h.queue.Stats(r.Context(), chi.URLParam(r, "queue_id"))
+	if err != nil {
+		apierror.Write(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
@@ -0,0 +1,145 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-chi/chi/v5"
+	"github.com/jawaracloud/waiting-room-demo/internal/hub"
+	"github.com/jawaracloud/waiting-room-demo/internal/middleware"
+	"github.com/jawaracloud/waiting-room-demo/internal/queue"
+	"github.com/jawaracloud/waiting-room-demo/internal/storage"
+	"github.com/jawaracloud/waiting-room-demo/internal/token"
+)
+
+// noEvents drops published events and never delivers any.
+type noEvents struct{}
+
+func (noEvents) Publish(ctx context.Context, subject, queueID string, data any) error { return nil }
+
+func (noEvents) Subscribe(subject string, handle func(data []byte)) (func(), error) {
+	return func() {}, nil
+}
+
+// newTestRouter serves the API from a handler backed by an in-memory
+// DragonFlyDB.
+func newTestRouter(t *testing.T) http.Handler {
+	t.Helper()
+	server := miniredis.RunT(t)
+	st, err := storage.NewRedisStorage(server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := token.GenerateKeys("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := token.NewService(st, token.Config{
+		Keys:       keys,
+		QueueTTL:   time.Hour,
+		SessionTTL: time.Hour,
+		IPSalt:     "salt",
+		Cookie:     token.CookieConfig{Insecure: true, CSRFKey: []byte("csrf")},
+	})
+	queueService := queue.NewService(st, tokens, noEvents{}, queue.Config{
+		AdmissionRate:     1,
+		HeartbeatInterval: 10 * time.Second,
+		HeartbeatTimeout:  time.Minute,
+		DefaultSessionTTL: time.Hour,
+	})
+	heartbeat := queue.NewHeartbeatService(st, queueService, queue.HeartbeatConfig{Timeout: time.Minute})
+	limits := middleware.NewRateLimiter(st, tokens, "admin", map[string]middleware.Limit{})
+	h := NewHandler(queueService, tokens, heartbeat, hub.New(queueService, noEvents{}, hub.Config{}), limits, HandlerConfig{
+		HeartbeatInterval: 10 * time.Second,
+		HeartbeatTimeout:  time.Minute,
+		AdminKey:          "admin",
+	})
+
+	r := chi.NewRouter()
+	r.Route("/api/v1", h.RegisterRoutes)
+	return r
+}
+
+// cookieClient is a position enqueued with cookies: its queue cookie and the
+// CSRF token it was given.
+type cookieClient struct {
+	cookie *http.Cookie
+	csrf   string
+}
+
+func enqueueWithCookies(t *testing.T, router http.Handler) cookieClient {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/queues/shop/enqueue", strings.NewReader(`{"token_transport":"cookie"}`))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("enqueue = %d %s", rec.Code, rec.Body)
+	}
+
+	var resp EnqueueResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == token.QueueCookie {
+			return cookieClient{cookie: cookie, csrf: resp.CSRFToken}
+		}
+	}
+	t.Fatal("enqueue set no queue cookie")
+	return cookieClient{}
+}
+
+func TestCSRF(t *testing.T) {
+	router := newTestRouter(t)
+	alice := enqueueWithCookies(t, router)
+	bob := enqueueWithCookies(t, router)
+
+	for _, tt := range []struct {
+		name   string
+		method string
+		path   string
+		cookie *http.Cookie
+		bearer string
+		csrf   string
+		want   int
+	}{
+		{"heartbeat without token", http.MethodPost, "heartbeat", alice.cookie, "", "", http.StatusForbidden},
+		{"heartbeat with another position's token", http.MethodPost, "heartbeat", alice.cookie, "", bob.csrf, http.StatusForbidden},
+		{"heartbeat with a bogus token", http.MethodPost, "heartbeat", alice.cookie, "", "bogus", http.StatusForbidden},
+		{"heartbeat with token", http.MethodPost, "heartbeat", alice.cookie, "", alice.csrf, http.StatusOK},
+		{"status without token", http.MethodGet, "status", alice.cookie, "", "", http.StatusOK},
+		{"bearer heartbeat without token", http.MethodPost, "heartbeat", nil, alice.cookie.Value, "", http.StatusOK},
+		{"cancel without token", http.MethodDelete, "position", bob.cookie, "", "", http.StatusForbidden},
+		{"cancel with another position's token", http.MethodDelete, "position", bob.cookie, "", alice.csrf, http.StatusForbidden},
+		{"bearer cancel without token", http.MethodDelete, "position", nil, alice.cookie.Value, "", http.StatusOK},
+		{"cancel with token", http.MethodDelete, "position", bob.cookie, "", bob.csrf, http.StatusOK},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			body := strings.NewReader("{}")
+			if tt.method != http.MethodPost {
+				body = strings.NewReader("")
+			}
+			req := httptest.NewRequest(tt.method, "/api/v1/queues/shop/"+tt.path, body)
+			if tt.cookie != nil {
+				req.AddCookie(tt.cookie)
+			}
+			if tt.bearer != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.bearer)
+			}
+			if tt.csrf != "" {
+				req.Header.Set(token.CSRFHeader, tt.csrf)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("%s %s = %d %s, want %d", tt.method, tt.path, rec.Code, rec.Body, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+// Package handler implements the waiting room HTTP API.
+package handler
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jawaracloud/waiting-room-demo/internal/apierror"
+	"github.com/jawaracloud/waiting-room-demo/internal/hub"
+	"github.com/jawaracloud/waiting-room-demo/internal/middleware"
+	"github.com/jawaracloud/waiting-room-demo/internal/queue"
+	"github.com/jawaracloud/waiting-room-demo/internal/token"
+	"github.com/jawaracloud/waiting-room-demo/pkg/models"
+)
+
+var (
+	errSessionMismatch  = models.NewError(models.CodeForbidden, "Token was issued for a different session")
+	errInvalidBody      = models.NewError(models.CodeInvalidRequest, "Invalid request body")
+	errPositionNotFound = models.NewError(models.CodeNotFound, "Position not found")
+	errAdminKey         = models.NewError(models.CodeUnauthorized, "Missing or invalid admin key")
+	errPriority         = models.NewError(models.CodeForbidden, "Priority above normal requires the admin key")
+	errRouteNotFound    = models.NewError(models.CodeNotFound, "Route not found")
+	errMethodNotAllowed = models.NewError(models.CodeMethodNotAllowed, "Method not allowed")
+)
+
+// HandlerConfig holds HTTP layer configuration.
+type HandlerConfig struct {
+	HeartbeatInterval  time.Duration
+	HeartbeatTimeout   time.Duration
+	DefaultPositionTTL time.Duration
+	AdminKey           string
+}
+
+// Handler serves the public waiting room API.
+type Handler struct {
+	queue     *queue.Service
+	tokens    *token.Service
+	heartbeat *queue.HeartbeatService
+	hub       *hub.Hub
+	limits    *middleware.RateLimiter
+	config    HandlerConfig
+}
+
+// NewHandler creates a handler.
+func NewHandler(queueService *queue.Service, tokenService *token.Service, heartbeatService *queue.HeartbeatService, updates *hub.Hub, limits *middleware.RateLimiter, config HandlerConfig) *Handler {
+	return &Handler{
+		queue:     queueService,
+		tokens:    tokenService,
+		heartbeat: heartbeatService,
+		hub:       updates,
+		limits:    limits,
+		config:    config,
+	}
+}
+
+// RegisterRoutes mounts the API routes on r.
+func (h *Handler) RegisterRoutes(r chi.Router) {
+	r.Route("/queues/{queue_id}", func(r chi.Router) {
+		r.With(h.limits.Limit("challenge")).Get("/challenge", h.Challenge)
+		r.With(h.limits.Limit("enqueue")).Post("/enqueue", h.Enqueue)
+		r.With(h.limits.Limit("status")).Get("/status", h.Status)
+		r.With(h.limits.Limit("heartbeat")).Post("/heartbeat", h.Heartbeat)
+		r.Delete("/position", h.CancelPosition)
+	})
+
+	r.With(h.limits.Limit("refresh")).Post("/tokens/refresh", h.RefreshToken)
+
+	r.Route("/sessions/{session_id}", func(r chi.Router) {
+		r.Get("/", h.SessionStatus)
+		r.With(h.limits.Limit("activity")).Post("/activity", h.SessionActivity)
+	})
+
+	r.Route("/admin", func(r chi.Router) {
+		r.Use(h.limits.Limit("admin"))
+		r.Use(h.requireAdminKey)
+		r.Post("/queues", h.CreateQueue)
+		r.Get("/queues/{queue_id}", h.GetQueue)
+		r.Patch("/queues/{queue_id}", h.UpdateQueue)
+		r.Get("/queues/{queue_id}/stats", h.QueueStats)
+		r.Get("/queues/{queue_id}/lottery", h.QueueLottery)
+		r.Delete("/sessions/{session_id}", h.TerminateSession)
+		r.Delete("/queues/{queue_id}/positions/{position_id}", h.RevokePosition)
+	})
+}
+
+// RegisterStreamRoutes registers the live update routes, which stay open for
+// as long as the client does and so are kept apart from RegisterRoutes and
+// its request timeout.
+func (h *Handler) RegisterStreamRoutes(r chi.Router) {
+	r.Get("/queues/{queue_id}/events", h.QueueEvents)
+	r.Get("/queues/{queue_id}/ws", h.QueueSocket)
+}
+
+// NotFound answers requests for unknown routes in the error envelope.
+func NotFound(w http.ResponseWriter, r *http.Request) {
+	apierror.Write(w, r, errRouteNotFound)
+}
+
+// MethodNotAllowed answers requests with an unsupported method in the error envelope.
+func MethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	apierror.Write(w, r, errMethodNotAllowed)
+}
+
+// JWKS handles GET /.well-known/jwks.json, publishing the keys session
+// tokens can be verified with.
+func (h *Handler) JWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, h.tokens.JWKS())
+}
+
+// queueClaims validates the bearer token, or the queue cookie, and checks it
+// belongs to the queue in the path. Requests with the cookie that change state
+// must also send its CSRF token.
+func (h *Handler) queueClaims(r *http.Request) (*models.QueueToken, error) {
+	tokenString, fromCookie := queueToken(r)
+	claims, err := h.validateQueueToken(r, tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if fromCookie {
+		if err := h.checkCSRF(r, claims.PositionID); err != nil {
+			return nil, err
+		}
+	}
+	return claims, nil
+}
+
+func (h *Handler) validateQueueToken(r *http.Request, tokenString string) (*models.QueueToken, error) {
+	claims, err := h.tokens.ValidateQueueToken(r.Context(), tokenString, token.ClientFromRequest(r))
+	if err != nil {
+		return nil, err
+	}
+	if queueID := chi.URLParam(r, "queue_id"); queueID != "" && claims.QueueID != queueID {
+		return nil, queue.ErrWrongQueue
+	}
+	return claims, nil
+}
+
+// checkCSRF verifies the CSRF token of a request made with a position's
+// cookies, unless the request is safe.
+func (h *Handler) checkCSRF(r *http.Request, positionID string) error {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return nil
+	}
+	return h.tokens.CheckCSRF(positionID, r.Header.Get(token.CSRFHeader))
+}
+
+// queueToken returns the bearer token or, for browser clients, the queue
+// cookie, and whether it was the cookie.
+func queueToken(r *http.Request) (string, bool) {
+	if tokenString := bearerToken(r); tokenString != "" {
+		return tokenString, false
+	}
+	return cookieToken(r, token.QueueCookie)
+}
+
+// sessionToken returns the bearer token or, for browser clients, the session
+// cookie, and whether it was the cookie.
+func sessionToken(r *http.Request) (string, bool) {
+	if tokenString := bearerToken(r); tokenString != "" {
+		return tokenString, false
+	}
+	return cookieToken(r, token.SessionCookie)
+}
+
+func cookieToken(r *http.Request, name string) (string, bool) {
+	cookie, err := r.Cookie(name)
+	if err != nil || cookie.Value == "" {
+		return "", false
+	}
+	return cookie.Value, true
+}
+
+// queueCookiePath scopes queue cookies to the queue's API routes, which the
+// route being served is one of.
+func queueCookiePath(r *http.Request) string {
+	return path.Dir(r.URL.Path)
+}
+
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("writing response: %v", err)
+	}
+}
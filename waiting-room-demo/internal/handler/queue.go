@@ -0,0 +1,306 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jawaracloud/waiting-room-demo/internal/apierror"
+	"github.com/jawaracloud/waiting-room-demo/internal/token"
+	"github.com/jawaracloud/waiting-room-demo/pkg/models"
+)
+
+// Token transports an enqueue request can ask for
+const (
+	TransportBearer = "bearer" // Tokens in the response body, sent back as bearer tokens
+	TransportCookie = "cookie" // Tokens in HttpOnly cookies, with a CSRF token in the body
+)
+
+// EnqueueRequest is the body of an enqueue request.
+type EnqueueRequest struct {
+	Priority       int            `json:"priority"`                  // above 0 only with the admin key
+	Metadata       map[string]any `json:"metadata,omitempty"`        // user_id, if set, tells clients on one network apart
+	TokenTransport string         `json:"token_transport,omitempty"` // bearer by default
+
+	Challenge *models.ChallengeSolution `json:"challenge,omitempty"` // required by queues with a challenge
+}
+
+// EnqueueResponse is returned when a user joins a queue.
+type EnqueueResponse struct {
+	PositionID               string     `json:"position_id"`
+	QueueID                  string     `json:"queue_id"`
+	Priority                 int        `json:"priority"`
+	Position                 int64      `json:"position"`
+	LanePosition             int64      `json:"lane_position"`
+	QueueLength              int64      `json:"queue_length"`
+	EstimatedWaitSeconds     int64      `json:"estimated_wait_seconds"`
+	EstimatedWaitMinSeconds  int64      `json:"estimated_wait_min_seconds"`
+	EstimatedWaitMaxSeconds  int64      `json:"estimated_wait_max_seconds"`
+	Status                   string     `json:"status"`
+	Resumed                  bool       `json:"resumed"`
+	OpensAt                  *time.Time `json:"opens_at,omitempty"`
+	QueueStatus              string     `json:"queue_status"`
+	Token                    string     `json:"token,omitempty"`
+	CSRFToken                string     `json:"csrf_token,omitempty"`
+	HeartbeatIntervalSeconds int64      `json:"heartbeat_interval_seconds"`
+	HeartbeatTimeoutSeconds  int64      `json:"heartbeat_timeout_seconds"`
+	ExpiresAt                time.Time  `json:"expires_at"`
+}
+
+// StatusResponse describes a position in the queue.
+type StatusResponse struct {
+	PositionID           string     `json:"position_id"`
+	QueueID              string     `json:"queue_id"`
+	Status               string     `json:"status"`
+	OpensAt              *time.Time `json:"opens_at,omitempty"`
+	QueueStatus          string     `json:"queue_status"`
+	Priority             int        `json:"priority"`
+	Position             int64      `json:"position"`
+	LanePosition         int64      `json:"lane_position"`
+	QueueLength          int64      `json:"queue_length"`
+	EstimatedWaitSeconds int64      `json:"estimated_wait_seconds"`
+	EstimatedWaitMin     int64      `json:"estimated_wait_min_seconds"`
+	EstimatedWaitMax     int64      `json:"estimated_wait_max_seconds"`
+	Admitted             bool       `json:"admitted"`
+	Token                string     `json:"token,omitempty"`
+	CSRFToken            string     `json:"csrf_token,omitempty"`
+	ExpiresAt            *time.Time `json:"expires_at,omitempty"`
+	SessionID            string     `json:"session_id,omitempty"`
+	SessionToken         string     `json:"session_token,omitempty"`
+	RedirectURL          string     `json:"redirect_url,omitempty"`
+	SessionExpiresAt     *time.Time `json:"session_expires_at,omitempty"`
+}
+
+// HeartbeatResponse acknowledges a heartbeat.
+type HeartbeatResponse struct {
+	StatusResponse
+	NextHeartbeatSeconds int64 `json:"next_heartbeat_seconds"`
+}
+
+// CancelResponse confirms a cancelled position.
+type CancelResponse struct {
+	PositionID  string    `json:"position_id"`
+	Status      string    `json:"status"`
+	CancelledAt time.Time `json:"cancelled_at"`
+}
+
+// Enqueue handles POST /queues/{queue_id}/enqueue.
+func (h *Handler) Enqueue(w http.ResponseWriter, r *http.Request) {
+	var req EnqueueRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		apierror.Write(w, r, errInvalidBody)
+		return
+	}
+	switch req.TokenTransport {
+	case "", TransportBearer, TransportCookie:
+	default:
+		apierror.Write(w, r, errInvalidBody.WithDetails(map[string]any{"field": "token_transport"}))
+		return
+	}
+	// Browsers can't be trusted with their own priority; backends that decide
+	// it call with the admin key.
+	if req.Priority > 0 && !h.isAdmin(r) {
+		apierror.Write(w, r, errPriority.WithDetails(map[string]any{"field": "priority"}))
+		return
+	}
+	client := token.ClientFromRequest(r)
+	if userID, ok := req.Metadata["user_id"]; ok {
+		if client.UserID, ok = userID.(string); !ok {
+			apierror.Write(w, r, errInvalidBody.WithDetails(map[string]any{"field": "metadata.user_id"}))
+			return
+		}
+	}
+
+	tokenString, status, err := h.queue.Enqueue(r.Context(), chi.URLParam(r, "queue_id"), req.Priority, client, req.Challenge)
+	if err != nil {
+		apierror.Write(w, r, err)
+		return
+	}
+
+	resp := EnqueueResponse{
+		PositionID:               status.PositionID,
+		QueueID:                  status.QueueID,
+		Priority:                 status.Priority,
+		Position:                 status.Position,
+		LanePosition:             status.LanePosition,
+		QueueLength:              status.TotalInQueue,
+		EstimatedWaitSeconds:     status.WaitTimeEst,
+		EstimatedWaitMinSeconds:  status.WaitTimeMin,
+		EstimatedWaitMaxSeconds:  status.WaitTimeMax,
+		Status:                   positionState(status),
+		Resumed:                  status.Resumed,
+		OpensAt:                  status.OpensAt,
+		QueueStatus:              status.QueueState,
+		Token:                    tokenString,
+		HeartbeatIntervalSeconds: int64(h.heartbeatInterval(status) / time.Second),
+		HeartbeatTimeoutSeconds:  int64(h.heartbeatTimeout(status) / time.Second),
+		ExpiresAt:                status.ExpiresAt,
+	}
+	if req.TokenTransport == TransportCookie {
+		http.SetCookie(w, h.tokens.QueueCookie(r, tokenString, queueCookiePath(r), status.ExpiresAt))
+		resp.Token = ""
+		resp.CSRFToken = h.tokens.CSRFToken(status.PositionID)
+	}
+	code := http.StatusCreated
+	if status.Resumed {
+		code = http.StatusOK
+	}
+	writeJSON(w, code, resp)
+}
+
+// Challenge handles GET /queues/{queue_id}/challenge, for queues whose
+// enqueues must solve one.
+func (h *Handler) Challenge(w http.ResponseWriter, r *http.Request) {
+	challenge, err := h.queue.IssueChallenge(r.Context(), chi.URLParam(r, "queue_id"))
+	if err != nil {
+		apierror.Write(w, r, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, challenge)
+}
+
+// Status handles GET /queues/{queue_id}/status.
+func (h *Handler) Status(w http.ResponseWriter, r *http.Request) {
+	claims, err := h.queueClaims(r)
+	if err != nil {
+		apierror.Write(w, r, err)
+		return
+	}
+
+	status, err := h.queue.Status(r.Context(), claims)
+	if err != nil {
+		apierror.Write(w, r, err)
+		return
+	}
+	if !status.InQueue {
+		apierror.Write(w, r, errPositionNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, h.statusResponse(w, r, status))
+}
+
+// Heartbeat handles POST /queues/{queue_id}/heartbeat.
+func (h *Handler) Heartbeat(w http.ResponseWriter, r *http.Request) {
+	claims, err := h.queueClaims(r)
+	if err != nil {
+		apierror.Write(w, r, err)
+		return
+	}
+
+	status, err := h.heartbeat.Heartbeat(r.Context(), claims)
+	if err != nil {
+		apierror.Write(w, r, err)
+		return
+	}
+	if _, fromCookie := queueToken(r); fromCookie && status.Session == nil {
+		if err := h.refreshQueueCookie(w, r, claims); err != nil {
+			apierror.Write(w, r, err)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, HeartbeatResponse{
+		StatusResponse:       h.statusResponse(w, r, status),
+		NextHeartbeatSeconds: int64(h.heartbeatInterval(status) / time.Second),
+	})
+}
+
+// CancelPosition handles DELETE /queues/{queue_id}/position.
+func (h *Handler) CancelPosition(w http.ResponseWriter, r *http.Request) {
+	claims, err := h.queueClaims(r)
+	if err != nil {
+		apierror.Write(w, r, err)
+		return
+	}
+
+	if err := h.queue.Cancel(r.Context(), claims); err != nil {
+		apierror.Write(w, r, err)
+		return
+	}
+	if _, fromCookie := queueToken(r); fromCookie {
+		http.SetCookie(w, h.tokens.ClearQueueCookie(r, queueCookiePath(r)))
+	}
+
+	writeJSON(w, http.StatusOK, CancelResponse{
+		PositionID:  claims.PositionID,
+		Status:      "cancelled",
+		CancelledAt: time.Now().UTC(),
+	})
+}
+
+// statusResponse describes a status to the client that asked for it. Clients
+// using cookies get their session token as a cookie, and their CSRF token.
+func (h *Handler) statusResponse(w http.ResponseWriter, r *http.Request, status *models.QueueStatus) StatusResponse {
+	tokenString, fromCookie := queueToken(r)
+	if !fromCookie {
+		return newStatusResponse(status, tokenString)
+	}
+
+	resp := newStatusResponse(status, "")
+	resp.CSRFToken = h.tokens.CSRFToken(status.PositionID)
+	if session := status.Session; session != nil {
+		http.SetCookie(w, h.tokens.SessionCookie(r, session.Token, session.ExpiresAt))
+		resp.SessionToken = ""
+	}
+	return resp
+}
+
+func newStatusResponse(status *models.QueueStatus, token string) StatusResponse {
+	resp := StatusResponse{
+		PositionID:           status.PositionID,
+		QueueID:              status.QueueID,
+		Status:               positionState(status),
+		OpensAt:              status.OpensAt,
+		QueueStatus:          status.QueueState,
+		Priority:             status.Priority,
+		Position:             status.Position,
+		LanePosition:         status.LanePosition,
+		QueueLength:          status.TotalInQueue,
+		EstimatedWaitSeconds: status.WaitTimeEst,
+		EstimatedWaitMin:     status.WaitTimeMin,
+		EstimatedWaitMax:     status.WaitTimeMax,
+		Admitted:             status.Allowed,
+		RedirectURL:          status.TargetURL,
+	}
+	if session := status.Session; session != nil {
+		resp.SessionID = session.ID
+		resp.SessionToken = session.Token
+		resp.SessionExpiresAt = &session.ExpiresAt
+	} else {
+		resp.Token = token
+		resp.ExpiresAt = &status.ExpiresAt
+	}
+	return resp
+}
+
+// heartbeatInterval is the queue's heartbeat interval, or the server default.
+func (h *Handler) heartbeatInterval(status *models.QueueStatus) time.Duration {
+	if status.HeartbeatInterval > 0 {
+		return status.HeartbeatInterval
+	}
+	return h.config.HeartbeatInterval
+}
+
+// heartbeatTimeout is the queue's heartbeat timeout, or the server default.
+func (h *Handler) heartbeatTimeout(status *models.QueueStatus) time.Duration {
+	if status.HeartbeatTimeout > 0 {
+		return status.HeartbeatTimeout
+	}
+	return h.config.HeartbeatTimeout
+}
+
+func positionState(status *models.QueueStatus) string {
+	switch {
+	case status.Allowed:
+		return "admitted"
+	case status.PreQueue:
+		return "prequeue"
+	}
+	return "waiting"
+}
@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jawaracloud/waiting-room-demo/internal/apierror"
+	"github.com/jawaracloud/waiting-room-demo/internal/token"
+	"github.com/jawaracloud/waiting-room-demo/pkg/models"
+)
+
+// SessionResponse describes an admitted user's session.
+type SessionResponse struct {
+	*models.Session
+	RemainingSeconds int64 `json:"remaining_seconds"`
+}
+
+// SessionStatus handles GET /sessions/{session_id}.
+func (h *Handler) SessionStatus(w http.ResponseWriter, r *http.Request) {
+	claims, err := h.sessionClaims(r)
+	if err != nil {
+		apierror.Write(w, r, err)
+		return
+	}
+
+	session, err := h.queue.Session(r.Context(), claims)
+	if err != nil {
+		apierror.Write(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newSessionResponse(session))
+}
+
+// SessionActivity handles POST /sessions/{session_id}/activity.
+func (h *Handler) SessionActivity(w http.ResponseWriter, r *http.Request) {
+	claims, err := h.sessionClaims(r)
+	if err != nil {
+		apierror.Write(w, r, err)
+		return
+	}
+
+	session, err := h.queue.RecordActivity(r.Context(), claims)
+	if err != nil {
+		apierror.Write(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newSessionResponse(session))
+}
+
+// sessionClaims validates the bearer session token, or the session cookie,
+// and checks it belongs to the session in the path. Requests with the cookie
+// that change state must also send the CSRF token of the position the session
+// was admitted from.
+func (h *Handler) sessionClaims(r *http.Request) (*models.SessionToken, error) {
+	tokenString, fromCookie := sessionToken(r)
+	claims, err := h.tokens.ValidateSessionToken(r.Context(), tokenString, token.ClientFromRequest(r))
+	if err != nil {
+		return nil, err
+	}
+	if claims.SessionID != chi.URLParam(r, "session_id") {
+		return nil, errSessionMismatch
+	}
+	if fromCookie {
+		if err := h.checkCSRF(r, claims.PositionID); err != nil {
+			return nil, err
+		}
+	}
+	return claims, nil
+}
+
+func newSessionResponse(session *models.Session) SessionResponse {
+	remaining := int64(time.Until(session.ExpiresAt) / time.Second)
+	if remaining < 0 || session.Status != models.SessionActive {
+		remaining = 0
+	}
+	return SessionResponse{Session: session, RemainingSeconds: remaining}
+}
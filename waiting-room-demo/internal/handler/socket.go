@@ -0,0 +1,175 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/jawaracloud/waiting-room-demo/internal/apierror"
+	"github.com/jawaracloud/waiting-room-demo/internal/hub"
+	"github.com/jawaracloud/waiting-room-demo/internal/queue"
+	"github.com/jawaracloud/waiting-room-demo/pkg/models"
+)
+
+const (
+	socketWriteWait  = 10 * time.Second
+	socketMaxMessage = 4096
+	clientHeartbeat  = "heartbeat"
+)
+
+var (
+	upgrader = websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		// Clients authenticate with their queue token, not cookies, so any
+		// origin may connect.
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+
+	// cookieUpgrader is for clients authenticated with the queue cookie, which
+	// the browser would also send for another site's page. Only pages from
+	// this host may connect.
+	cookieUpgrader = websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+	}
+)
+
+// ClientMessage is a message sent by a WebSocket client.
+type ClientMessage struct {
+	Type string `json:"type"`
+}
+
+// QueueSocket handles GET /ws/queues/{queue_id} and
+// /queues/{queue_id}/ws, authenticated with the queue token as a bearer
+// token, token query parameter or queue cookie.
+func (h *Handler) QueueSocket(w http.ResponseWriter, r *http.Request) {
+	tokenString, fromCookie := streamToken(r)
+	claims, err := h.validateQueueToken(r, tokenString)
+	if err != nil {
+		apierror.Write(w, r, err)
+		return
+	}
+
+	u := &upgrader
+	if fromCookie {
+		u = &cookieUpgrader
+	}
+	conn, err := u.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already replied
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	sub := h.hub.Subscribe(ctx, claims)
+	defer h.hub.Unsubscribe(sub)
+
+	go func() {
+		defer cancel()
+		h.readSocket(ctx, conn, sub, claims)
+	}()
+	h.writeSocket(ctx, conn, sub, fromCookie)
+}
+
+// streamToken returns the bearer token or, for browser APIs such as
+// WebSocket and EventSource that can't set headers, the token query parameter
+// or queue cookie, and whether it was the cookie.
+func streamToken(r *http.Request) (string, bool) {
+	if tokenString := r.URL.Query().Get("token"); tokenString != "" && bearerToken(r) == "" {
+		return tokenString, false
+	}
+	return queueToken(r)
+}
+
+// withoutSessionToken leaves the session token out of an admitted message
+// for a client using cookies, which gets its session cookie from its next
+// status request instead, out of reach of scripts.
+func withoutSessionToken(msg hub.Message) hub.Message {
+	if admitted, ok := msg.Data.(hub.Admitted); ok {
+		admitted.SessionToken = ""
+		msg.Data = admitted
+	}
+	return msg
+}
+
+// readSocket treats each client heartbeat message as a heartbeat and answers
+// it with the current position.
+func (h *Handler) readSocket(ctx context.Context, conn *websocket.Conn, sub *hub.Subscriber, claims *models.QueueToken) {
+	conn.SetReadLimit(socketMaxMessage)
+	extend := func() error {
+		return conn.SetReadDeadline(time.Now().Add(h.config.HeartbeatTimeout))
+	}
+	_ = extend()
+	conn.SetPongHandler(func(string) error { return extend() })
+
+	for {
+		var msg ClientMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return
+		}
+		_ = extend()
+
+		if msg.Type != clientHeartbeat {
+			continue
+		}
+		if status, ok := h.streamHeartbeat(ctx, sub, claims); ok {
+			h.hub.Update(sub, status)
+		}
+	}
+}
+
+// streamHeartbeat records a heartbeat for a connected client, ending its
+// subscription if the position is gone.
+func (h *Handler) streamHeartbeat(ctx context.Context, sub *hub.Subscriber, claims *models.QueueToken) (*models.QueueStatus, bool) {
+	status, err := h.heartbeat.Heartbeat(ctx, claims)
+	switch {
+	case errors.Is(err, queue.ErrPositionNotFound):
+		h.hub.Expire(sub, models.ReasonHeartbeatTimeout)
+	case errors.Is(err, queue.ErrSessionExpired):
+		h.hub.Expire(sub, models.ReasonSessionTimeout)
+	case err != nil:
+		log.Printf("stream heartbeat: position %s: %v", claims.PositionID, err)
+	default:
+		return status, true
+	}
+	return nil, false
+}
+
+// writeSocket is the connection's only writer. It forwards hub messages and
+// pings the client, and closes the connection after a final message.
+func (h *Handler) writeSocket(ctx context.Context, conn *websocket.Conn, sub *hub.Subscriber, fromCookie bool) {
+	ping := time.NewTicker(h.config.HeartbeatInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-sub.Messages():
+			_ = conn.SetWriteDeadline(time.Now().Add(socketWriteWait))
+			if !ok {
+				_ = conn.WriteMessage(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				return
+			}
+			if fromCookie {
+				msg = withoutSessionToken(msg)
+			}
+			if err := conn.WriteJSON(msg); err != nil {
+				return
+			}
+		case <-ping.C:
+			_ = conn.SetWriteDeadline(time.Now().Add(socketWriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
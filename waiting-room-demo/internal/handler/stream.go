@@ -0,0 +1,114 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jawaracloud/waiting-room-demo/internal/apierror"
+	"github.com/jawaracloud/waiting-room-demo/internal/hub"
+)
+
+// streamRetry is the reconnection delay sent to EventSource clients.
+const streamRetry = 3 * time.Second
+
+// QueueEvents handles GET /api/v1/queues/{queue_id}/events, a Server-Sent
+// Events stream of the same messages as the WebSocket for clients behind
+// proxies that drop WebSockets. An open stream counts as a heartbeat.
+//
+// Each event carries an ID, so a reconnecting EventSource resumes from its
+// Last-Event-ID without being sent the position it already has, and is told
+// with 204 No Content to stop once it was sent its final message.
+func (h *Handler) QueueEvents(w http.ResponseWriter, r *http.Request) {
+	tokenString, fromCookie := streamToken(r)
+	claims, err := h.validateQueueToken(r, tokenString)
+	if err != nil {
+		apierror.Write(w, r, err)
+		return
+	}
+
+	lastPosition, done := parseLastEventID(r.Header.Get("Last-Event-ID"))
+	if done {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	write := func(format string, args ...any) error {
+		// Extend the server's write timeout for each write
+		_ = rc.SetWriteDeadline(time.Now().Add(socketWriteWait))
+		if _, err := fmt.Fprintf(w, format, args...); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+	if err := write("retry: %d\n\n", streamRetry.Milliseconds()); err != nil {
+		return
+	}
+
+	ctx := r.Context()
+	sub := h.hub.Resume(ctx, claims, lastPosition)
+	defer h.hub.Unsubscribe(sub)
+
+	ticker := time.NewTicker(h.config.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case msg, ok := <-sub.Messages():
+			if !ok {
+				return
+			}
+			if fromCookie {
+				msg = withoutSessionToken(msg)
+			}
+			data, err := json.Marshal(msg)
+			if err != nil {
+				return
+			}
+			if err := write("id: %s\ndata: %s\n\n", eventID(msg), data); err != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if status, ok := h.streamHeartbeat(ctx, sub, claims); ok {
+				h.hub.UpdateIfChanged(sub, status)
+			}
+			// Keep idle proxies from closing the stream
+			if err := write(": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// eventID is the position for position updates and the message type for
+// final messages.
+func eventID(msg hub.Message) string {
+	if update, ok := msg.Data.(hub.PositionUpdate); ok {
+		return strconv.FormatInt(update.Position, 10)
+	}
+	return msg.Type
+}
+
+// parseLastEventID returns the position a client was last sent, -1 if
+// unknown, and whether it was already sent its final message.
+func parseLastEventID(id string) (int64, bool) {
+	switch id {
+	case hub.MessageAdmitted, hub.MessageExpired:
+		return -1, true
+	}
+	position, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return -1, false
+	}
+	return position, false
+}
@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/jawaracloud/waiting-room-demo/internal/apierror"
+	"github.com/jawaracloud/waiting-room-demo/internal/token"
+	"github.com/jawaracloud/waiting-room-demo/pkg/models"
+)
+
+// RefreshResponse carries a token after a refresh request.
+type RefreshResponse struct {
+	Type      string    `json:"type"` // queue or session
+	Token     string    `json:"token,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Refreshed bool      `json:"refreshed"` // false while the token isn't near expiry yet
+	SessionID string    `json:"session_id,omitempty"`
+}
+
+// RefreshToken handles POST /tokens/refresh. A queue or session token near
+// expiry is replaced by one for the same position or session, with a new jti
+// and a new expiry; earlier on, the token is returned unchanged. Browser
+// clients refresh their session cookie here; their queue cookie is refreshed
+// by heartbeats.
+func (h *Handler) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	tokenString, fromCookie := sessionToken(r)
+	if !fromCookie {
+		claims, err := h.tokens.ValidateQueueToken(r.Context(), tokenString, token.ClientFromRequest(r))
+		if !errors.Is(err, token.ErrInvalidToken) {
+			h.refreshQueueToken(w, r, tokenString, claims, err)
+			return
+		}
+	}
+
+	claims, err := h.tokens.ValidateSessionToken(r.Context(), tokenString, token.ClientFromRequest(r))
+	if err == nil && fromCookie {
+		err = h.checkCSRF(r, claims.PositionID)
+	}
+	if err != nil {
+		apierror.Write(w, r, err)
+		return
+	}
+
+	resp := RefreshResponse{
+		Type:      models.TokenTypeSession,
+		Token:     tokenString,
+		ExpiresAt: claims.ExpiresAt.Time,
+		SessionID: claims.SessionID,
+	}
+	if h.tokens.Refreshable(resp.ExpiresAt) {
+		session, err := h.queue.RefreshSession(r.Context(), claims)
+		if err != nil {
+			apierror.Write(w, r, err)
+			return
+		}
+		resp.Token, resp.ExpiresAt, resp.Refreshed = session.Token, session.ExpiresAt, true
+	}
+	if fromCookie {
+		if resp.Refreshed {
+			http.SetCookie(w, h.tokens.SessionCookie(r, resp.Token, resp.ExpiresAt))
+		}
+		resp.Token = ""
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handler) refreshQueueToken(w http.ResponseWriter, r *http.Request, tokenString string, claims *models.QueueToken, err error) {
+	if err != nil {
+		apierror.Write(w, r, err)
+		return
+	}
+
+	resp := RefreshResponse{
+		Type:      models.TokenTypeQueue,
+		Token:     tokenString,
+		ExpiresAt: claims.RegisteredClaims.ExpiresAt.Time,
+	}
+	if h.tokens.Refreshable(resp.ExpiresAt) {
+		resp.Token, resp.ExpiresAt, err = h.tokens.RefreshQueueToken(r.Context(), claims, time.Now())
+		if err != nil {
+			apierror.Write(w, r, err)
+			return
+		}
+		resp.Refreshed = true
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// refreshQueueCookie replaces a browser client's queue cookie once its token
+// nears expiry, so that a long wait doesn't outlast it. A concurrent request
+// that got there first has already set the new cookie.
+func (h *Handler) refreshQueueCookie(w http.ResponseWriter, r *http.Request, claims *models.QueueToken) error {
+	if !h.tokens.Refreshable(claims.RegisteredClaims.ExpiresAt.Time) {
+		return nil
+	}
+	refreshed, expiresAt, err := h.tokens.RefreshQueueToken(r.Context(), claims, time.Now())
+	if errors.Is(err, token.ErrTokenRefreshed) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, h.tokens.QueueCookie(r, refreshed, queueCookiePath(r), expiresAt))
+	return nil
+}
@@ -0,0 +1,466 @@
+// Package hub pushes live queue updates to connected clients, independent of
+// the transport they are connected over.
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jawaracloud/waiting-room-demo/internal/queue"
+	"github.com/jawaracloud/waiting-room-demo/pkg/models"
+)
+
+// Server message types, see docs/API.md
+const (
+	MessagePositionUpdate = "position_update"
+	MessageAdmitted       = "admitted"
+	MessageExpired        = "expired"
+)
+
+// positionEvents matches every position event, from any replica.
+const positionEvents = "waitingroom.position.*.v1"
+
+// queueEvents matches every queue configuration event, from any replica.
+const queueEvents = "waitingroom.queue.*.v1"
+
+// Message is a server message pushed to a client.
+type Message struct {
+	Type string `json:"type"`
+	Data any    `json:"data"`
+}
+
+// PositionUpdate is the data of a position_update message.
+type PositionUpdate struct {
+	Position                int64  `json:"position"`
+	LanePosition            int64  `json:"lane_position"`
+	QueueLength             int64  `json:"queue_length"`
+	EstimatedWaitSeconds    int64  `json:"estimated_wait_seconds"`
+	EstimatedWaitMinSeconds int64  `json:"estimated_wait_min_seconds"`
+	EstimatedWaitMaxSeconds int64  `json:"estimated_wait_max_seconds"`
+	QueueStatus             string `json:"queue_status"`
+	PreQueue                bool   `json:"prequeue,omitempty"`
+}
+
+// Admitted is the data of an admitted message.
+type Admitted struct {
+	SessionID        string    `json:"session_id"`
+	SessionToken     string    `json:"session_token,omitempty"` // Left out for clients using cookies
+	SessionExpiresAt time.Time `json:"session_expires_at"`
+	RedirectURL      string    `json:"redirect_url,omitempty"`
+}
+
+// Expired is the data of an expired message.
+type Expired struct {
+	Reason string `json:"reason"`
+}
+
+// EventSource delivers the raw events published by every replica.
+type EventSource interface {
+	Subscribe(subject string, handle func(data []byte)) (func(), error)
+}
+
+// Config holds hub configuration.
+type Config struct {
+	// Interval is how often subscribers in queues whose order changed are
+	// sent their new position.
+	Interval time.Duration
+	// Workers bounds concurrent reads of positions that have to be read
+	// again during a refresh.
+	Workers int
+	// BufferSize is the number of messages buffered per subscriber.
+	BufferSize int
+}
+
+// Subscriber receives the updates for one position.
+type Subscriber struct {
+	claims      *models.QueueToken
+	mu          sync.Mutex
+	send        chan Message
+	closed      bool
+	position    atomic.Int64                       // last position sent
+	queueStatus atomic.Value                       // last queue status sent
+	status      atomic.Pointer[models.QueueStatus] // last status read from storage
+	stale       atomic.Bool                        // read again at the next refresh
+}
+
+// Messages returns the subscriber's messages. The channel is closed after
+// an admitted or expired message, or when the hub stops.
+func (s *Subscriber) Messages() <-chan Message {
+	return s.send
+}
+
+// deliver queues a message. Position updates are dropped when the buffer is
+// full, since a newer one will follow; a final message makes room for itself
+// and closes the channel.
+func (s *Subscriber) deliver(msg Message, final bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+
+	select {
+	case s.send <- msg:
+	default:
+		if !final {
+			return
+		}
+		select {
+		case <-s.send:
+		default:
+		}
+		s.send <- msg
+	}
+	if final {
+		s.close()
+	}
+}
+
+func (s *Subscriber) close() {
+	if !s.closed {
+		s.closed = true
+		close(s.send)
+	}
+}
+
+// Hub tracks the subscribers connected to this replica and pushes them
+// updates. Position events from every replica mark queues as changed, so a
+// client connected to any replica learns of its admission within Interval.
+//
+// A changed queue's lanes are read once per refresh, and each subscriber's
+// position is moved on in memory from the last status read for it, by the
+// admissions from its lane since. Only subscribers that may have been
+// admitted are read again, so a refresh costs Redis work in proportion to
+// admissions rather than to subscribers. Positions ahead that expire or
+// cancel are caught up with by the client's next heartbeat.
+type Hub struct {
+	queue       *queue.Service
+	events      EventSource
+	config      Config
+	mu          sync.Mutex
+	subscribers map[string]map[*Subscriber]struct{} // by queue ID
+	positions   map[string]map[*Subscriber]struct{} // by position ID
+	changed     map[string]bool
+	unsubscribe []func()
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup
+}
+
+func New(queueService *queue.Service, events EventSource, config Config) *Hub {
+	if config.Interval <= 0 {
+		config.Interval = time.Second
+	}
+	if config.Workers <= 0 {
+		config.Workers = 16
+	}
+	if config.BufferSize <= 0 {
+		config.BufferSize = 8
+	}
+
+	return &Hub{
+		queue:       queueService,
+		events:      events,
+		config:      config,
+		subscribers: make(map[string]map[*Subscriber]struct{}),
+		positions:   make(map[string]map[*Subscriber]struct{}),
+		changed:     make(map[string]bool),
+	}
+}
+
+// Start subscribes to position and queue events and launches the refresh
+// worker.
+func (h *Hub) Start(ctx context.Context) error {
+	for _, subject := range []string{positionEvents, queueEvents} {
+		unsubscribe, err := h.events.Subscribe(subject, h.handleEvent)
+		if err != nil {
+			h.unsubscribeAll()
+			return err
+		}
+		h.unsubscribe = append(h.unsubscribe, unsubscribe)
+	}
+
+	ctx, h.cancel = context.WithCancel(ctx)
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		h.run(ctx)
+	}()
+	return nil
+}
+
+// Stop halts the hub and closes every subscriber.
+func (h *Hub) Stop() {
+	h.unsubscribeAll()
+	if h.cancel != nil {
+		h.cancel()
+	}
+	h.wg.Wait()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, subs := range h.subscribers {
+		for sub := range subs {
+			sub.mu.Lock()
+			sub.close()
+			sub.mu.Unlock()
+		}
+	}
+	h.subscribers = make(map[string]map[*Subscriber]struct{})
+	h.positions = make(map[string]map[*Subscriber]struct{})
+}
+
+func (h *Hub) unsubscribeAll() {
+	for _, unsubscribe := range h.unsubscribe {
+		unsubscribe()
+	}
+	h.unsubscribe = nil
+}
+
+// Subscribe registers a client for the position its validated token refers
+// to and sends it the current status.
+func (h *Hub) Subscribe(ctx context.Context, claims *models.QueueToken) *Subscriber {
+	return h.Resume(ctx, claims, -1)
+}
+
+// Resume registers a client reconnecting after it was last sent lastPosition.
+// The current status is only sent if the position has moved since.
+func (h *Hub) Resume(ctx context.Context, claims *models.QueueToken, lastPosition int64) *Subscriber {
+	sub := &Subscriber{
+		claims: claims,
+		send:   make(chan Message, h.config.BufferSize),
+	}
+	sub.position.Store(lastPosition)
+
+	h.mu.Lock()
+	add(h.subscribers, claims.QueueID, sub)
+	add(h.positions, claims.PositionID, sub)
+	h.mu.Unlock()
+
+	h.refresh(ctx, sub)
+	return sub
+}
+
+// Unsubscribe removes a subscriber, typically once its connection closes.
+func (h *Hub) Unsubscribe(sub *Subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	remove(h.subscribers, sub.claims.QueueID, sub)
+	remove(h.positions, sub.claims.PositionID, sub)
+}
+
+func add(index map[string]map[*Subscriber]struct{}, key string, sub *Subscriber) {
+	subs, ok := index[key]
+	if !ok {
+		subs = make(map[*Subscriber]struct{})
+		index[key] = subs
+	}
+	subs[sub] = struct{}{}
+}
+
+func remove(index map[string]map[*Subscriber]struct{}, key string, sub *Subscriber) {
+	if subs, ok := index[key]; ok {
+		delete(subs, sub)
+		if len(subs) == 0 {
+			delete(index, key)
+		}
+	}
+}
+
+// Update sends a subscriber the message for a status read from storage, for
+// example the one a client heartbeat just returned.
+func (h *Hub) Update(sub *Subscriber, status *models.QueueStatus) {
+	sub.status.Store(status)
+	h.send(sub, status)
+}
+
+// UpdateIfChanged is Update, except that a position the subscriber was
+// already sent is not sent again unless the queue's status changed.
+func (h *Hub) UpdateIfChanged(sub *Subscriber, status *models.QueueStatus) {
+	sub.status.Store(status)
+	h.sendIfChanged(sub, status)
+}
+
+func (h *Hub) send(sub *Subscriber, status *models.QueueStatus) {
+	switch {
+	case status.Session != nil:
+		sub.deliver(Message{Type: MessageAdmitted, Data: Admitted{
+			SessionID:        status.Session.ID,
+			SessionToken:     status.Session.Token,
+			SessionExpiresAt: status.Session.ExpiresAt,
+			RedirectURL:      status.TargetURL,
+		}}, true)
+		h.Unsubscribe(sub)
+	case !status.InQueue:
+		h.Expire(sub, models.ReasonExpired)
+	default:
+		sub.position.Store(status.Position)
+		sub.queueStatus.Store(status.QueueState)
+		sub.deliver(Message{Type: MessagePositionUpdate, Data: PositionUpdate{
+			Position:                status.Position,
+			LanePosition:            status.LanePosition,
+			QueueLength:             status.TotalInQueue,
+			EstimatedWaitSeconds:    status.WaitTimeEst,
+			EstimatedWaitMinSeconds: status.WaitTimeMin,
+			EstimatedWaitMaxSeconds: status.WaitTimeMax,
+			QueueStatus:             status.QueueState,
+			PreQueue:                status.PreQueue,
+		}}, false)
+	}
+}
+
+func (h *Hub) sendIfChanged(sub *Subscriber, status *models.QueueStatus) {
+	if status.InQueue && status.Session == nil && status.Position == sub.position.Load() &&
+		status.QueueState == sub.queueStatus.Load() {
+		return
+	}
+	h.send(sub, status)
+}
+
+// Expire sends a subscriber its final expired message.
+func (h *Hub) Expire(sub *Subscriber, reason string) {
+	sub.deliver(Message{Type: MessageExpired, Data: Expired{Reason: reason}}, true)
+	h.Unsubscribe(sub)
+}
+
+// event is the part of the event envelope the hub needs.
+type event struct {
+	Type    string `json:"type"`
+	QueueID string `json:"queue_id"`
+	Data    struct {
+		PositionID string `json:"position_id"`
+		Priority   int    `json:"priority"`
+		Reason     string `json:"reason"`
+	} `json:"data"`
+}
+
+func (h *Hub) handleEvent(data []byte) {
+	var e event
+	if err := json.Unmarshal(data, &e); err != nil {
+		log.Printf("hub: decoding event: %v", err)
+		return
+	}
+
+	switch e.Type {
+	case "position.enqueued":
+		// Arrivals in lane 0 join at the back and move nobody
+		if e.Data.Priority > models.PriorityNormal {
+			h.markChanged(e.QueueID)
+		}
+	case "position.admitted":
+		for _, sub := range h.positionSubscribers(e.Data.PositionID) {
+			sub.stale.Store(true)
+		}
+		h.markChanged(e.QueueID)
+	case "position.expired", "position.cancelled":
+		for _, sub := range h.positionSubscribers(e.Data.PositionID) {
+			h.Expire(sub, e.Data.Reason)
+		}
+		h.markChanged(e.QueueID)
+	case "queue.lottery_drawn":
+		// The cohort now has lane positions, ahead of anyone who joined after
+		// the opening
+		for _, sub := range h.queueSubscribers(e.QueueID) {
+			sub.stale.Store(true)
+		}
+		h.markChanged(e.QueueID)
+	case "queue.updated", "queue.paused", "queue.resumed", "queue.maintenance", "queue.closed":
+		h.markChanged(e.QueueID)
+	}
+}
+
+func (h *Hub) markChanged(queueID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subscribers[queueID]; ok {
+		h.changed[queueID] = true
+	}
+}
+
+func (h *Hub) queueSubscribers(queueID string) []*Subscriber {
+	return h.list(h.subscribers, queueID)
+}
+
+func (h *Hub) positionSubscribers(positionID string) []*Subscriber {
+	return h.list(h.positions, positionID)
+}
+
+func (h *Hub) list(index map[string]map[*Subscriber]struct{}, key string) []*Subscriber {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	subs := make([]*Subscriber, 0, len(index[key]))
+	for sub := range index[key] {
+		subs = append(subs, sub)
+	}
+	return subs
+}
+
+func (h *Hub) run(ctx context.Context) {
+	ticker := time.NewTicker(h.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.refreshChanged(ctx)
+		}
+	}
+}
+
+// refreshChanged sends every subscriber in the queues that changed since the
+// last tick its new position, reading again those that may have been
+// admitted.
+func (h *Hub) refreshChanged(ctx context.Context) {
+	h.mu.Lock()
+	changed := h.changed
+	h.changed = make(map[string]bool)
+	h.mu.Unlock()
+
+	sem := make(chan struct{}, h.config.Workers)
+	var wg sync.WaitGroup
+	for queueID := range changed {
+		frontier, err := h.queue.Frontier(ctx, queueID)
+		if err != nil {
+			log.Printf("hub: reading queue %s: %v", queueID, err)
+			continue
+		}
+		for _, sub := range h.queueSubscribers(queueID) {
+			if !sub.stale.Swap(false) {
+				if last := sub.status.Load(); last != nil {
+					if status, ok := frontier.Project(last); ok {
+						h.sendIfChanged(sub, status)
+						continue
+					}
+				}
+			}
+			sem <- struct{}{}
+			wg.Add(1)
+			go func(sub *Subscriber) {
+				defer func() { <-sem; wg.Done() }()
+				h.refresh(ctx, sub)
+			}(sub)
+		}
+	}
+	wg.Wait()
+}
+
+// refresh reads a subscriber's status without counting it as a heartbeat and
+// sends it if it changed.
+func (h *Hub) refresh(ctx context.Context, sub *Subscriber) {
+	status, err := h.queue.Peek(ctx, sub.claims)
+	switch {
+	case errors.Is(err, queue.ErrSessionExpired):
+		h.Expire(sub, models.ReasonSessionTimeout)
+		return
+	case err != nil:
+		log.Printf("hub: refreshing position %s: %v", sub.claims.PositionID, err)
+		return
+	}
+	h.UpdateIfChanged(sub, status)
+}
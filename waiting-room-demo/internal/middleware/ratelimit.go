@@ -0,0 +1,200 @@
+package middleware
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jawaracloud/waiting-room-demo/internal/apierror"
+	"github.com/jawaracloud/waiting-room-demo/internal/storage"
+	"github.com/jawaracloud/waiting-room-demo/internal/token"
+	"github.com/jawaracloud/waiting-room-demo/pkg/models"
+)
+
+// Rate limit scopes, i.e. what a limit counts requests per
+const (
+	ScopeIP       = "ip"    // Client IP
+	ScopeToken    = "token" // Position or session of a valid bearer, token query parameter or token cookie, falling back to IP
+	ScopeAdminKey = "key"   // Valid X-Admin-Key, falling back to IP
+)
+
+var errRateLimited = models.NewError(models.CodeRateLimited, "Rate limit exceeded")
+
+// Limit allows Requests per Window for each client in Scope.
+type Limit struct {
+	Requests int64
+	Window   time.Duration
+	Scope    string
+}
+
+// DefaultLimits are the per-route limits documented in docs/API.md.
+var DefaultLimits = map[string]Limit{
+	"challenge": {Requests: 20, Window: time.Minute, Scope: ScopeIP},
+	"enqueue":   {Requests: 10, Window: time.Minute, Scope: ScopeIP},
+	"status":    {Requests: 60, Window: time.Minute, Scope: ScopeToken},
+	"heartbeat": {Requests: 30, Window: time.Minute, Scope: ScopeToken},
+	"activity":  {Requests: 100, Window: time.Minute, Scope: ScopeToken},
+	"refresh":   {Requests: 10, Window: time.Minute, Scope: ScopeToken},
+	"admin":     {Requests: 100, Window: time.Minute, Scope: ScopeAdminKey},
+}
+
+// RateLimitStore counts requests in a sliding window shared by every replica.
+type RateLimitStore interface {
+	RecordRequest(ctx context.Context, key string, limit int64, window time.Duration, now time.Time) (bool, int64, time.Time, error)
+}
+
+// TokenSubjects tells which position or session a token stands for, if it
+// was issued by this waiting room.
+type TokenSubjects interface {
+	Subject(tokenString string) (string, bool)
+}
+
+// RateLimiter enforces named sliding-window limits on routes.
+type RateLimiter struct {
+	store    RateLimitStore
+	tokens   TokenSubjects
+	adminKey string
+	limits   map[string]Limit
+}
+
+// NewRateLimiter creates a rate limiter for the given named limits. Tokens
+// are counted by what they stand for and the admin key as one caller, so
+// made-up tokens or keys can't each get a fresh allowance.
+func NewRateLimiter(store RateLimitStore, tokens TokenSubjects, adminKey string, limits map[string]Limit) *RateLimiter {
+	return &RateLimiter{store: store, tokens: tokens, adminKey: adminKey, limits: limits}
+}
+
+// Limit returns middleware enforcing the named limit. Routes whose limit
+// isn't configured are not limited.
+//
+// Every response carries X-RateLimit-Limit, X-RateLimit-Remaining and
+// X-RateLimit-Reset, the Unix time a slot frees up. Requests over the limit
+// get a 429 RATE_LIMITED error with Retry-After. If the store is unavailable
+// requests are let through rather than failed.
+func (rl *RateLimiter) Limit(name string) func(http.Handler) http.Handler {
+	if limit, ok := rl.limits[name]; !ok || limit.Requests <= 0 {
+		return func(next http.Handler) http.Handler { return next }
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := rl.Check(w, r, name); err != nil {
+				apierror.Write(w, r, err)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Check counts a request against the named limit and sets the same headers
+// as Limit, for handlers that answer in something other than JSON. It
+// returns a RATE_LIMITED error carrying retry_after_seconds when the request
+// is over the limit.
+func (rl *RateLimiter) Check(w http.ResponseWriter, r *http.Request, name string) error {
+	limit, ok := rl.limits[name]
+	if !ok || limit.Requests <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+	key := storage.KeyRateLimit(name, rl.clientIdentifier(r, limit.Scope))
+	allowed, count, reset, err := rl.store.RecordRequest(r.Context(), key, limit.Requests, limit.Window, now)
+	if err != nil {
+		log.Printf("rate limit %s: %v", name, err)
+		return nil
+	}
+
+	header := w.Header()
+	header.Set("X-RateLimit-Limit", strconv.FormatInt(limit.Requests, 10))
+	header.Set("X-RateLimit-Remaining", strconv.FormatInt(max(limit.Requests-count, 0), 10))
+	header.Set("X-RateLimit-Reset", strconv.FormatInt(int64(math.Ceil(float64(reset.UnixMilli())/1000)), 10))
+
+	if !allowed {
+		retryAfter := int64(math.Ceil(reset.Sub(now).Seconds()))
+		return errRateLimited.WithDetails(map[string]any{"retry_after_seconds": max(retryAfter, 1)})
+	}
+	return nil
+}
+
+// clientIdentifier returns what a scope counts requests per. Tokens and admin
+// keys only count once they check out; anything else counts against the
+// client IP.
+func (rl *RateLimiter) clientIdentifier(r *http.Request, scope string) string {
+	switch scope {
+	case ScopeToken:
+		if tokenString := requestToken(r); tokenString != "" {
+			if subject, ok := rl.tokens.Subject(tokenString); ok {
+				return scope + ":" + subject
+			}
+		}
+	case ScopeAdminKey:
+		key := r.Header.Get("X-Admin-Key")
+		if rl.adminKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(rl.adminKey)) == 1 {
+			return scope + ":admin"
+		}
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return ScopeIP + ":" + ip
+}
+
+func requestToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	if tokenString := r.URL.Query().Get("token"); tokenString != "" {
+		return tokenString
+	}
+	for _, name := range []string{token.QueueCookie, token.SessionCookie} {
+		if cookie, err := r.Cookie(name); err == nil && cookie.Value != "" {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+// ParseLimits parses limits written as name=requests/window/scope, separated
+// by commas, e.g. "enqueue=10/1m/ip,status=60/1m/token".
+func ParseLimits(s string) (map[string]Limit, error) {
+	limits := make(map[string]Limit)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, spec, ok := strings.Cut(entry, "=")
+		parts := strings.Split(spec, "/")
+		if !ok || len(parts) != 3 {
+			return nil, fmt.Errorf("rate limit %q: want name=requests/window/scope", entry)
+		}
+
+		requests, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("rate limit %q: %w", entry, err)
+		}
+		window, err := time.ParseDuration(parts[1])
+		if err != nil || window <= 0 {
+			return nil, fmt.Errorf("rate limit %q: invalid window %q", entry, parts[1])
+		}
+		switch parts[2] {
+		case ScopeIP, ScopeToken, ScopeAdminKey:
+		default:
+			return nil, fmt.Errorf("rate limit %q: unknown scope %q", entry, parts[2])
+		}
+
+		limits[strings.TrimSpace(name)] = Limit{Requests: requests, Window: window, Scope: parts[2]}
+	}
+	return limits, nil
+}
@@ -0,0 +1,42 @@
+package middleware
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseLimits(t *testing.T) {
+	for _, tt := range []struct {
+		in      string
+		want    map[string]Limit
+		wantErr bool
+	}{
+		{in: "", want: map[string]Limit{}},
+		{in: "enqueue=10/1m/ip", want: map[string]Limit{
+			"enqueue": {Requests: 10, Window: time.Minute, Scope: ScopeIP},
+		}},
+		{in: " enqueue=10/1m/ip , status=60/30s/token,admin=100/1h/key,", want: map[string]Limit{
+			"enqueue": {Requests: 10, Window: time.Minute, Scope: ScopeIP},
+			"status":  {Requests: 60, Window: 30 * time.Second, Scope: ScopeToken},
+			"admin":   {Requests: 100, Window: time.Hour, Scope: ScopeAdminKey},
+		}},
+		{in: "enqueue", wantErr: true},
+		{in: "enqueue=10/1m", wantErr: true},
+		{in: "enqueue=10/1m/ip/x", wantErr: true},
+		{in: "enqueue=ten/1m/ip", wantErr: true},
+		{in: "enqueue=10/minute/ip", wantErr: true},
+		{in: "enqueue=10/0s/ip", wantErr: true},
+		{in: "enqueue=10/-1m/ip", wantErr: true},
+		{in: "enqueue=10/1m/user", wantErr: true},
+	} {
+		got, err := ParseLimits(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseLimits(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseLimits(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestRealIP(t *testing.T) {
+	trusted, err := ParseTrustedProxies("10.0.0.0/8, 192.0.2.10, fd00::/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		peer     string
+		xff      []string
+		realIP   string
+		trusted  []netip.Prefix
+		wantAddr string
+	}{
+		{"untrusted peer", "203.0.113.7:4000", []string{"198.51.100.1"}, "198.51.100.2", trusted, "203.0.113.7:4000"},
+		{"no trusted proxies", "10.0.0.1:4000", []string{"198.51.100.1"}, "", nil, "10.0.0.1:4000"},
+		{"trusted peer", "10.0.0.1:4000", []string{"198.51.100.1"}, "", trusted, "198.51.100.1"},
+		{"single trusted address", "192.0.2.10:4000", []string{"198.51.100.1"}, "", trusted, "198.51.100.1"},
+		{"trusted IPv6 peer", "[fd00::1]:4000", []string{"2001:db8::1"}, "", trusted, "2001:db8::1"},
+		{"spoofed first hop", "10.0.0.1:4000", []string{"1.2.3.4, 198.51.100.1"}, "", trusted, "198.51.100.1"},
+		{"trusted hops skipped", "10.0.0.1:4000", []string{"1.2.3.4, 198.51.100.1, 10.0.0.3", "10.0.0.2"}, "", trusted, "198.51.100.1"},
+		{"all hops trusted", "10.0.0.1:4000", []string{"10.0.0.3, 10.0.0.2"}, "", trusted, "10.0.0.3"},
+		{"mapped IPv4", "10.0.0.1:4000", []string{"::ffff:198.51.100.1"}, "", trusted, "198.51.100.1"},
+		{"real IP", "10.0.0.1:4000", nil, " 198.51.100.2 ", trusted, "198.51.100.2"},
+		{"malformed hop falls back to real IP", "10.0.0.1:4000", []string{"198.51.100.1, bogus, 10.0.0.2"}, "198.51.100.2", trusted, "198.51.100.2"},
+		{"malformed hop falls back to peer", "10.0.0.1:4000", []string{"198.51.100.1, bogus, 10.0.0.2"}, "", trusted, "10.0.0.1:4000"},
+		{"malformed last hop", "10.0.0.1:4000", []string{"198.51.100.1, bogus"}, "", trusted, "10.0.0.1:4000"},
+		{"malformed hop beyond the client", "10.0.0.1:4000", []string{"bogus, 198.51.100.1"}, "", trusted, "198.51.100.1"},
+		{"malformed real IP", "10.0.0.1:4000", nil, "bogus", trusted, "10.0.0.1:4000"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			handler := RealIP(tt.trusted)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.RemoteAddr
+			}))
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.peer
+			for _, xff := range tt.xff {
+				r.Header.Add("X-Forwarded-For", xff)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+			if got != tt.wantAddr {
+				t.Errorf("RemoteAddr = %q, want %q", got, tt.wantAddr)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	prefixes, err := ParseTrustedProxies(" 10.1.2.3/8 ,192.0.2.10,,::ffff:192.0.2.11,2001:db8::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.0.0.0/8", "192.0.2.10/32", "192.0.2.11/32", "2001:db8::/32"}
+	if len(prefixes) != len(want) {
+		t.Fatalf("ParseTrustedProxies = %v, want %v", prefixes, want)
+	}
+	for i, prefix := range prefixes {
+		if prefix.String() != want[i] {
+			t.Errorf("prefix %d = %s, want %s", i, prefix, want[i])
+		}
+	}
+
+	for _, bad := range []string{"10.0.0.0/33", "proxy.internal", "10.0.0"} {
+		if _, err := ParseTrustedProxies(bad); err == nil {
+			t.Errorf("ParseTrustedProxies(%q) accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package queue
+
+import (
+	"context"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/jawaracloud/waiting-room-demo/internal/storage"
+)
+
+// AdmissionConfig holds admission control configuration. A queue's own
+// configuration, when it has one, overrides the rate and active-user cap.
+type AdmissionConfig struct {
+	// AdmissionRate is the number of users admitted per second.
+	AdmissionRate float64
+	// MaxActiveUsers caps how many admitted users may be active at once.
+	// Zero means unlimited.
+	MaxActiveUsers int64
+	// NormalMinShare guarantees lane 0 at least this fraction of admissions
+	// while it has users waiting, so higher lanes can't starve it. Zero
+	// disables the guard.
+	NormalMinShare float64
+	// BucketCapacity is the largest burst the token bucket allows. It
+	// defaults to MaxActiveUsers, or to one second of admissions when
+	// MaxActiveUsers is unlimited.
+	BucketCapacity float64
+	// Interval is how often each queue's bucket is drained.
+	Interval time.Duration
+}
+
+// AdmissionController periodically admits waiting users in every known queue
+// using a token bucket held in DragonFlyDB, so any number of replicas can run
+// it side by side without admitting more than the configured rate.
+type AdmissionController struct {
+	storage *storage.RedisStorage
+	events  EventPublisher
+	config  AdmissionConfig
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+func NewAdmissionController(storage *storage.RedisStorage, events EventPublisher, config AdmissionConfig) *AdmissionController {
+	if config.BucketCapacity <= 0 {
+		config.BucketCapacity = float64(config.MaxActiveUsers)
+	}
+	if config.BucketCapacity <= 0 {
+		config.BucketCapacity = math.Max(1, math.Ceil(config.AdmissionRate))
+	}
+	if config.Interval <= 0 {
+		config.Interval = time.Second
+	}
+
+	return &AdmissionController{
+		storage: storage,
+		events:  events,
+		config:  config,
+	}
+}
+
+// Start launches the background admission worker.
+func (a *AdmissionController) Start(ctx context.Context) error {
+	ctx, a.cancel = context.WithCancel(ctx)
+
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		a.run(ctx)
+	}()
+	return nil
+}
+
+// Stop halts the admission worker and waits for it to exit.
+func (a *AdmissionController) Stop() {
+	if a.cancel != nil {
+		a.cancel()
+	}
+	a.wg.Wait()
+}
+
+// AdmitQueue runs one admission round for a queue and returns how many users
+// were admitted. Queues that aren't active admit no one.
+func (a *AdmissionController) AdmitQueue(ctx context.Context, queueID string) (int64, error) {
+	params, admits, err := a.params(ctx, queueID)
+	if err != nil || !admits {
+		return 0, err
+	}
+
+	now := time.Now()
+	admission, err := a.storage.Admit(ctx, queueID, params, now)
+	if err != nil {
+		return 0, err
+	}
+	publishAdmission(ctx, a.events, queueID, admission, now)
+	return int64(len(admission.Admitted)), nil
+}
+
+// params returns the admission parameters for a queue and whether it admits
+// users at all. A lottery queue's cohort is drawn here once it opens.
+func (a *AdmissionController) params(ctx context.Context, queueID string) (storage.AdmissionParams, bool, error) {
+	params := storage.AdmissionParams{
+		Capacity:       a.config.BucketCapacity,
+		Rate:           a.config.AdmissionRate,
+		MaxActive:      a.config.MaxActiveUsers,
+		NormalMinShare: a.config.NormalMinShare,
+	}
+
+	queue, err := a.storage.GetQueue(ctx, queueID)
+	if err != nil || queue == nil {
+		return params, err == nil, err
+	}
+	if !queue.Admits() {
+		return params, false, nil
+	}
+	if ready, err := runLottery(ctx, a.storage, a.events, queue, time.Now()); !ready || err != nil {
+		return params, false, err
+	}
+
+	params.Rate = queue.AdmissionRate
+	params.MaxActive = queue.MaxActiveUsers
+	params.Capacity = float64(queue.MaxActiveUsers)
+	if params.Capacity <= 0 {
+		params.Capacity = math.Max(1, math.Ceil(queue.AdmissionRate))
+	}
+	return params, true, nil
+}
+
+func (a *AdmissionController) run(ctx context.Context) {
+	ticker := time.NewTicker(a.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.admitAll(ctx)
+		}
+	}
+}
+
+func (a *AdmissionController) admitAll(ctx context.Context) {
+	queues, err := a.storage.Queues(ctx)
+	if err != nil {
+		log.Printf("admission: listing queues: %v", err)
+		return
+	}
+
+	for _, queueID := range queues {
+		if _, err := a.AdmitQueue(ctx, queueID); err != nil {
+			log.Printf("admission: queue %s: %v", queueID, err)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jawaracloud/waiting-room-demo/pkg/models"
+)
+
+var ErrNoChallenge = models.NewError(models.CodeNotFound, "Queue has no challenge")
+
+// IssueChallenge creates a challenge for an enqueue into a queue that requires
+// one.
+func (s *Service) IssueChallenge(ctx context.Context, queueID string) (*models.Challenge, error) {
+	queue, err := s.queueConfig(ctx, queueID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAccepting(queue); err != nil {
+		return nil, err
+	}
+	challenge, ok := s.challenges[queue.Challenge]
+	if !ok {
+		return nil, ErrNoChallenge
+	}
+	return challenge.Issue(ctx, queueID, time.Now())
+}
+
+// checkChallenge verifies the solution an enqueue presents, if the queue
+// requires one.
+func (s *Service) checkChallenge(ctx context.Context, queue *models.Queue, solution *models.ChallengeSolution, now time.Time) error {
+	if queue.Challenge == "" {
+		return nil
+	}
+	challenge, ok := s.challenges[queue.Challenge]
+	if !ok {
+		return fmt.Errorf("queue %s requires unknown challenge %q", queue.ID, queue.Challenge)
+	}
+	return challenge.Verify(ctx, queue.ID, solution, now)
+}
+
+// releaseChallenge gives back the solution an enqueue that didn't add anyone
+// used up, so a client turned away by a full queue can retry without
+// solving another challenge.
+func (s *Service) releaseChallenge(ctx context.Context, queue *models.Queue, solution *models.ChallengeSolution) {
+	challenge, ok := s.challenges[queue.Challenge]
+	if !ok {
+		return
+	}
+	if err := challenge.Release(ctx, queue.ID, solution); err != nil {
+		log.Printf("releasing challenge for queue %s: %v", queue.ID, err)
+	}
+}
+
+// acceptChallenge counts the solution of an enqueue that added or resumed a
+// position.
+func (s *Service) acceptChallenge(ctx context.Context, queue *models.Queue, now time.Time) {
+	challenge, ok := s.challenges[queue.Challenge]
+	if !ok {
+		return
+	}
+	if err := challenge.Accept(ctx, queue.ID, now); err != nil {
+		log.Printf("accepting challenge for queue %s: %v", queue.ID, err)
+	}
+}
+
+// CheckChallenges fails if a stored queue requires a challenge the service
+// doesn't have, for instance because its secret isn't configured.
+func (s *Service) CheckChallenges(ctx context.Context) error {
+	queueIDs, err := s.storage.Queues(ctx)
+	if err != nil {
+		return err
+	}
+	for _, queueID := range queueIDs {
+		queue, err := s.storage.GetQueue(ctx, queueID)
+		if err != nil {
+			return err
+		}
+		if queue == nil || queue.Challenge == "" {
+			continue
+		}
+		if _, ok := s.challenges[queue.Challenge]; !ok {
+			return fmt.Errorf("queue %s requires challenge %q, which isn't configured", queueID, queue.Challenge)
+		}
+	}
+	return nil
+}
+
+// validateChallenge checks a queue only requires challenges the service has.
+func (s *Service) validateChallenge(queue *models.Queue) error {
+	if _, ok := s.challenges[queue.Challenge]; ok || queue.Challenge == "" {
+		return nil
+	}
+	if len(s.challenges) == 0 {
+		return invalidQueue("challenge", "must be empty while CHALLENGE_SECRET is unset")
+	}
+	types := make([]string, 0, len(s.challenges))
+	for name := range s.challenges {
+		types = append(types, name)
+	}
+	sort.Strings(types)
+	return invalidQueue("challenge", "must be "+strings.Join(types, ", ")+" or empty")
+}
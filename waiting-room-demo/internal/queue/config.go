@@ -0,0 +1,449 @@
+package queue
+
+import (
+	"context"
+	"math"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jawaracloud/waiting-room-demo/internal/token"
+	"github.com/jawaracloud/waiting-room-demo/pkg/models"
+)
+
+var (
+	ErrQueueNotFound = models.NewError(models.CodeNotFound, "Queue not found")
+	ErrQueueExists   = models.NewError(models.CodeQueueExists, "Queue already exists")
+	ErrQueueClosed   = models.NewError(models.CodeQueueClosed, "Queue is closed")
+	ErrMaintenance   = models.NewError(models.CodeMaintenanceMode, "Queue is in maintenance mode")
+	ErrInvalidQueue  = models.NewError(models.CodeInvalidRequest, "Invalid queue configuration")
+	ErrQueueConflict = models.NewError(models.CodeUpdateConflict, "Queue is being updated by another request, please try again")
+)
+
+var (
+	// queueIDPattern keeps queue IDs safe to use in storage keys and URL paths.
+	queueIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+	colorPattern   = regexp.MustCompile(`^#([0-9A-Fa-f]{3}|[0-9A-Fa-f]{6})$`)
+	localePattern  = regexp.MustCompile(`^[a-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+)
+
+// maxUpdateAttempts bounds how often an update is worked out again after
+// another update got in first.
+const maxUpdateAttempts = 5
+
+// Longest free text settings, in bytes
+const (
+	maxMaintenanceMessage = 500
+	maxPageTitle          = 200
+	maxPageMessage        = 1000
+)
+
+// Queue returns a configured queue.
+func (s *Service) Queue(ctx context.Context, queueID string) (*models.Queue, error) {
+	queue, err := s.storage.GetQueue(ctx, queueID)
+	if err != nil {
+		return nil, err
+	}
+	if queue == nil {
+		return nil, ErrQueueNotFound
+	}
+	return queue, nil
+}
+
+// queueConfig returns a queue's configuration, or the defaults for queues
+// that were never configured and are created on first enqueue. IDs no queue
+// could be created with are not found.
+func (s *Service) queueConfig(ctx context.Context, queueID string) (*models.Queue, error) {
+	if !queueIDPattern.MatchString(queueID) {
+		return nil, ErrQueueNotFound
+	}
+	queue, err := s.storage.GetQueue(ctx, queueID)
+	if err != nil {
+		return nil, err
+	}
+	if queue == nil {
+		queue = s.defaultQueue(queueID)
+	}
+	return queue, nil
+}
+
+// defaultQueue is the configuration implied by the service defaults.
+func (s *Service) defaultQueue(queueID string) *models.Queue {
+	return &models.Queue{
+		ID:                queueID,
+		Name:              queueID,
+		Status:            models.QueueActive,
+		MaxActiveUsers:    s.config.MaxActiveUsers,
+		MaxQueueSize:      s.config.MaxQueueSize,
+		AdmissionRate:     s.config.AdmissionRate,
+		SessionTimeout:    int64(s.config.DefaultSessionTTL / time.Second),
+		HeartbeatInterval: int64(s.config.HeartbeatInterval / time.Second),
+		HeartbeatTimeout:  int64(s.config.HeartbeatTimeout / time.Second),
+		ClientBinding:     s.config.ClientBinding,
+	}
+}
+
+// CreateQueue configures a new queue. Settings left out take the service
+// defaults, so a 0 given for a limit means unlimited, and the queue starts
+// active unless a status is given.
+func (s *Service) CreateQueue(ctx context.Context, create *models.QueueCreate) (*models.Queue, error) {
+	if !queueIDPattern.MatchString(create.ID) {
+		return nil, invalidQueue("id", "must be 1 to 64 letters, digits, '-' or '_'")
+	}
+
+	queue := s.defaultQueue(create.ID)
+	applyUpdate(queue, &create.QueueUpdate)
+	if queue.Name == "" {
+		queue.Name = queue.ID
+	}
+	if err := validateQueue(queue); err != nil {
+		return nil, err
+	}
+	if err := s.validateChallenge(queue); err != nil {
+		return nil, err
+	}
+	if err := s.commitLottery(ctx, queue); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	queue.CreatedAt = now
+	queue.UpdatedAt = now
+
+	created, err := s.storage.CreateQueue(ctx, queue)
+	if err != nil {
+		return nil, err
+	}
+	if !created {
+		return nil, ErrQueueExists
+	}
+
+	s.publish(ctx, models.EventQueueCreated, queue.ID, queue)
+	return queue, nil
+}
+
+// UpdateQueue applies a partial update to a configured queue. Status changes
+// take effect on the next enqueue and admission round, on every replica.
+// Closed is final. Setting opens_at commits to a lottery seed as on
+// creation. Clearing it before the pre-queue closes calls the lottery off,
+// and its pre-queue joins the queue in order of arrival.
+//
+// Only the changed settings are written, and only if nothing else updated
+// the queue in the meantime; otherwise the update is applied again to the
+// newer configuration, so concurrent updates never undo each other.
+func (s *Service) UpdateQueue(ctx context.Context, queueID string, update *models.QueueUpdate) (*models.Queue, error) {
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		old, err := s.Queue(ctx, queueID)
+		if err != nil {
+			return nil, err
+		}
+		queue, changes, err := s.updatedQueue(ctx, old, update)
+		if err != nil || len(changes) == 0 {
+			return queue, err
+		}
+
+		updated, err := s.storage.UpdateQueue(ctx, old, queue)
+		if err != nil {
+			return nil, err
+		}
+		if updated {
+			s.publishUpdate(ctx, old, queue, changes)
+			return queue, nil
+		}
+	}
+	return nil, ErrQueueConflict
+}
+
+// updatedQueue works out and checks the configuration an update leads to
+// from old, returning it with the settings it changes.
+func (s *Service) updatedQueue(ctx context.Context, old *models.Queue, update *models.QueueUpdate) (*models.Queue, map[string]models.Change, error) {
+	queue := *old
+	applyUpdate(&queue, update)
+
+	if err := validateQueue(&queue); err != nil {
+		return nil, nil, err
+	}
+	if err := s.validateChallenge(&queue); err != nil {
+		return nil, nil, err
+	}
+	if old.Status == models.QueueClosed && queue.Status != models.QueueClosed {
+		return nil, nil, invalidQueue("status", "a closed queue cannot be reopened")
+	}
+
+	changes := queueChanges(old, &queue)
+	if len(changes) == 0 {
+		return old, nil, nil
+	}
+	_, opensChanged := changes["opens_at"]
+	_, windowChanged := changes["prequeue_window_seconds"]
+	if opensChanged || windowChanged {
+		if err := s.checkLotteryOpen(ctx, old); err != nil {
+			return nil, nil, err
+		}
+		if err := s.commitLottery(ctx, &queue); err != nil {
+			return nil, nil, err
+		}
+		changes = queueChanges(old, &queue)
+	}
+	queue.UpdatedAt = time.Now().UTC().Truncate(time.Millisecond)
+	return &queue, changes, nil
+}
+
+// publishUpdate announces an update, and the status change it made, if any.
+func (s *Service) publishUpdate(ctx context.Context, old, queue *models.Queue, changes map[string]models.Change) {
+	s.publish(ctx, models.EventQueueUpdated, queue.ID, models.QueueUpdatedData{
+		QueueID: queue.ID,
+		Changes: changes,
+	})
+	if subject := statusEvent(old.Status, queue.Status); subject != "" {
+		s.publish(ctx, subject, queue.ID, models.QueueStatusData{
+			QueueID:        queue.ID,
+			Status:         queue.Status,
+			PreviousStatus: old.Status,
+		})
+	}
+}
+
+// applyUpdate sets the fields an update gives on queue.
+func applyUpdate(queue *models.Queue, update *models.QueueUpdate) {
+	set(&queue.Name, update.Name)
+	set(&queue.Status, update.Status)
+	set(&queue.TargetURL, update.TargetURL)
+	set(&queue.MaxActiveUsers, update.MaxActiveUsers)
+	set(&queue.MaxQueueSize, update.MaxQueueSize)
+	set(&queue.AdmissionRate, update.AdmissionRate)
+	set(&queue.SessionTimeout, update.SessionTimeout)
+	set(&queue.HeartbeatInterval, update.HeartbeatInterval)
+	set(&queue.HeartbeatTimeout, update.HeartbeatTimeout)
+	set(&queue.ClientBinding, update.ClientBinding)
+	set(&queue.IdentityPolicy, update.IdentityPolicy)
+	set(&queue.IdentityLimit, update.IdentityLimit)
+	set(&queue.Challenge, update.Challenge)
+	set(&queue.MaintenanceMessage, update.MaintenanceMessage)
+	set(&queue.PreQueueWindow, update.PreQueueWindow)
+	if update.Page != nil {
+		queue.Page = normalizePage(update.Page)
+	}
+	if update.OpensAt.Set {
+		queue.OpensAt = nil
+		if update.OpensAt.Value != nil {
+			opensAt := update.OpensAt.Value.UTC().Truncate(time.Millisecond)
+			queue.OpensAt = &opensAt
+		}
+	}
+	normalizeIdentity(queue)
+}
+
+func set[T any](field *T, value *T) {
+	if value != nil {
+		*field = *value
+	}
+}
+
+func validateQueue(queue *models.Queue) error {
+	switch queue.Status {
+	case models.QueueActive, models.QueuePaused, models.QueueMaintenance, models.QueueClosed:
+	default:
+		return invalidQueue("status", "must be active, paused, maintenance or closed")
+	}
+	if queue.TargetURL != "" {
+		u, err := url.Parse(queue.TargetURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return invalidQueue("target_url", "must be an absolute http or https URL")
+		}
+	}
+	if queue.MaxActiveUsers < 0 {
+		return invalidQueue("max_active_users", "must not be negative")
+	}
+	if queue.MaxQueueSize < 0 {
+		return invalidQueue("max_queue_size", "must not be negative")
+	}
+	if queue.AdmissionRate <= 0 || math.IsInf(queue.AdmissionRate, 0) || math.IsNaN(queue.AdmissionRate) {
+		return invalidQueue("admission_rate", "must be positive")
+	}
+	if queue.SessionTimeout <= 0 {
+		return invalidQueue("session_timeout_seconds", "must be positive")
+	}
+	if queue.HeartbeatInterval <= 0 {
+		return invalidQueue("heartbeat_interval_seconds", "must be positive")
+	}
+	if queue.HeartbeatTimeout <= queue.HeartbeatInterval {
+		return invalidQueue("heartbeat_timeout_seconds", "must be longer than the heartbeat interval")
+	}
+	if !token.ValidBinding(queue.ClientBinding) {
+		return invalidQueue("client_binding", "must be ip, subnet, ua, tolerant or empty")
+	}
+	switch queue.IdentityPolicy {
+	case models.IdentityNone, models.IdentityIP, models.IdentityUserID, models.IdentityFingerprint:
+	default:
+		return invalidQueue("identity_policy", "must be ip, user_id, fingerprint or empty")
+	}
+	if queue.IdentityLimit < 0 {
+		return invalidQueue("identity_limit", "must not be negative")
+	}
+	if len(queue.MaintenanceMessage) > maxMaintenanceMessage {
+		return invalidQueue("maintenance_message", "must be at most 500 bytes")
+	}
+	if queue.PreQueueWindow < 0 {
+		return invalidQueue("prequeue_window_seconds", "must not be negative")
+	}
+	if queue.PreQueueWindow > 0 && queue.OpensAt == nil {
+		return invalidQueue("prequeue_window_seconds", "requires opens_at")
+	}
+	if queue.Page != nil {
+		return validatePage(queue.Page)
+	}
+	return nil
+}
+
+func validatePage(page *models.QueuePage) error {
+	if len(page.Title) > maxPageTitle {
+		return invalidQueue("page.title", "must be at most 200 bytes")
+	}
+	if len(page.Message) > maxPageMessage {
+		return invalidQueue("page.message", "must be at most 1000 bytes")
+	}
+	if page.LogoURL != "" {
+		u, err := url.Parse(page.LogoURL)
+		absolute := err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+		local := err == nil && u.Scheme == "" && u.Host == "" && strings.HasPrefix(u.Path, "/")
+		if !absolute && !local {
+			return invalidQueue("page.logo_url", "must be an absolute http or https URL or a path starting with /")
+		}
+	}
+	if page.PrimaryColor != "" && !colorPattern.MatchString(page.PrimaryColor) {
+		return invalidQueue("page.primary_color", "must be a hex color such as #1a73e8")
+	}
+	if page.BackgroundColor != "" && !colorPattern.MatchString(page.BackgroundColor) {
+		return invalidQueue("page.background_color", "must be a hex color such as #ffffff")
+	}
+	if page.Locale != "" && !localePattern.MatchString(page.Locale) {
+		return invalidQueue("page.locale", "must be a language tag such as en or pt-BR")
+	}
+	return nil
+}
+
+// normalizeIdentity applies the identity limit to the ip policy only, where
+// it defaults to one position per address.
+func normalizeIdentity(queue *models.Queue) {
+	if queue.IdentityPolicy != models.IdentityIP {
+		queue.IdentityLimit = 0
+	} else if queue.IdentityLimit == 0 {
+		queue.IdentityLimit = 1
+	}
+}
+
+// normalizePage drops a theme with nothing set, so it reads back the same.
+func normalizePage(page *models.QueuePage) *models.QueuePage {
+	if page == nil || *page == (models.QueuePage{}) {
+		return nil
+	}
+	return page
+}
+
+func invalidQueue(field, reason string) error {
+	return ErrInvalidQueue.WithDetails(map[string]any{"field": field, "reason": reason})
+}
+
+// queueChanges lists the settings an update changed, by their JSON names.
+func queueChanges(old, queue *models.Queue) map[string]models.Change {
+	fields := []struct {
+		name     string
+		old, new any
+	}{
+		{"name", old.Name, queue.Name},
+		{"status", old.Status, queue.Status},
+		{"target_url", old.TargetURL, queue.TargetURL},
+		{"max_active_users", old.MaxActiveUsers, queue.MaxActiveUsers},
+		{"max_queue_size", old.MaxQueueSize, queue.MaxQueueSize},
+		{"admission_rate", old.AdmissionRate, queue.AdmissionRate},
+		{"session_timeout_seconds", old.SessionTimeout, queue.SessionTimeout},
+		{"heartbeat_interval_seconds", old.HeartbeatInterval, queue.HeartbeatInterval},
+		{"heartbeat_timeout_seconds", old.HeartbeatTimeout, queue.HeartbeatTimeout},
+		{"client_binding", old.ClientBinding, queue.ClientBinding},
+		{"identity_policy", old.IdentityPolicy, queue.IdentityPolicy},
+		{"identity_limit", old.IdentityLimit, queue.IdentityLimit},
+		{"challenge", old.Challenge, queue.Challenge},
+		{"maintenance_message", old.MaintenanceMessage, queue.MaintenanceMessage},
+		{"opens_at", optionalTime(old.OpensAt), optionalTime(queue.OpensAt)},
+		{"lottery_seed_sha256", old.LotterySeedSHA256, queue.LotterySeedSHA256},
+		{"prequeue_window_seconds", old.PreQueueWindow, queue.PreQueueWindow},
+		{"page", optionalPage(old.Page), optionalPage(queue.Page)},
+	}
+
+	changes := make(map[string]models.Change)
+	for _, f := range fields {
+		if f.old != f.new {
+			changes[f.name] = models.Change{OldValue: f.old, NewValue: f.new}
+		}
+	}
+	return changes
+}
+
+// optionalTime makes a time comparable across time zones, nil when unset.
+func optionalTime(t *time.Time) any {
+	if t == nil {
+		return nil
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// optionalPage makes a theme comparable by value, nil when unset.
+func optionalPage(page *models.QueuePage) any {
+	if page == nil {
+		return nil
+	}
+	return *page
+}
+
+// checkLotteryOpen rejects changes to a lottery once its pre-queue closed,
+// which happens at the opening time even if the draw has not run yet.
+func (s *Service) checkLotteryOpen(ctx context.Context, queue *models.Queue) error {
+	if queue.OpensAt == nil {
+		return nil
+	}
+	if !time.Now().Before(*queue.OpensAt) {
+		return ErrLotteryLocked
+	}
+	state, err := s.storage.LotteryState(ctx, queue.ID)
+	if err != nil {
+		return err
+	}
+	if state != "" {
+		return ErrLotteryLocked
+	}
+	return nil
+}
+
+// statusEvent returns the event subject for a status transition, if any.
+func statusEvent(from, to string) string {
+	if from == to {
+		return ""
+	}
+	switch to {
+	case models.QueuePaused:
+		return models.EventQueuePaused
+	case models.QueueMaintenance:
+		return models.EventQueueMaintenance
+	case models.QueueClosed:
+		return models.EventQueueClosed
+	default:
+		return models.EventQueueResumed
+	}
+}
+
+// checkAccepting rejects new users unless the queue takes them. Users turned
+// away during maintenance get the queue's maintenance message, if it has one.
+func checkAccepting(queue *models.Queue) error {
+	switch queue.Status {
+	case models.QueueMaintenance:
+		if queue.MaintenanceMessage != "" {
+			return ErrMaintenance.WithMessage(queue.MaintenanceMessage)
+		}
+		return ErrMaintenance
+	case models.QueueClosed:
+		return ErrQueueClosed
+	}
+	return nil
+}
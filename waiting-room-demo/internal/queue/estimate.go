@@ -0,0 +1,224 @@
+package queue
+
+import (
+	"context"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/jawaracloud/waiting-room-demo/internal/storage"
+	"github.com/jawaracloud/waiting-room-demo/pkg/models"
+)
+
+const (
+	// minThroughputBuckets is how many completed buckets must have been
+	// observed before the observed rate replaces the configured one.
+	minThroughputBuckets = 3
+	// confidenceZ is the z-score of the 90% confidence range.
+	confidenceZ = 1.645
+	// minRateFraction floors the low end of the rate range, so a noisy
+	// window can't stretch the longest estimate without bound.
+	minRateFraction = 0.1
+	// maxRetryAfter caps the retry hint given to users turned away from a
+	// full queue.
+	maxRetryAfter = 5 * time.Minute
+)
+
+// Throughput is a queue's admission rate in users per second, with a
+// confidence range.
+type Throughput struct {
+	Rate     float64
+	Low      float64
+	High     float64
+	Observed bool // false when the configured rate stands in
+}
+
+// wait estimates how long the user at position has to wait, returning the
+// estimate and its range in whole seconds. All are 0 when the rate is unknown.
+func (t Throughput) wait(position int64) (est, min, max int64) {
+	if t.Rate <= 0 || position <= 0 {
+		return 0, 0, 0
+	}
+	seconds := func(rate float64) int64 {
+		return int64(math.Ceil(float64(position) / rate))
+	}
+	return seconds(t.Rate), seconds(t.High), seconds(t.Low)
+}
+
+// estimator derives each queue's admission rate from the admissions counted
+// in storage, so the estimate reflects what every replica actually admitted,
+// including slowdowns from the active-user cap.
+type estimator struct {
+	storage *storage.RedisStorage
+
+	mu    sync.Mutex
+	cache map[string]cachedThroughput
+}
+
+// cachedThroughput is valid until the bucket it was computed in completes.
+type cachedThroughput struct {
+	bucket     int64
+	throughput Throughput
+}
+
+func newEstimator(storage *storage.RedisStorage) *estimator {
+	return &estimator{
+		storage: storage,
+		cache:   make(map[string]cachedThroughput),
+	}
+}
+
+// throughput returns a queue's admission rate over the completed buckets of
+// the window, or the configured rate, fallback, until enough have been
+// observed. A queue that admitted before but not within the window has
+// stalled, and its rate is 0 rather than the fallback.
+func (e *estimator) throughput(ctx context.Context, queueID string, fallback float64, now time.Time) (Throughput, error) {
+	width := int64(storage.ThroughputBucket / time.Second)
+	current := now.Unix() / width * width
+
+	e.mu.Lock()
+	cached, ok := e.cache[queueID]
+	e.mu.Unlock()
+	if !ok || cached.bucket != current {
+		buckets, admitted, err := e.storage.Throughput(ctx, queueID)
+		if err != nil {
+			return Throughput{}, err
+		}
+		// Only the observation is cached, so a rate change applies at once
+		throughput, _ := observedThroughput(buckets, current, width, admitted)
+		cached = cachedThroughput{bucket: current, throughput: throughput}
+
+		e.mu.Lock()
+		e.cache[queueID] = cached
+		e.mu.Unlock()
+	}
+
+	if !cached.throughput.Observed {
+		return Throughput{Rate: fallback, Low: fallback, High: fallback}, nil
+	}
+	return cached.throughput, nil
+}
+
+// observedThroughput computes the mean rate over the buckets from the first
+// one observed up to current, exclusive, counting missing buckets as no
+// admissions. The range is the mean's 90% confidence interval. If nothing
+// was admitted in the window but the queue admitted before, the observed
+// rate is 0.
+func observedThroughput(buckets map[int64]int64, current, width int64, admitted bool) (Throughput, bool) {
+	first := current
+	windowStart := current - int64(storage.ThroughputWindow/time.Second)
+	empty := true
+	for start := range buckets {
+		if start >= windowStart {
+			empty = false
+			first = min(first, start)
+		}
+	}
+	if empty && admitted {
+		return Throughput{Observed: true}, true
+	}
+
+	n := (current - first) / width
+	if n < minThroughputBuckets {
+		return Throughput{}, false
+	}
+
+	var sum float64
+	for start := first; start < current; start += width {
+		sum += float64(buckets[start])
+	}
+	mean := sum / float64(n)
+
+	var variance float64
+	for start := first; start < current; start += width {
+		d := float64(buckets[start]) - mean
+		variance += d * d
+	}
+	variance /= float64(n - 1)
+
+	rate := mean / float64(width)
+	margin := confidenceZ * math.Sqrt(variance/float64(n)) / float64(width)
+	return Throughput{
+		Rate:     rate,
+		Low:      math.Max(rate-margin, rate*minRateFraction),
+		High:     rate + margin,
+		Observed: true,
+	}, true
+}
+
+// estimateWait fills in the wait time estimate of a waiting position. There
+// is none while admissions are frozen or before the lottery draw. A failure
+// only loses the estimate, not the status.
+func (s *Service) estimateWait(ctx context.Context, status *models.QueueStatus, queue *models.Queue) {
+	if !status.InQueue || status.PreQueue || status.Allowed || status.Session != nil || !queue.Admits() {
+		return
+	}
+	throughput, err := s.estimator.throughput(ctx, status.QueueID, queue.AdmissionRate, time.Now())
+	if err != nil {
+		log.Printf("estimating wait for queue %s: %v", status.QueueID, err)
+		return
+	}
+	status.WaitTimeEst, status.WaitTimeMin, status.WaitTimeMax = throughput.wait(status.Position)
+}
+
+// queueFull returns ErrQueueFull with a hint of when a place should free up,
+// going by the admission rate. While admissions are frozen it is the longest
+// hint given.
+func (s *Service) queueFull(ctx context.Context, queue *models.Queue, length int64) error {
+	retryAfter := int64(maxRetryAfter / time.Second)
+	if queue.Admits() {
+		throughput, err := s.estimator.throughput(ctx, queue.ID, queue.AdmissionRate, time.Now())
+		if err != nil {
+			log.Printf("estimating retry for queue %s: %v", queue.ID, err)
+		} else if throughput.Rate > 0 {
+			places := float64(length - queue.MaxQueueSize + 1)
+			retryAfter = min(max(int64(math.Ceil(places/throughput.Rate)), 1), retryAfter)
+		}
+	}
+	return ErrQueueFull.WithDetails(map[string]any{
+		"max_queue_size":      queue.MaxQueueSize,
+		"retry_after_seconds": retryAfter,
+	})
+}
+
+// Stats reports a queue's current load, admission rate and the wait a user
+// joining now can expect.
+func (s *Service) Stats(ctx context.Context, queueID string) (*models.QueueStats, error) {
+	queue, err := s.queueConfig(ctx, queueID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	waiting, active, err := s.storage.QueueCounts(ctx, queueID, now)
+	if err != nil {
+		return nil, err
+	}
+	throughput, err := s.estimator.throughput(ctx, queueID, queue.AdmissionRate, now)
+	if err != nil {
+		return nil, err
+	}
+	resumed, rejected, err := s.storage.IdentityStats(ctx, queueID)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &models.QueueStats{
+		QueueID:           queueID,
+		Status:            queue.Status,
+		CurrentWaiting:    waiting,
+		CurrentActive:     active,
+		AdmissionRate:     throughput.Rate,
+		AdmissionRateLow:  throughput.Low,
+		AdmissionRateHigh: throughput.High,
+		RateObserved:      throughput.Observed,
+		Identity: models.IdentityStats{
+			Policy:   queue.IdentityPolicy,
+			Limit:    queue.IdentityLimit,
+			Resumed:  resumed,
+			Rejected: rejected,
+		},
+	}
+	stats.WaitTimeEst, stats.WaitTimeMin, stats.WaitTimeMax = throughput.wait(waiting + 1)
+	return stats, nil
+}
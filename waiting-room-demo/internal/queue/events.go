@@ -0,0 +1,64 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/jawaracloud/waiting-room-demo/internal/storage"
+	"github.com/jawaracloud/waiting-room-demo/pkg/models"
+)
+
+// maxEventUserAgent bounds the User-Agent length carried in events.
+const maxEventUserAgent = 128
+
+// EventPublisher publishes waiting room lifecycle events, wrapping data in
+// the base event envelope for the given queue.
+type EventPublisher interface {
+	Publish(ctx context.Context, subject, queueID string, data any) error
+}
+
+// publish sends an event without failing the caller; events are a side
+// channel for analytics and audit consumers.
+func publish(ctx context.Context, events EventPublisher, subject, queueID string, data any) {
+	if err := events.Publish(ctx, subject, queueID, data); err != nil {
+		log.Printf("publishing %s for queue %s: %v", subject, queueID, err)
+	}
+}
+
+func (s *Service) publish(ctx context.Context, subject, queueID string, data any) {
+	publish(ctx, s.events, subject, queueID, data)
+}
+
+// publishAdmission emits a position admitted event per admitted position.
+func publishAdmission(ctx context.Context, events EventPublisher, queueID string, admission *storage.Admission, now time.Time) {
+	for _, p := range admission.Admitted {
+		publish(ctx, events, models.EventPositionAdmitted, queueID, models.PositionAdmittedData{
+			PositionID:  p.PositionID,
+			Priority:    p.Priority,
+			WaitTime:    int64(now.Sub(p.EnqueuedAt) / time.Second),
+			QueueLength: admission.Waiting,
+		})
+	}
+}
+
+// maskIP hides the host part of an address, e.g. 192.168.1.***.
+func maskIP(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.***", v4[0], v4[1], v4[2])
+	}
+	return parsed.Mask(net.CIDRMask(48, 128)).String() + "***"
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
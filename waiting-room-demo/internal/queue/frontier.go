@@ -0,0 +1,82 @@
+package queue
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jawaracloud/waiting-room-demo/internal/storage"
+	"github.com/jawaracloud/waiting-room-demo/pkg/models"
+)
+
+// Frontier is what every waiting position in a queue needs to work out where
+// it stands, read once for all of them.
+type Frontier struct {
+	queue      *models.Queue
+	lanes      *storage.Lanes
+	throughput Throughput
+}
+
+// Frontier reads a queue's settings, lanes and admission rate.
+func (s *Service) Frontier(ctx context.Context, queueID string) (*Frontier, error) {
+	queue, err := s.queueConfig(ctx, queueID)
+	if err != nil {
+		return nil, err
+	}
+	lanes, err := s.storage.GetLanes(ctx, queueID)
+	if err != nil {
+		return nil, err
+	}
+
+	frontier := &Frontier{queue: queue, lanes: lanes}
+	if queue.Admits() {
+		// As in estimateWait, a failure only loses the estimates
+		frontier.throughput, err = s.estimator.throughput(ctx, queueID, queue.AdmissionRate, time.Now())
+		if err != nil {
+			log.Printf("estimating wait for queue %s: %v", queueID, err)
+		}
+	}
+	return frontier, nil
+}
+
+// Project moves a waiting position's status, as last read from storage, on to
+// the frontier: up its lane by the admissions from the lane since, behind the
+// higher lanes as they are now. Positions ahead that left the queue by other
+// means are only accounted for at the next read. It returns false when the
+// position may have been admitted or drawn, and has to be read again.
+func (f *Frontier) Project(status *models.QueueStatus) (*models.QueueStatus, bool) {
+	if !status.InQueue || status.Allowed || status.Session != nil {
+		return nil, false
+	}
+
+	projected := *status
+	projected.WaitTimeEst, projected.WaitTimeMin, projected.WaitTimeMax = 0, 0, 0
+	if status.PreQueue {
+		if f.lanes.PreQueue == 0 {
+			return nil, false
+		}
+		projected.TotalInQueue = f.lanes.PreQueue
+		applyQueueConfig(&projected, f.queue)
+		return &projected, true
+	}
+
+	lane := status.Priority
+	projected.LanePosition = status.LanePosition - (f.lanes.Departed[lane] - status.LaneDeparted)
+	if projected.LanePosition <= 0 {
+		return nil, false
+	}
+	projected.Position = projected.LanePosition
+	projected.TotalInQueue = 0
+	for i, waiting := range f.lanes.Waiting {
+		if i > lane {
+			projected.Position += waiting
+		}
+		projected.TotalInQueue += waiting
+	}
+
+	applyQueueConfig(&projected, f.queue)
+	if f.queue.Admits() {
+		projected.WaitTimeEst, projected.WaitTimeMin, projected.WaitTimeMax = f.throughput.wait(projected.Position)
+	}
+	return &projected, true
+}
@@ -0,0 +1,171 @@
+package queue
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jawaracloud/waiting-room-demo/internal/storage"
+	"github.com/jawaracloud/waiting-room-demo/pkg/models"
+)
+
+// defaultSweepBatch is used when HeartbeatConfig.BatchSize is unset.
+const defaultSweepBatch = 1000
+
+// HeartbeatConfig holds heartbeat and cleanup configuration.
+type HeartbeatConfig struct {
+	Timeout         time.Duration // for queues without their own heartbeat timeout
+	CleanupInterval time.Duration
+	BatchSize       int64 // positions or sessions removed per script call
+}
+
+// HeartbeatService records client heartbeats and removes positions whose
+// heartbeats have stopped.
+type HeartbeatService struct {
+	storage *storage.RedisStorage
+	queue   *Service
+	config  HeartbeatConfig
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+func NewHeartbeatService(storage *storage.RedisStorage, queue *Service, config HeartbeatConfig) *HeartbeatService {
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaultSweepBatch
+	}
+	return &HeartbeatService{
+		storage: storage,
+		queue:   queue,
+		config:  config,
+	}
+}
+
+// Heartbeat refreshes the last-seen time of a position and returns its status.
+func (h *HeartbeatService) Heartbeat(ctx context.Context, claims *models.QueueToken) (*models.QueueStatus, error) {
+	status, err := h.queue.Status(ctx, claims)
+	if err != nil {
+		return nil, err
+	}
+	if !status.InQueue {
+		return nil, ErrPositionNotFound.WithDetails(map[string]any{"position_id": claims.PositionID})
+	}
+	return status, nil
+}
+
+// Start launches the background cleanup worker.
+func (h *HeartbeatService) Start(ctx context.Context) error {
+	ctx, h.cancel = context.WithCancel(ctx)
+
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		h.run(ctx)
+	}()
+	return nil
+}
+
+// Stop halts the cleanup worker and waits for it to exit.
+func (h *HeartbeatService) Stop() {
+	if h.cancel != nil {
+		h.cancel()
+	}
+	h.wg.Wait()
+}
+
+func (h *HeartbeatService) run(ctx context.Context) {
+	ticker := time.NewTicker(h.config.CleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.cleanup(ctx)
+		}
+	}
+}
+
+func (h *HeartbeatService) cleanup(ctx context.Context) {
+	queues, err := h.storage.Queues(ctx)
+	if err != nil {
+		log.Printf("heartbeat cleanup: listing queues: %v", err)
+		return
+	}
+
+	for _, queueID := range queues {
+		expired, err := h.expirePositions(ctx, queueID)
+		if err != nil {
+			log.Printf("heartbeat cleanup: queue %s: %v", queueID, err)
+		}
+		for _, positionID := range expired {
+			h.queue.publish(ctx, models.EventPositionExpired, queueID, models.PositionExpiredData{
+				PositionID: positionID,
+				Reason:     models.ReasonHeartbeatTimeout,
+			})
+		}
+
+		sessions, err := h.expireSessions(ctx, queueID)
+		if err != nil {
+			log.Printf("session cleanup: queue %s: %v", queueID, err)
+		}
+		for _, session := range sessions {
+			h.queue.publish(ctx, models.EventSessionExpired, queueID, models.SessionExpiredData{
+				SessionID:  session.ID,
+				PositionID: session.PositionID,
+				Duration:   int64(session.ExpiresAt.Sub(session.StartedAt) / time.Second),
+				PageViews:  session.PageViews,
+				Reason:     models.ReasonSessionTimeout,
+			})
+		}
+
+		if _, err := h.storage.PruneQueue(ctx, queueID); err != nil {
+			log.Printf("heartbeat cleanup: pruning queue %s: %v", queueID, err)
+		}
+	}
+}
+
+// expirePositions removes every position of a queue whose heartbeat has
+// timed out, one bounded batch at a time, and returns their IDs. Paused
+// queues expire positions too, so a pause doesn't hold abandoned places.
+func (h *HeartbeatService) expirePositions(ctx context.Context, queueID string) ([]string, error) {
+	timeout := h.config.Timeout
+	queue, err := h.storage.GetQueue(ctx, queueID)
+	if err != nil {
+		return nil, err
+	}
+	if queue != nil {
+		timeout = queue.HeartbeatTimeoutDuration()
+	}
+	cutoff := time.Now().Add(-timeout)
+
+	var expired []string
+	for {
+		batch, err := h.storage.ExpirePositions(ctx, queueID, cutoff, h.config.BatchSize)
+		if err != nil {
+			return expired, err
+		}
+		expired = append(expired, batch...)
+		if int64(len(batch)) < h.config.BatchSize || ctx.Err() != nil {
+			return expired, nil
+		}
+	}
+}
+
+// expireSessions ends every session of a queue that has run past its expiry,
+// one bounded batch at a time, and returns them.
+func (h *HeartbeatService) expireSessions(ctx context.Context, queueID string) ([]*models.Session, error) {
+	now := time.Now()
+	var expired []*models.Session
+	for {
+		batch, err := h.storage.ExpireSessions(ctx, queueID, now, h.config.BatchSize)
+		if err != nil {
+			return expired, err
+		}
+		expired = append(expired, batch...)
+		if int64(len(batch)) < h.config.BatchSize || ctx.Err() != nil {
+			return expired, nil
+		}
+	}
+}
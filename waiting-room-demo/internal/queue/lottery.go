@@ -0,0 +1,198 @@
+package queue
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/jawaracloud/waiting-room-demo/internal/storage"
+	"github.com/jawaracloud/waiting-room-demo/pkg/models"
+)
+
+// lotteryAlgorithm names how a cohort is ordered from the seed, so anyone
+// holding the seed can recompute a draw.
+const lotteryAlgorithm = "hmac-sha256-asc"
+
+// lotterySeedBytes is the size of a lottery seed.
+const lotterySeedBytes = 32
+
+var (
+	ErrQueueNotOpen  = models.NewError(models.CodeQueueNotOpen, "The queue is not open yet")
+	ErrLotteryLocked = models.NewError(models.CodeInvalidRequest, "The lottery pre-queue has already closed")
+	ErrNoLottery     = models.NewError(models.CodeNotFound, "Queue has no lottery")
+)
+
+// preQueue reports whether a user arriving now joins the queue's lottery
+// pre-queue. Arrivals before the pre-queue window are turned away with a hint
+// of when it opens.
+func preQueue(queue *models.Queue, now time.Time) (bool, error) {
+	if queue.OpensAt == nil || !now.Before(*queue.OpensAt) {
+		return false, nil
+	}
+	if start := queue.PreQueueOpensAt(); now.Before(start) {
+		return false, ErrQueueNotOpen.WithDetails(map[string]any{
+			"prequeue_opens_at":   start,
+			"opens_at":            *queue.OpensAt,
+			"retry_after_seconds": int64(math.Ceil(start.Sub(now).Seconds())),
+		})
+	}
+	return true, nil
+}
+
+// runLottery draws a lottery queue's cohort once it opens, and reports
+// whether the queue is ready for admissions: queues without a lottery always
+// are, lottery queues only once drawn, so nobody who arrived after the
+// opening can be admitted ahead of the cohort.
+func runLottery(ctx context.Context, st *storage.RedisStorage, events EventPublisher, queue *models.Queue, now time.Time) (bool, error) {
+	if queue.OpensAt == nil {
+		return true, nil
+	}
+	state, err := st.LotteryState(ctx, queue.ID)
+	if err != nil || state == models.LotteryDrawn {
+		return err == nil, err
+	}
+	if now.Before(*queue.OpensAt) {
+		return false, nil
+	}
+
+	cohort, open, err := st.ClosePreQueue(ctx, queue.ID)
+	if err != nil || !open {
+		return err == nil, err
+	}
+
+	sealed, err := st.LotterySeed(ctx, queue.ID)
+	if err != nil {
+		return false, err
+	}
+	if sealed == "" {
+		log.Printf("lottery: queue %s has no committed seed, drawing with a fresh one", queue.ID)
+		if sealed, err = newLotterySeed(); err != nil {
+			return false, err
+		}
+	}
+	seed, err := hex.DecodeString(sealed)
+	if err != nil {
+		return false, err
+	}
+	draw := &models.Lottery{
+		QueueID:   queue.ID,
+		OpensAt:   *queue.OpensAt,
+		Seed:      sealed,
+		Algorithm: lotteryAlgorithm,
+		DrawnAt:   &now,
+		Order:     lotteryOrder(seed, cohort),
+	}
+	size, err := st.DrawLottery(ctx, draw)
+	if err != nil {
+		return false, err
+	}
+	if size < 0 {
+		// Another replica drew first
+		return true, nil
+	}
+
+	log.Printf("lottery: queue %s drew %d positions with seed %s", queue.ID, size, draw.Seed)
+	publish(ctx, events, models.EventQueueLotteryDrawn, queue.ID, models.LotteryDrawnData{
+		QueueID:    queue.ID,
+		SeedSHA256: queue.LotterySeedSHA256,
+		Seed:       draw.Seed,
+		Algorithm:  draw.Algorithm,
+		CohortSize: size,
+		DrawnAt:    *draw.DrawnAt,
+	})
+	return true, nil
+}
+
+// lotteryOrder orders a cohort by HMAC-SHA256(seed, position ID). The seed
+// stays secret until the draw, so no arrival time or position ID can be
+// chosen to land early, and its hash is published beforehand, so the seed
+// can't be chosen to favor anyone either. The order follows from the seed
+// alone.
+func lotteryOrder(seed []byte, cohort []string) []string {
+	type entry struct {
+		id  string
+		key []byte
+	}
+	entries := make([]entry, len(cohort))
+	for i, id := range cohort {
+		mac := hmac.New(sha256.New, seed)
+		mac.Write([]byte(id))
+		entries[i] = entry{id: id, key: mac.Sum(nil)}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return string(entries[i].key) < string(entries[j].key)
+	})
+
+	order := make([]string, len(entries))
+	for i, e := range entries {
+		order[i] = e.id
+	}
+	return order
+}
+
+// commitLottery seals a seed for a lottery queue's draw, if it has none yet,
+// and sets the queue's commitment to it: the hex SHA-256 of the seed bytes.
+// The commitment is published with the queue, and the seed revealed at the
+// draw, so anyone can check the draw used the seed committed to before the
+// pre-queue opened.
+func (s *Service) commitLottery(ctx context.Context, queue *models.Queue) error {
+	if queue.OpensAt == nil || queue.LotterySeedSHA256 != "" {
+		return nil
+	}
+	seed, err := newLotterySeed()
+	if err != nil {
+		return err
+	}
+	if seed, err = s.storage.SealLotterySeed(ctx, queue.ID, seed); err != nil {
+		return err
+	}
+	queue.LotterySeedSHA256 = seedCommitment(seed)
+	return nil
+}
+
+// newLotterySeed returns a random hex seed.
+func newLotterySeed() (string, error) {
+	seed := make([]byte, lotterySeedBytes)
+	if _, err := rand.Read(seed); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(seed), nil
+}
+
+// seedCommitment returns the hex SHA-256 of a hex seed's bytes.
+func seedCommitment(seed string) string {
+	b, _ := hex.DecodeString(seed)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// Lottery returns the audit record of a lottery queue's draw.
+func (s *Service) Lottery(ctx context.Context, queueID string) (*models.Lottery, error) {
+	queue, err := s.Queue(ctx, queueID)
+	if err != nil {
+		return nil, err
+	}
+	if queue.OpensAt == nil {
+		return nil, ErrNoLottery
+	}
+
+	lottery, err := s.storage.GetLottery(ctx, queueID)
+	if err != nil {
+		return nil, err
+	}
+	if lottery == nil {
+		lottery = &models.Lottery{QueueID: queueID, State: models.LotteryPending}
+		if lottery.CohortSize, err = s.storage.PreQueueSize(ctx, queueID); err != nil {
+			return nil, err
+		}
+	}
+	lottery.OpensAt = *queue.OpensAt
+	lottery.SeedSHA256 = queue.LotterySeedSHA256
+	return lottery, nil
+}
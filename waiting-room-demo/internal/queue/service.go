@@ -2,105 +2,315 @@ package queue
 
 import (
 	"context"
-	"errors"
 	"time"
 
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
+	"github.com/jawaracloud/waiting-room-demo/internal/challenge"
 	"github.com/jawaracloud/waiting-room-demo/internal/storage"
+	"github.com/jawaracloud/waiting-room-demo/internal/token"
 	"github.com/jawaracloud/waiting-room-demo/pkg/models"
 )
 
 var (
-	ErrInvalidToken = errors.New("invalid token")
-	ErrExpiredToken = errors.New("expired token")
+	ErrInvalidToken     = token.ErrInvalidToken
+	ErrExpiredToken     = token.ErrExpiredToken
+	ErrRevokedToken     = token.ErrRevokedToken
+	ErrClientMismatch   = token.ErrClientMismatch
+	ErrWrongQueue       = models.NewError(models.CodeForbidden, "Token was issued for a different queue")
+	ErrPositionNotFound = models.NewError(models.CodePositionExpired, "Your position in the queue has expired")
+	ErrNotAdmitted      = models.NewError(models.CodeNotFound, "Session not found")
+	ErrSessionExpired   = models.NewError(models.CodeSessionExpired, "Your session has expired")
+	ErrInvalidPriority  = models.NewError(models.CodeInvalidRequest, "Priority must be between 0 and 3")
+	ErrQueueFull        = models.NewError(models.CodeQueueFull, "The queue is full, please try again later")
+	ErrAlreadyQueued    = models.NewError(models.CodeAlreadyQueued, "You already hold a position in this queue")
+	ErrUserIDRequired   = models.NewError(models.CodeInvalidRequest, "This queue requires metadata.user_id")
 )
 
+// Config holds queue service configuration.
+type Config struct {
+	DefaultPositionTTL time.Duration
+	DefaultSessionTTL  time.Duration
+	HeartbeatTimeout   time.Duration
+	HeartbeatInterval  time.Duration
+	AdmissionRate      float64               // expected admissions per second until throughput is observed
+	MaxActiveUsers     int64                 // active-user cap for queues that were never configured
+	MaxQueueSize       int64                 // waiting-user cap for queues that were never configured, 0 for unlimited
+	ClientBinding      string                // binding mode for queues without their own
+	ResumeGrace        time.Duration         // how long after its last heartbeat a client can get its position back by enqueueing again, 0 to disable
+	Challenges         []challenge.Challenge // challenges queues can require enqueues to solve
+}
+
 type Service struct {
-	storage   *storage.RedisStorage
-	jwtSecret []byte
+	storage    *storage.RedisStorage
+	tokens     *token.Service
+	events     EventPublisher
+	estimator  *estimator
+	challenges map[string]challenge.Challenge
+	config     Config
 }
 
-func NewService(storage *storage.RedisStorage, secret string) *Service {
-	return &Service{
-		storage:   storage,
-		jwtSecret: []byte(secret),
+func NewService(storage *storage.RedisStorage, tokens *token.Service, events EventPublisher, config Config) *Service {
+	s := &Service{
+		storage:    storage,
+		tokens:     tokens,
+		events:     events,
+		estimator:  newEstimator(storage),
+		challenges: make(map[string]challenge.Challenge),
+		config:     config,
+	}
+	for _, c := range config.Challenges {
+		s.challenges[c.Type()] = c
 	}
+	return s
 }
 
-func (s *Service) Enqueue(ctx context.Context) (string, *models.QueueStatus, error) {
-	queueID := uuid.New().String()
-	score := time.Now().UnixNano()
+// Enqueue adds a new position to a queue and issues its queue token, bound to
+// client according to the queue's binding mode. Paused queues still take new
+// users; closed queues and queues under maintenance don't.
+//
+// With a resume grace period configured, a client that enqueues again, for
+// instance after its tab crashed with the token, gets its earlier position
+// back with a new token, as long as that position was seen within the grace
+// period. Clients are told apart by their IP address, User-Agent and user ID.
+//
+// Queues that require a challenge only take enqueues with a solution to one
+// issued by IssueChallenge. The solution is used up only if the enqueue adds
+// or resumes a position.
+//
+// A queue's identity policy limits the positions one identity can hold: an
+// identity at its limit is turned away under the ip and user_id policies, and
+// given its position back under the fingerprint policy.
+func (s *Service) Enqueue(ctx context.Context, queueID string, priority int, client token.Client, solution *models.ChallengeSolution) (string, *models.QueueStatus, error) {
+	if priority < models.PriorityNormal || priority > models.PriorityPremium {
+		return "", nil, ErrInvalidPriority
+	}
 
-	total, err := s.storage.Enqueue(ctx, queueID, score)
+	queue, err := s.queueConfig(ctx, queueID)
 	if err != nil {
 		return "", nil, err
 	}
+	if err := checkAccepting(queue); err != nil {
+		return "", nil, err
+	}
 
-	// Create JWT
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, models.QueueToken{
-		QueueID:  queueID,
-		IssuedAt: score,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
-		},
-	})
+	positionID := uuid.New().String()
+	now := time.Now()
+	params := storage.EnqueueParams{MaxSize: queue.MaxQueueSize}
+	if params.PreQueue, err = preQueue(queue, now); err != nil {
+		return "", nil, err
+	}
+	if queue.OpensAt != nil {
+		params.OpensAt = *queue.OpensAt
+	}
+	if s.config.ResumeGrace > 0 {
+		params.ClientKey = s.tokens.ClientKey(client)
+		params.ResumeAfter = now.Add(-s.config.ResumeGrace)
+	}
+	if queue.IdentityPolicy != models.IdentityNone {
+		if err := s.identityParams(&params, queue, client); err != nil {
+			return "", nil, err
+		}
+	}
 
-	tokenString, err := token.SignedString(s.jwtSecret)
+	if err := s.checkChallenge(ctx, queue, solution, now); err != nil {
+		return "", nil, err
+	}
+	result, err := s.storage.Enqueue(ctx, queueID, positionID, priority, params, now)
+	if err != nil || !result.Added {
+		s.releaseChallenge(ctx, queue, solution)
+	}
 	if err != nil {
 		return "", nil, err
 	}
+	if result.Duplicate {
+		return "", nil, ErrAlreadyQueued.WithDetails(map[string]any{
+			"identity_policy": queue.IdentityPolicy,
+			"identity_limit":  max(queue.IdentityLimit, 1),
+		})
+	}
+	if !result.Added {
+		return "", nil, s.queueFull(ctx, queue, result.QueueLength)
+	}
+	s.acceptChallenge(ctx, queue, now)
+	positionID, priority = result.PositionID, result.Priority
 
-	allowed, pos, _, err := s.storage.GetStatus(ctx, queueID, score)
+	binding := s.tokens.Bind(queue.ClientBinding, client)
+	issue := s.tokens.IssueQueueToken
+	if result.Resumed {
+		issue = s.tokens.ReissueQueueToken
+	}
+	tokenString, expiresAt, err := issue(queueID, positionID, priority, binding, now)
+	if err != nil {
+		return "", nil, err
+	}
+
+	st, err := s.storage.GetStatus(ctx, queueID, positionID, now)
 	if err != nil {
 		return "", nil, err
 	}
 
-	return tokenString, &models.QueueStatus{
-		InQueue:      true,
-		Position:     pos,
-		TotalInQueue: total,
-		Allowed:      allowed,
-	}, nil
+	if !result.Resumed {
+		s.publish(ctx, models.EventPositionEnqueued, queueID, models.PositionEnqueuedData{
+			PositionID:  positionID,
+			Priority:    priority,
+			IPAddress:   maskIP(client.IP),
+			UserAgent:   truncate(client.UserAgent, maxEventUserAgent),
+			QueueLength: result.QueueLength,
+		})
+	}
+	status := newQueueStatus(queueID, positionID, expiresAt, st)
+	status.Resumed = result.Resumed
+	applyQueueConfig(status, queue)
+	s.estimateWait(ctx, status, queue)
+	return tokenString, status, nil
 }
 
-func (s *Service) CheckStatus(ctx context.Context, tokenString string) (*models.QueueStatus, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &models.QueueToken{}, func(token *jwt.Token) (interface{}, error) {
-		return s.jwtSecret, nil
-	})
+// identityParams applies a queue's identity policy to an enqueue by client.
+func (s *Service) identityParams(params *storage.EnqueueParams, queue *models.Queue, client token.Client) error {
+	params.IdentityPolicy = queue.IdentityPolicy
+	params.IdentityKey = s.tokens.IdentityKey(queue.IdentityPolicy, client)
+	if params.IdentityKey == "" {
+		return ErrUserIDRequired.WithDetails(map[string]any{"field": "metadata.user_id"})
+	}
+	params.IdentityLimit = max(queue.IdentityLimit, 1)
+	params.IdentityResume = queue.IdentityPolicy == models.IdentityFingerprint
+	return nil
+}
 
-	if err != nil || !token.Valid {
-		return nil, ErrInvalidToken
+// CheckStatus validates a queue token and returns the status of its position.
+func (s *Service) CheckStatus(ctx context.Context, queueID, tokenString string, client token.Client) (*models.QueueStatus, error) {
+	claims, err := s.tokens.ValidateQueueToken(ctx, tokenString, client)
+	if err != nil {
+		return nil, err
+	}
+	if claims.QueueID != queueID {
+		return nil, ErrWrongQueue
 	}
 
-	claims := token.Claims.(*models.QueueToken)
-	now := time.Now().UnixNano()
+	return s.Status(ctx, claims)
+}
 
-	allowed, pos, total, err := s.storage.GetStatus(ctx, claims.QueueID, now)
+// Status returns the status of the position a validated token refers to and
+// counts as a heartbeat. Once the position is admitted, the first call starts
+// its session.
+func (s *Service) Status(ctx context.Context, claims *models.QueueToken) (*models.QueueStatus, error) {
+	st, err := s.storage.GetStatus(ctx, claims.QueueID, claims.PositionID, time.Now())
 	if err != nil {
 		return nil, err
 	}
-
-	return &models.QueueStatus{
-		InQueue:      pos != -1,
-		Position:     pos,
-		TotalInQueue: total,
-		Allowed:      allowed,
-	}, nil
+	return s.status(ctx, claims, st)
 }
 
-func (s *Service) AllowMore(ctx context.Context, n int64) (int64, error) {
-	return s.storage.AllowNext(ctx, n)
+// Peek is like Status but doesn't count as a heartbeat, for server-initiated
+// updates that say nothing about whether the client is still there.
+func (s *Service) Peek(ctx context.Context, claims *models.QueueToken) (*models.QueueStatus, error) {
+	st, err := s.storage.PeekStatus(ctx, claims.QueueID, claims.PositionID)
+	if err != nil {
+		return nil, err
+	}
+	return s.status(ctx, claims, st)
 }
 
-func (s *Service) RunCleanup(ctx context.Context, interval time.Duration, timeout int64) {
-	ticker := time.NewTicker(interval)
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-ticker.C:
-			s.storage.CleanupStaleSessions(ctx, timeout)
+func (s *Service) status(ctx context.Context, claims *models.QueueToken, st *storage.PositionStatus) (*models.QueueStatus, error) {
+	status := newQueueStatus(claims.QueueID, claims.PositionID, claims.RegisteredClaims.ExpiresAt.Time, st)
+
+	queue, err := s.queueConfig(ctx, claims.QueueID)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case st.Admitted:
+		status.Session, err = s.startSession(ctx, claims, queue.SessionTTL())
+	case !st.Found:
+		// The position leaves the queue once its session starts
+		status.Session, err = s.positionSession(ctx, claims)
+		if status.Session != nil {
+			status.InQueue = true
+			status.Allowed = true
 		}
 	}
+	if err != nil {
+		return nil, err
+	}
+	applyQueueConfig(status, queue)
+	s.estimateWait(ctx, status, queue)
+	return status, nil
+}
+
+// Cancel removes the position a validated token refers to.
+func (s *Service) Cancel(ctx context.Context, claims *models.QueueToken) error {
+	removed, err := s.storage.Remove(ctx, claims.QueueID, claims.PositionID)
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return ErrPositionNotFound.WithDetails(map[string]any{"position_id": claims.PositionID})
+	}
+
+	s.publish(ctx, models.EventPositionCancelled, claims.QueueID, models.PositionExpiredData{
+		PositionID: claims.PositionID,
+		Reason:     models.ReasonCancelled,
+	})
+	return nil
+}
+
+// RevokePosition revokes a position's queue token and removes it from the
+// queue, whether it is still waiting or already admitted.
+func (s *Service) RevokePosition(ctx context.Context, queueID, positionID, reason string) error {
+	if err := s.tokens.RevokeQueueToken(ctx, positionID, reason); err != nil {
+		return err
+	}
+
+	removed, err := s.storage.Remove(ctx, queueID, positionID)
+	if err != nil {
+		return err
+	}
+	if removed {
+		s.publish(ctx, models.EventPositionExpired, queueID, models.PositionExpiredData{
+			PositionID: positionID,
+			Reason:     models.ReasonAdminRevoked,
+		})
+	}
+	return nil
+}
+
+// AllowMore admits the next n waiting users regardless of the admission rate.
+func (s *Service) AllowMore(ctx context.Context, queueID string, n int64) (int64, error) {
+	admission, err := s.storage.AllowNext(ctx, queueID, n)
+	if err != nil {
+		return 0, err
+	}
+	publishAdmission(ctx, s.events, queueID, admission, time.Now())
+	return int64(len(admission.Admitted)), nil
+}
+
+// applyQueueConfig adds the queue's settings to a status. The target URL is
+// only given out to admitted users.
+func applyQueueConfig(status *models.QueueStatus, queue *models.Queue) {
+	status.QueueState = queue.Status
+	if status.PreQueue {
+		status.OpensAt = queue.OpensAt
+	}
+	status.HeartbeatInterval = queue.HeartbeatIntervalDuration()
+	status.HeartbeatTimeout = queue.HeartbeatTimeoutDuration()
+	if status.Allowed {
+		status.TargetURL = queue.TargetURL
+	}
+}
+
+func newQueueStatus(queueID, positionID string, expiresAt time.Time, st *storage.PositionStatus) *models.QueueStatus {
+	return &models.QueueStatus{
+		PositionID:   positionID,
+		QueueID:      queueID,
+		InQueue:      st.Found,
+		PreQueue:     st.PreQueue,
+		Priority:     st.Priority,
+		Position:     st.Position,
+		LanePosition: st.LanePosition,
+		TotalInQueue: st.QueueLength,
+		Allowed:      st.Admitted,
+		ExpiresAt:    expiresAt,
+		LaneDeparted: st.Departed,
+	}
 }
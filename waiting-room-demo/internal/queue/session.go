@@ -0,0 +1,178 @@
+package queue
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jawaracloud/waiting-room-demo/pkg/models"
+)
+
+// startSession turns an admitted position into an active session with its
+// own session token, lasting ttl. Repeated calls for the same position return
+// the session that was started first.
+func (s *Service) startSession(ctx context.Context, claims *models.QueueToken, ttl time.Duration) (*models.Session, error) {
+	now := time.Now()
+	session := &models.Session{
+		ID:           uuid.New().String(),
+		QueueID:      claims.QueueID,
+		PositionID:   claims.PositionID,
+		Status:       models.SessionActive,
+		StartedAt:    now,
+		LastActivity: now,
+	}
+
+	tokenString, expiresAt, err := s.tokens.IssueSessionToken(session.QueueID, session.ID, session.PositionID, claims.ClientBinding, ttl, now)
+	if err != nil {
+		return nil, err
+	}
+	session.Token = tokenString
+	session.ExpiresAt = expiresAt
+
+	id, err := s.storage.StartSession(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+	if id == "" {
+		return nil, ErrNotAdmitted
+	}
+	if id != session.ID {
+		return s.loadSession(ctx, claims.QueueID, id)
+	}
+
+	s.publish(ctx, models.EventSessionStarted, session.QueueID, models.SessionStartedData{
+		SessionID:  session.ID,
+		PositionID: session.PositionID,
+		ExpiresAt:  session.ExpiresAt,
+	})
+	return session, nil
+}
+
+// positionSession returns the session a position already started, or nil.
+func (s *Service) positionSession(ctx context.Context, claims *models.QueueToken) (*models.Session, error) {
+	id, err := s.storage.PositionSession(ctx, claims.QueueID, claims.PositionID)
+	if err != nil || id == "" {
+		return nil, err
+	}
+	return s.loadSession(ctx, claims.QueueID, id)
+}
+
+func (s *Service) loadSession(ctx context.Context, queueID, sessionID string) (*models.Session, error) {
+	session, err := s.storage.GetSession(ctx, queueID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if session == nil {
+		return nil, sessionExpired(sessionID)
+	}
+	return session, nil
+}
+
+// Session returns the session a validated session token refers to.
+func (s *Service) Session(ctx context.Context, claims *models.SessionToken) (*models.Session, error) {
+	return s.loadSession(ctx, claims.QueueID, claims.SessionID)
+}
+
+// RecordActivity counts a page view on an active session.
+func (s *Service) RecordActivity(ctx context.Context, claims *models.SessionToken) (*models.Session, error) {
+	pageViews, err := s.storage.RecordSessionActivity(ctx, claims.QueueID, claims.SessionID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if pageViews == -1 {
+		return nil, sessionExpired(claims.SessionID)
+	}
+
+	return s.loadSession(ctx, claims.QueueID, claims.SessionID)
+}
+
+// RefreshSession slides an active session's expiry forward with a new session
+// token, for users who are still busy when their session nears its end. The
+// old token is retired only once the session has been extended, so a failed
+// extension leaves it working.
+func (s *Service) RefreshSession(ctx context.Context, claims *models.SessionToken) (*models.Session, error) {
+	session, err := s.loadSession(ctx, claims.QueueID, claims.SessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	session.Token, session.ExpiresAt, err = s.tokens.RefreshSessionToken(claims, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	extended, err := s.storage.ExtendSession(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+	if !extended {
+		return nil, sessionExpired(claims.SessionID)
+	}
+	if err := s.tokens.RetireSessionToken(ctx, claims); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// EndSession finishes an active session with the given status, freeing its
+// slot for the next waiting user.
+func (s *Service) EndSession(ctx context.Context, queueID, sessionID, status string) error {
+	ended, err := s.storage.EndSession(ctx, queueID, sessionID, status)
+	if err != nil {
+		return err
+	}
+	if !ended {
+		return sessionExpired(sessionID)
+	}
+	return nil
+}
+
+// TerminateSession ends a session early and revokes both its session token
+// and the queue token it was admitted with, so the holder can neither browse
+// nor rejoin with them.
+func (s *Service) TerminateSession(ctx context.Context, sessionID, reason string) (*models.Session, error) {
+	session, err := s.findSession(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.EndSession(ctx, session.QueueID, session.ID, models.SessionTerminated); err != nil {
+		return nil, err
+	}
+	if err := s.tokens.RevokeSessionToken(ctx, session.ID, session.ExpiresAt, reason); err != nil {
+		return nil, err
+	}
+	if err := s.tokens.RevokeQueueToken(ctx, session.PositionID, reason); err != nil {
+		return nil, err
+	}
+
+	session.Status = models.SessionTerminated
+	s.publish(ctx, models.EventSessionTerminated, session.QueueID, models.SessionTerminatedData{
+		SessionID:    session.ID,
+		PositionID:   session.PositionID,
+		Reason:       reason,
+		TerminatedAt: time.Now(),
+	})
+	return session, nil
+}
+
+// findSession looks a session up by ID alone, across every known queue.
+func (s *Service) findSession(ctx context.Context, sessionID string) (*models.Session, error) {
+	queueIDs, err := s.storage.Queues(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, queueID := range queueIDs {
+		session, err := s.storage.GetSession(ctx, queueID, sessionID)
+		if err != nil {
+			return nil, err
+		}
+		if session != nil {
+			return session, nil
+		}
+	}
+	return nil, sessionExpired(sessionID)
+}
+
+func sessionExpired(sessionID string) error {
+	return ErrSessionExpired.WithDetails(map[string]any{"session_id": sessionID})
+}
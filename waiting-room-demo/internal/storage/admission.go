@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+func KeyAdmission(queueID string) string {
+	return fmt.Sprintf("waiting_room:{%s}:admission", queueID)
+}
+
+// AdmissionParams configures one admission round.
+type AdmissionParams struct {
+	Capacity       float64 // token bucket size
+	Rate           float64 // tokens added per second
+	MaxActive      int64   // admitted users and live sessions allowed at once, 0 for unlimited
+	NormalMinShare float64 // minimum fraction of admissions reserved for lane 0
+}
+
+// popLanesLua defines pop_lanes, which moves up to n positions from the four
+// lane keys starting at KEYS[first] into the admitted set. Up to reserved of
+// them come from lane 0 first; the rest are taken from the highest lane down.
+// Each lane's departures are counted in departures_key. It returns a flat
+// list of position ID, arrival time and lane triples. Lottery entrants are
+// scored by the draw, so their arrival is taken from arrivals_key instead.
+//
+// count_waiting sums the four lanes starting at KEYS[first].
+const popLanesLua = `
+	local function pop_lanes(first, n, reserved, admitted_key, departures_key, arrivals_key, now)
+		local admitted = {}
+		local count = 0
+		local function take(lane, limit)
+			if limit <= 0 then return end
+			local popped = redis.call('ZPOPMIN', KEYS[first + lane], limit)
+			for i = 1, #popped, 2 do
+				redis.call('ZADD', admitted_key, now, popped[i])
+				local arrived = redis.call('HGET', arrivals_key, popped[i])
+				if arrived then
+					redis.call('HDEL', arrivals_key, popped[i])
+				end
+				admitted[#admitted + 1] = popped[i]
+				admitted[#admitted + 1] = arrived or popped[i + 1]
+				admitted[#admitted + 1] = lane
+				count = count + 1
+			end
+			if #popped > 0 then
+				redis.call('HINCRBY', departures_key, lane, #popped / 2)
+			end
+		end
+
+		take(0, math.min(reserved, n))
+		for lane = 3, 0, -1 do
+			take(lane, n - count)
+		end
+		return admitted, count
+	end
+
+	local function count_waiting(first)
+		local waiting = 0
+		for i = first, first + 3 do
+			waiting = waiting + redis.call('ZCARD', KEYS[i])
+		end
+		return waiting
+	end
+`
+
+// AdmittedPosition is a position moved from its lane into the admitted set.
+type AdmittedPosition struct {
+	PositionID string
+	Priority   int
+	EnqueuedAt time.Time
+}
+
+// Admission is the outcome of one admission round.
+type Admission struct {
+	Admitted []AdmittedPosition
+	Waiting  int64 // users still waiting afterwards
+}
+
+// parseAdmission decodes a {waiting, id, arrival, lane, ...} script reply.
+func parseAdmission(res []interface{}) (*Admission, error) {
+	if len(res) == 0 || (len(res)-1)%3 != 0 {
+		return nil, fmt.Errorf("unexpected admission reply of length %d", len(res))
+	}
+	waiting, _ := res[0].(int64)
+
+	admission := &Admission{Waiting: waiting}
+	for i := 1; i < len(res); i += 3 {
+		id, _ := res[i].(string)
+		score, _ := res[i+1].(string)
+		lane, _ := res[i+2].(int64)
+		micros, _ := strconv.ParseFloat(score, 64)
+		admission.Admitted = append(admission.Admitted, AdmittedPosition{
+			PositionID: id,
+			Priority:   int(lane),
+			EnqueuedAt: time.UnixMicro(int64(micros)),
+		})
+	}
+	return admission, nil
+}
+
+// admitScript refills the queue's token bucket and admits as many waiting
+// users as the bucket, the active-user limit and the queue length allow.
+// Everything happens in one script so that concurrent callers on different
+// replicas can never over-admit.
+//
+// Lane 0 accrues credit at normal_share per admission; whole credits are
+// spent admitting lane 0 ahead of the higher lanes so it can't be starved.
+var admitScript = popLanesLua + throughputLua + `
+	local capacity = tonumber(ARGV[1])
+	local rate = tonumber(ARGV[2])
+	local max_active = tonumber(ARGV[3])
+	local now = tonumber(ARGV[4])
+	local normal_share = tonumber(ARGV[5])
+
+	local state = redis.call('HMGET', KEYS[1], 'tokens', 'last_update', 'normal_credit')
+	local tokens = tonumber(state[1]) or capacity
+	local last_update = tonumber(state[2]) or now
+	local credit = tonumber(state[3]) or 0
+
+	local elapsed = math.max(0, now - last_update) / 1000
+	tokens = math.min(capacity, tokens + elapsed * rate)
+
+	local waiting = count_waiting(2)
+
+	local n = math.min(math.floor(tokens), waiting)
+	if max_active > 0 then
+		-- Admitted users who haven't started their session yet hold a slot too
+		local active = redis.call('ZCARD', KEYS[6]) + redis.call('ZCOUNT', KEYS[7], '(' .. now, '+inf')
+		n = math.min(n, max_active - active)
+	end
+
+	local admitted, count = {}, 0
+	if n > 0 then
+		local reserved = 0
+		if normal_share > 0 and redis.call('ZCARD', KEYS[2]) > 0 then
+			credit = credit + n * normal_share
+			reserved = math.floor(credit)
+		else
+			credit = 0
+		end
+
+		admitted, count = pop_lanes(2, n, reserved, KEYS[6], KEYS[9], KEYS[10], now)
+		credit = math.max(0, credit - math.min(reserved, n))
+		tokens = tokens - count
+		record_throughput(KEYS[8], now, count)
+	end
+
+	redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'last_update', now, 'normal_credit', tostring(credit))
+	table.insert(admitted, 1, waiting - count)
+	return admitted
+`
+
+// Admit consumes tokens from the queue's token bucket and admits up to that
+// many waiting users in priority order.
+func (s *RedisStorage) Admit(ctx context.Context, queueID string, params AdmissionParams, now time.Time) (*Admission, error) {
+	keys := append([]string{KeyAdmission(queueID)}, laneKeys(queueID)...)
+	keys = append(keys, KeyAdmitted(queueID), KeyActiveSessions(queueID), KeyThroughput(queueID), KeyLaneDepartures(queueID),
+		KeyLotteryArrivals(queueID))
+
+	res, err := s.client.Eval(ctx, admitScript, keys,
+		params.Capacity, params.Rate, params.MaxActive, now.UnixMilli(), params.NormalMinShare,
+	).Slice()
+	if err != nil {
+		return nil, err
+	}
+	return parseAdmission(res)
+}
@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAdmitTokenBucket(t *testing.T) {
+	s, _ := newTestStorage(t)
+	ctx := context.Background()
+	now := time.UnixMilli(1704067200000)
+	enqueue(t, s, "q", 0, now, "a", "b", "c", "d", "e")
+	params := AdmissionParams{Capacity: 2, Rate: 1}
+
+	// The bucket starts full
+	admission, err := s.Admit(ctx, "q", params, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := admittedIDs(admission); !equalIDs(got, []string{"a", "b"}) || admission.Waiting != 3 {
+		t.Fatalf("first round admitted %v with %d waiting, want [a b] with 3", got, admission.Waiting)
+	}
+
+	admission, err = s.Admit(ctx, "q", params, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(admission.Admitted) != 0 {
+		t.Fatalf("empty bucket admitted %v", admittedIDs(admission))
+	}
+
+	// One token is added per second, up to the capacity
+	admission, err = s.Admit(ctx, "q", params, now.Add(1500*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := admittedIDs(admission); !equalIDs(got, []string{"c"}) {
+		t.Fatalf("after 1.5s admitted %v, want [c]", got)
+	}
+	admission, err = s.Admit(ctx, "q", params, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := admittedIDs(admission); !equalIDs(got, []string{"d", "e"}) || admission.Waiting != 0 {
+		t.Fatalf("after an hour admitted %v with %d waiting, want [d e] with 0", got, admission.Waiting)
+	}
+}
+
+func TestAdmitMaxActive(t *testing.T) {
+	s, _ := newTestStorage(t)
+	ctx := context.Background()
+	now := time.UnixMilli(1704067200000)
+	enqueue(t, s, "q", 0, now, "a", "b", "c")
+	params := AdmissionParams{Capacity: 10, Rate: 10, MaxActive: 2}
+
+	admission, err := s.Admit(ctx, "q", params, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := admittedIDs(admission); !equalIDs(got, []string{"a", "b"}) {
+		t.Fatalf("admitted %v, want [a b]", got)
+	}
+
+	// Admitted users hold their slot until they leave
+	admission, err = s.Admit(ctx, "q", params, now.Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(admission.Admitted) != 0 {
+		t.Fatalf("admitted %v past max active", admittedIDs(admission))
+	}
+	if _, err := s.Remove(ctx, "q", "a"); err != nil {
+		t.Fatal(err)
+	}
+	admission, err = s.Admit(ctx, "q", params, now.Add(2*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := admittedIDs(admission); !equalIDs(got, []string{"c"}) {
+		t.Fatalf("admitted %v after a slot freed, want [c]", got)
+	}
+}
+
+func TestAdmitPriorityOrder(t *testing.T) {
+	s, _ := newTestStorage(t)
+	ctx := context.Background()
+	now := time.UnixMilli(1704067200000)
+	enqueue(t, s, "q", 0, now, "n1", "n2")
+	enqueue(t, s, "q", 3, now, "p1", "p2")
+	enqueue(t, s, "q", 1, now, "h1")
+
+	admission, err := s.Admit(ctx, "q", AdmissionParams{Capacity: 3, Rate: 1}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := admittedIDs(admission); !equalIDs(got, []string{"p1", "p2", "h1"}) {
+		t.Fatalf("admitted %v, want the highest lanes first", got)
+	}
+	for _, p := range admission.Admitted {
+		if want := map[string]int{"p1": 3, "p2": 3, "h1": 1}[p.PositionID]; p.Priority != want {
+			t.Errorf("%s admitted from lane %d, want %d", p.PositionID, p.Priority, want)
+		}
+	}
+}
+
+func TestAdmitNormalMinShare(t *testing.T) {
+	s, _ := newTestStorage(t)
+	ctx := context.Background()
+	now := time.UnixMilli(1704067200000)
+	enqueue(t, s, "q", 0, now, "n1", "n2")
+	enqueue(t, s, "q", 3, now, "p1", "p2", "p3", "p4")
+
+	// Half of each round is reserved for lane 0, which goes first
+	admission, err := s.Admit(ctx, "q", AdmissionParams{Capacity: 4, Rate: 1, NormalMinShare: 0.5}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := admittedIDs(admission); !equalIDs(got, []string{"n1", "n2", "p1", "p2"}) {
+		t.Fatalf("admitted %v, want [n1 n2 p1 p2]", got)
+	}
+}
+
+func TestThroughput(t *testing.T) {
+	s, server := newTestStorage(t)
+	ctx := context.Background()
+	now := time.Unix(1704067200, 0)
+	enqueue(t, s, "q", 0, now, "a", "b")
+
+	buckets, admitted, err := s.Throughput(ctx, "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 0 || admitted {
+		t.Fatalf("before admitting: %v, admitted %v", buckets, admitted)
+	}
+
+	if _, err := s.Admit(ctx, "q", AdmissionParams{Capacity: 2, Rate: 1}, now); err != nil {
+		t.Fatal(err)
+	}
+	buckets, admitted, err = s.Throughput(ctx, "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buckets[now.Unix()] != 2 || !admitted {
+		t.Fatalf("after admitting: %v, admitted %v", buckets, admitted)
+	}
+
+	// A stalled queue's window empties, but it is still known to have admitted
+	server.FastForward(ThroughputWindow)
+	buckets, admitted, err = s.Throughput(ctx, "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 0 || !admitted {
+		t.Fatalf("after stalling: %v, admitted %v", buckets, admitted)
+	}
+}
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// ChallengeWindow is the window solutions accepted for a queue are counted
+// over.
+const ChallengeWindow = time.Minute
+
+// KeySolutions counts the challenge solutions accepted for a queue in one
+// window, keyed by the window's start in Unix seconds.
+func KeySolutions(queueID string, windowStart int64) string {
+	return fmt.Sprintf("waiting_room:{%s}:solutions:%d", queueID, windowStart)
+}
+
+// KeyChallengeUsed marks a challenge whose solution has been accepted.
+func KeyChallengeUsed(queueID, challengeID string) string {
+	return fmt.Sprintf("waiting_room:{%s}:challenge_used:%s", queueID, challengeID)
+}
+
+// RecordSolution counts a challenge solution accepted for a queue at now.
+func (s *RedisStorage) RecordSolution(ctx context.Context, queueID string, now time.Time) error {
+	key := KeySolutions(queueID, windowStart(now))
+	pipe := s.client.Pipeline()
+	pipe.Incr(ctx, key)
+	pipe.Expire(ctx, key, 2*ChallengeWindow)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// SolutionRate returns how many challenge solutions were accepted for a queue
+// over the last ChallengeWindow before now, estimated from the current and
+// previous windows.
+func (s *RedisStorage) SolutionRate(ctx context.Context, queueID string, now time.Time) (float64, error) {
+	start := windowStart(now)
+	window := int64(ChallengeWindow / time.Second)
+	counts, err := s.client.MGet(ctx, KeySolutions(queueID, start), KeySolutions(queueID, start-window)).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	var current, prev int64
+	if count, ok := counts[0].(string); ok {
+		current, _ = strconv.ParseInt(count, 10, 64)
+	}
+	if count, ok := counts[1].(string); ok {
+		prev, _ = strconv.ParseInt(count, 10, 64)
+	}
+	elapsed := float64(now.UnixMilli()-start*1000) / float64(ChallengeWindow.Milliseconds())
+	return float64(prev)*(1-elapsed) + float64(current), nil
+}
+
+// windowStart returns the start of the ChallengeWindow holding t, in Unix
+// seconds.
+func windowStart(t time.Time) int64 {
+	window := int64(ChallengeWindow / time.Second)
+	return t.Unix() / window * window
+}
+
+// UseChallenge marks a challenge as used until ttl elapses. It reports false
+// if it already was.
+func (s *RedisStorage) UseChallenge(ctx context.Context, queueID, challengeID string, ttl time.Duration) (bool, error) {
+	return s.client.SetNX(ctx, KeyChallengeUsed(queueID, challengeID), 1, ttl).Result()
+}
+
+// ReleaseChallenge unmarks a used challenge, so its solution can be sent again.
+func (s *RedisStorage) ReleaseChallenge(ctx context.Context, queueID, challengeID string) error {
+	return s.client.Del(ctx, KeyChallengeUsed(queueID, challengeID)).Err()
+}
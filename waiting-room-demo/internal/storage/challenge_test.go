@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestUseChallenge(t *testing.T) {
+	s, server := newTestStorage(t)
+	ctx := context.Background()
+
+	for _, want := range []bool{true, false} {
+		used, err := s.UseChallenge(ctx, "q", "c1", time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if used != want {
+			t.Fatalf("UseChallenge = %v, want %v", used, want)
+		}
+	}
+
+	// A released challenge can be used again
+	if err := s.ReleaseChallenge(ctx, "q", "c1"); err != nil {
+		t.Fatal(err)
+	}
+	used, err := s.UseChallenge(ctx, "q", "c1", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !used {
+		t.Fatal("released challenge still marked used")
+	}
+
+	// Marks are only kept until the challenge expires
+	server.FastForward(time.Minute)
+	if server.Exists(KeyChallengeUsed("q", "c1")) {
+		t.Error("used mark outlived the challenge")
+	}
+}
+
+func TestSolutionRate(t *testing.T) {
+	s, _ := newTestStorage(t)
+	ctx := context.Background()
+	start := time.Unix(1704067200, 0)
+
+	for i := 0; i < 4; i++ {
+		if err := s.RecordSolution(ctx, "q", start.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.RecordSolution(ctx, "q", start.Add(ChallengeWindow)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A quarter into the next window, three quarters of the previous one
+	// still count
+	rate, err := s.SolutionRate(ctx, "q", start.Add(ChallengeWindow+ChallengeWindow/4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rate != 4 {
+		t.Fatalf("SolutionRate = %v, want 4", rate)
+	}
+
+	rate, err = s.SolutionRate(ctx, "other", start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rate != 0 {
+		t.Fatalf("SolutionRate of a queue without solutions = %v", rate)
+	}
+}
@@ -0,0 +1,256 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jawaracloud/waiting-room-demo/pkg/models"
+	"github.com/redis/go-redis/v9"
+)
+
+// KeyPreQueue holds the positions waiting for a queue's lottery draw, scored
+// by arrival time in microseconds.
+func KeyPreQueue(queueID string) string {
+	return fmt.Sprintf("waiting_room:{%s}:prequeue", queueID)
+}
+
+// KeyLottery holds the record of a queue's lottery draw.
+func KeyLottery(queueID string) string {
+	return fmt.Sprintf("waiting_room:{%s}:lottery", queueID)
+}
+
+// KeyLotteryOrder lists a queue's lottery cohort in drawn order.
+func KeyLotteryOrder(queueID string) string {
+	return fmt.Sprintf("waiting_room:{%s}:lottery:order", queueID)
+}
+
+// KeyLotteryStaging lists a cohort in the order one attempt at the draw
+// worked out, until the draw is claimed.
+func KeyLotteryStaging(queueID, attempt string) string {
+	return fmt.Sprintf("waiting_room:{%s}:lottery:staging:%s", queueID, attempt)
+}
+
+// KeyLotteryArrivals maps drawn positions to their arrival in the pre-queue
+// in microseconds, until they are admitted.
+func KeyLotteryArrivals(queueID string) string {
+	return fmt.Sprintf("waiting_room:{%s}:lottery:arrivals", queueID)
+}
+
+// lotteryBatchSize is how many positions one draw script handles, which
+// bounds both its arguments and how long it blocks the queue.
+const lotteryBatchSize = 1000
+
+// lotteryStagingTTL is how long a staged order outlives a replica that
+// crashed before claiming the draw.
+const lotteryStagingTTL = 10 * time.Minute
+
+// SealLotterySeed keeps seed secret for a queue's lottery draw, unless one is
+// sealed already, and returns the sealed seed. Once sealed, a seed is never
+// replaced, so the commitment published for it stays good until the draw.
+func (s *RedisStorage) SealLotterySeed(ctx context.Context, queueID, seed string) (string, error) {
+	script := `
+		redis.call('HSETNX', KEYS[1], 'sealed_seed', ARGV[1])
+		return redis.call('HGET', KEYS[1], 'sealed_seed')
+	`
+	return s.client.Eval(ctx, script, []string{KeyLottery(queueID)}, seed).Text()
+}
+
+// LotterySeed returns the seed sealed for a queue's lottery draw, empty if
+// none was.
+func (s *RedisStorage) LotterySeed(ctx context.Context, queueID string) (string, error) {
+	seed, err := s.client.HGet(ctx, KeyLottery(queueID), "sealed_seed").Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return seed, err
+}
+
+// LotteryState returns the state of a queue's lottery draw, empty until the
+// pre-queue closes.
+func (s *RedisStorage) LotteryState(ctx context.Context, queueID string) (string, error) {
+	state, err := s.client.HGet(ctx, KeyLottery(queueID), "state").Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return state, err
+}
+
+// ClosePreQueue stops new arrivals from joining a queue's pre-queue and
+// returns the cohort to draw. It returns false once the lottery was drawn.
+// Closing an already closed pre-queue returns the cohort again, so a draw
+// interrupted by a crash is simply redone.
+func (s *RedisStorage) ClosePreQueue(ctx context.Context, queueID string) ([]string, bool, error) {
+	script := `
+		local state = redis.call('HGET', KEYS[1], 'state')
+		if state == ARGV[2] then return false end
+		redis.call('HSET', KEYS[1], 'state', ARGV[1])
+		return redis.call('ZRANGE', KEYS[2], 0, -1)
+	`
+	res, err := s.client.Eval(ctx, script, []string{KeyLottery(queueID), KeyPreQueue(queueID)}, models.LotteryDrawing, models.LotteryDrawn).StringSlice()
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return res, true, nil
+}
+
+// claimLotteryScript records the draw whose order is staged in KEYS[3],
+// unless another one was claimed first. Either way it returns the claimed
+// seed, algorithm and draw time, or nil once the draw is done.
+const claimLotteryScript = `
+	if redis.call('HGET', KEYS[1], 'state') ~= ARGV[1] then return false end
+	if redis.call('HEXISTS', KEYS[1], 'seed') == 1 then
+		redis.call('DEL', KEYS[3])
+	else
+		if redis.call('EXISTS', KEYS[3]) == 1 then
+			redis.call('RENAME', KEYS[3], KEYS[2])
+		else
+			redis.call('DEL', KEYS[2])
+		end
+		redis.call('HSET', KEYS[1], 'seed', ARGV[2], 'algorithm', ARGV[3], 'drawn_at', ARGV[4], 'cohort_size', 0)
+	end
+	return redis.call('HMGET', KEYS[1], 'seed', 'algorithm', 'drawn_at')
+`
+
+// drawLotteryBatchScript moves the cohort members at ARGV[3] onwards in the
+// claimed order into their lanes, up to ARGV[4] of them. Scores count up to
+// just below the opening at ARGV[5] by place in the order, so concurrent or
+// repeated batches agree, and members that left the pre-queue are skipped.
+// It returns how many members it looked at, or -1 once the draw is done.
+const drawLotteryBatchScript = `
+	if redis.call('HGET', KEYS[1], 'state') ~= ARGV[1] or redis.call('HGET', KEYS[1], 'seed') ~= ARGV[2] then
+		return -1
+	end
+
+	local start = tonumber(ARGV[3])
+	local ids = redis.call('LRANGE', KEYS[2], start, start + tonumber(ARGV[4]) - 1)
+	local base = tonumber(ARGV[5]) - redis.call('LLEN', KEYS[2]) + start
+	local moved = 0
+	for i, id in ipairs(ids) do
+		local arrived = redis.call('ZSCORE', KEYS[3], id)
+		if arrived then
+			local priority = tonumber(redis.call('HGET', KEYS[4], id))
+			redis.call('ZADD', KEYS[5 + priority], base + i - 1, id)
+			redis.call('ZREM', KEYS[3], id)
+			redis.call('HSET', KEYS[9], id, arrived)
+			moved = moved + 1
+		end
+	end
+	redis.call('HINCRBY', KEYS[1], 'cohort_size', moved)
+	return #ids
+`
+
+// DrawLottery moves a queue's pre-queue into the lanes in the draw's order and
+// records the draw. The cohort is placed just ahead of the opening, so
+// everyone who arrives later queues behind it. Positions that left the
+// pre-queue since it was closed are skipped.
+//
+// The order is staged and the cohort moved in batches, so no one script
+// handles the whole cohort. Each call stages its order apart, as replicas
+// draw with the same sealed seed. If another replica claimed the draw first, or
+// crashed partway through it, draw takes on that draw's seed and this call
+// helps finish it. It returns the size of the drawn cohort, or -1 if the draw
+// was finished by another replica.
+func (s *RedisStorage) DrawLottery(ctx context.Context, draw *models.Lottery) (int64, error) {
+	queueID := draw.QueueID
+	attempt := make([]byte, 8)
+	if _, err := rand.Read(attempt); err != nil {
+		return 0, err
+	}
+	staging := KeyLotteryStaging(queueID, hex.EncodeToString(attempt))
+	for i := 0; i < len(draw.Order); i += lotteryBatchSize {
+		batch := draw.Order[i:min(i+lotteryBatchSize, len(draw.Order))]
+		ids := make([]interface{}, len(batch))
+		for j, id := range batch {
+			ids[j] = id
+		}
+		pipe := s.client.Pipeline()
+		pipe.RPush(ctx, staging, ids...)
+		pipe.Expire(ctx, staging, lotteryStagingTTL)
+		if _, err := pipe.Exec(ctx); err != nil {
+			return 0, err
+		}
+	}
+
+	claimed, err := s.client.Eval(ctx, claimLotteryScript,
+		[]string{KeyLottery(queueID), KeyLotteryOrder(queueID), staging},
+		models.LotteryDrawing, draw.Seed, draw.Algorithm, draw.DrawnAt.UnixMilli(),
+	).Slice()
+	if err == redis.Nil {
+		return -1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	draw.Seed, _ = claimed[0].(string)
+	draw.Algorithm, _ = claimed[1].(string)
+	if drawnAt, ok := claimed[2].(string); ok {
+		t := parseMillis(drawnAt)
+		draw.DrawnAt = &t
+	}
+
+	keys := append([]string{KeyLottery(queueID), KeyLotteryOrder(queueID), KeyPreQueue(queueID), KeyPositions(queueID)}, laneKeys(queueID)...)
+	keys = append(keys, KeyLotteryArrivals(queueID))
+	for start := int64(0); ; start += lotteryBatchSize {
+		n, err := s.client.Eval(ctx, drawLotteryBatchScript, keys,
+			models.LotteryDrawing, draw.Seed, start, lotteryBatchSize, draw.OpensAt.UnixMicro(),
+		).Int64()
+		if err != nil || n < 0 {
+			return n, err
+		}
+		if n < lotteryBatchSize {
+			break
+		}
+	}
+
+	script := `
+		if redis.call('HGET', KEYS[1], 'state') ~= ARGV[1] or redis.call('HGET', KEYS[1], 'seed') ~= ARGV[3] then
+			return -1
+		end
+		redis.call('HSET', KEYS[1], 'state', ARGV[2])
+		return tonumber(redis.call('HGET', KEYS[1], 'cohort_size'))
+	`
+	return s.client.Eval(ctx, script, []string{KeyLottery(queueID)}, models.LotteryDrawing, models.LotteryDrawn, draw.Seed).Int64()
+}
+
+// GetLottery returns the record of a queue's lottery draw with the cohort in
+// drawn order, or nil if the pre-queue hasn't closed. The sealed seed is only
+// given once the draw claims it, and OpensAt and SeedSHA256 are left for the
+// caller to fill in.
+func (s *RedisStorage) GetLottery(ctx context.Context, queueID string) (*models.Lottery, error) {
+	pipe := s.client.Pipeline()
+	fields := pipe.HGetAll(ctx, KeyLottery(queueID))
+	order := pipe.LRange(ctx, KeyLotteryOrder(queueID), 0, -1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	record := fields.Val()
+	if record["state"] == "" {
+		return nil, nil
+	}
+
+	lottery := &models.Lottery{
+		QueueID:   queueID,
+		State:     record["state"],
+		Seed:      record["seed"],
+		Algorithm: record["algorithm"],
+		Order:     order.Val(),
+	}
+	lottery.CohortSize, _ = strconv.ParseInt(record["cohort_size"], 10, 64)
+	if record["drawn_at"] != "" {
+		drawnAt := parseMillis(record["drawn_at"])
+		lottery.DrawnAt = &drawnAt
+	}
+	return lottery, nil
+}
+
+// PreQueueSize returns how many positions wait for a queue's lottery draw.
+func (s *RedisStorage) PreQueueSize(ctx context.Context, queueID string) (int64, error) {
+	return s.client.ZCard(ctx, KeyPreQueue(queueID)).Result()
+}
@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jawaracloud/waiting-room-demo/pkg/models"
+)
+
+// newLotteryQueue creates a lottery queue opening at opensAt and enqueues
+// positionIDs into its pre-queue a second apart from at, alternating between
+// lanes 0 and 1.
+func newLotteryQueue(t *testing.T, s *RedisStorage, opensAt, at time.Time, positionIDs ...string) {
+	t.Helper()
+	ctx := context.Background()
+	if _, err := s.CreateQueue(ctx, &models.Queue{ID: "q", Status: models.QueueActive, AdmissionRate: 10, OpensAt: &opensAt}); err != nil {
+		t.Fatal(err)
+	}
+	params := EnqueueParams{PreQueue: true, OpensAt: opensAt}
+	for i, id := range positionIDs {
+		res, err := s.Enqueue(ctx, "q", id, i%2, params, at.Add(time.Duration(i)*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !res.Added {
+			t.Fatalf("enqueue %s: not added", id)
+		}
+	}
+	lanes, err := s.GetLanes(ctx, "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lanes.PreQueue != int64(len(positionIDs)) {
+		t.Fatalf("pre-queue holds %d positions, want %d", lanes.PreQueue, len(positionIDs))
+	}
+}
+
+func TestDrawLottery(t *testing.T) {
+	s, _ := newTestStorage(t)
+	ctx := context.Background()
+	now := time.UnixMilli(1704067200000)
+	opensAt := now.Add(time.Hour)
+	newLotteryQueue(t, s, opensAt, now, "a", "b", "c", "gone")
+
+	cohort, open, err := s.ClosePreQueue(ctx, "q")
+	if err != nil || !open || len(cohort) != 4 {
+		t.Fatalf("ClosePreQueue = %v, %v, %v", cohort, open, err)
+	}
+	if _, err := s.Remove(ctx, "q", "gone"); err != nil {
+		t.Fatal(err)
+	}
+	// The pre-queue is closed, so this one queues behind the cohort
+	enqueue(t, s, "q", 1, opensAt, "after")
+
+	drawnAt := opensAt.Add(time.Second)
+	draw := &models.Lottery{QueueID: "q", OpensAt: opensAt, Seed: "seed", Algorithm: "test", DrawnAt: &drawnAt,
+		Order: []string{"c", "gone", "b", "a"}}
+	size, err := s.DrawLottery(ctx, draw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 3 {
+		t.Fatalf("DrawLottery = %d, want 3", size)
+	}
+
+	// Drawing again finds the draw done
+	again := *draw
+	again.Seed = "other"
+	if size, err := s.DrawLottery(ctx, &again); err != nil || size != -1 {
+		t.Fatalf("second DrawLottery = %d, %v", size, err)
+	}
+	if _, open, err := s.ClosePreQueue(ctx, "q"); err != nil || open {
+		t.Fatalf("ClosePreQueue after the draw = %v, %v", open, err)
+	}
+
+	lottery, err := s.GetLottery(ctx, "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lottery.State != models.LotteryDrawn || lottery.Seed != "seed" || lottery.CohortSize != 3 ||
+		!lottery.DrawnAt.Equal(drawnAt) || !equalIDs(lottery.Order, draw.Order) {
+		t.Fatalf("GetLottery = %+v", *lottery)
+	}
+
+	// Lane 1 first, the cohort in draw order ahead of later arrivals, and
+	// the wait counted from the arrival in the pre-queue
+	admission, err := s.AllowNext(ctx, "q", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalIDs(admittedIDs(admission), []string{"b", "after", "c", "a"}) {
+		t.Fatalf("admitted %v", admittedIDs(admission))
+	}
+	arrivals := map[string]time.Time{"a": now, "b": now.Add(time.Second), "c": now.Add(2 * time.Second), "after": opensAt}
+	for _, p := range admission.Admitted {
+		if !p.EnqueuedAt.Equal(arrivals[p.PositionID]) {
+			t.Errorf("%s enqueued at %v, want %v", p.PositionID, p.EnqueuedAt, arrivals[p.PositionID])
+		}
+	}
+}
+
+func TestSealLotterySeed(t *testing.T) {
+	s, _ := newTestStorage(t)
+	ctx := context.Background()
+
+	for _, seed := range []string{"first", "second"} {
+		sealed, err := s.SealLotterySeed(ctx, "q", seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sealed != "first" {
+			t.Fatalf("SealLotterySeed(%s) = %s, want the first seed", seed, sealed)
+		}
+	}
+	if seed, err := s.LotterySeed(ctx, "q"); err != nil || seed != "first" {
+		t.Fatalf("LotterySeed = %s, %v", seed, err)
+	}
+
+	// The sealed seed stays secret until the draw
+	if lottery, err := s.GetLottery(ctx, "q"); err != nil || lottery != nil {
+		t.Fatalf("GetLottery before the draw = %+v, %v", lottery, err)
+	}
+	if state, err := s.LotteryState(ctx, "q"); err != nil || state != "" {
+		t.Fatalf("LotteryState = %q, %v", state, err)
+	}
+}
+
+func TestDrawLotteryBatches(t *testing.T) {
+	s, server := newTestStorage(t)
+	ctx := context.Background()
+	now := time.UnixMilli(1704067200000)
+	opensAt := now.Add(time.Hour)
+	ids := make([]string, lotteryBatchSize+2)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("p%04d", i)
+	}
+	newLotteryQueue(t, s, opensAt, now, ids...)
+	cohort, _, err := s.ClosePreQueue(ctx, "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A replica claims a draw and crashes after its first batch
+	order := make([]string, len(cohort))
+	for i, id := range cohort {
+		order[len(order)-1-i] = id
+	}
+	if err := s.client.RPush(ctx, KeyLotteryStaging("q", "first"), order).Err(); err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{KeyLottery("q"), KeyLotteryOrder("q"), KeyLotteryStaging("q", "first")}
+	if err := s.client.Eval(ctx, claimLotteryScript, keys, models.LotteryDrawing, "first", "test", now.UnixMilli()).Err(); err != nil {
+		t.Fatal(err)
+	}
+	keys = append([]string{KeyLottery("q"), KeyLotteryOrder("q"), KeyPreQueue("q"), KeyPositions("q")}, laneKeys("q")...)
+	keys = append(keys, KeyLotteryArrivals("q"))
+	if err := s.client.Eval(ctx, drawLotteryBatchScript, keys, models.LotteryDrawing, "first", 0, 2, opensAt.UnixMicro()).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another one finishes it in the first draw's order
+	draw := &models.Lottery{QueueID: "q", OpensAt: opensAt, Seed: "second", Algorithm: "test", DrawnAt: &opensAt, Order: cohort}
+	size, err := s.DrawLottery(ctx, draw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(ids)) || draw.Seed != "first" || !draw.DrawnAt.Equal(now) {
+		t.Fatalf("DrawLottery = %d with seed %s at %v", size, draw.Seed, draw.DrawnAt)
+	}
+	lanes, err := s.GetLanes(ctx, "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lanes.PreQueue != 0 || lanes.Waiting[0]+lanes.Waiting[1] != int64(len(ids)) {
+		t.Fatalf("GetLanes = %+v", *lanes)
+	}
+	for _, key := range server.Keys() {
+		if strings.HasPrefix(key, KeyLotteryStaging("q", "")) {
+			t.Fatalf("staging list %s left behind", key)
+		}
+	}
+
+	admission, err := s.AllowNext(ctx, "q", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := ids[len(ids)-1]; !equalIDs(admittedIDs(admission), []string{want}) {
+		t.Fatalf("admitted %v, want %s first", admittedIDs(admission), want)
+	}
+}
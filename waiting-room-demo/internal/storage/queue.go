@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jawaracloud/waiting-room-demo/pkg/models"
+)
+
+// KeyQueueConfig holds a queue's configuration, see models.Queue.
+func KeyQueueConfig(queueID string) string {
+	return fmt.Sprintf("waiting_room:{%s}:config", queueID)
+}
+
+// CreateQueue stores a new queue's configuration and registers the queue. It
+// returns false if the queue is already configured.
+func (s *RedisStorage) CreateQueue(ctx context.Context, queue *models.Queue) (bool, error) {
+	script := `
+		if redis.call('EXISTS', KEYS[1]) == 1 then return 0 end
+		redis.call('HSET', KEYS[1], unpack(ARGV))
+		return 1
+	`
+	created, err := s.client.Eval(ctx, script, []string{KeyQueueConfig(queue.ID)}, queueFields(queue)...).Int64()
+	if err != nil || created == 0 {
+		return false, err
+	}
+
+	if err := s.client.SAdd(ctx, KeyQueues, queue.ID).Err(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// updateQueueScript writes the changed fields of a queue's configuration if
+// it is still at the revision they were worked out from, and bumps the
+// revision. Calling a lottery off releases its pre-queue into the lanes,
+// first come, first served.
+const updateQueueScript = `
+	if (tonumber(redis.call('HGET', KEYS[1], 'revision')) or 0) ~= tonumber(ARGV[1]) then
+		return 0
+	end
+	redis.call('HINCRBY', KEYS[1], 'revision', 1)
+	if #ARGV > 2 then
+		redis.call('HSET', KEYS[1], unpack(ARGV, 3))
+	end
+
+	if ARGV[2] == '1' then
+		local waiting = redis.call('ZRANGE', KEYS[2], 0, -1, 'WITHSCORES')
+		for i = 1, #waiting, 2 do
+			local priority = redis.call('HGET', KEYS[3], waiting[i])
+			if priority then
+				redis.call('ZADD', KEYS[4 + tonumber(priority)], waiting[i + 1], waiting[i])
+			end
+		end
+		redis.call('DEL', KEYS[2])
+	end
+	return 1
+`
+
+// UpdateQueue changes a queue's configuration from old to queue, writing only
+// the fields that differ. It returns false without writing anything if the
+// configuration was updated since old was read.
+func (s *RedisStorage) UpdateQueue(ctx context.Context, old, queue *models.Queue) (bool, error) {
+	release := 0
+	if old.OpensAt != nil && queue.OpensAt == nil {
+		release = 1
+	}
+	args := []interface{}{old.Revision, release}
+	before, after := queueFields(old), queueFields(queue)
+	for i := 0; i < len(after); i += 2 {
+		if fmt.Sprint(before[i+1]) != fmt.Sprint(after[i+1]) {
+			args = append(args, after[i], after[i+1])
+		}
+	}
+
+	keys := append([]string{KeyQueueConfig(queue.ID), KeyPreQueue(queue.ID), KeyPositions(queue.ID)}, laneKeys(queue.ID)...)
+	updated, err := s.client.Eval(ctx, updateQueueScript, keys, args...).Int64()
+	if err != nil {
+		return false, err
+	}
+	return updated == 1, nil
+}
+
+// GetQueue returns a queue's configuration, or nil if it has none.
+func (s *RedisStorage) GetQueue(ctx context.Context, queueID string) (*models.Queue, error) {
+	fields, err := s.client.HGetAll(ctx, KeyQueueConfig(queueID)).Result()
+	if err != nil || len(fields) == 0 {
+		return nil, err
+	}
+
+	integer := func(name string) int64 {
+		v, _ := strconv.ParseInt(fields[name], 10, 64)
+		return v
+	}
+	rate, _ := strconv.ParseFloat(fields["admission_rate"], 64)
+	var opensAt *time.Time
+	if integer("opens_at") > 0 {
+		t := parseMillis(fields["opens_at"])
+		opensAt = &t
+	}
+	page := &models.QueuePage{
+		Title:           fields["page_title"],
+		Message:         fields["page_message"],
+		LogoURL:         fields["page_logo_url"],
+		PrimaryColor:    fields["page_primary_color"],
+		BackgroundColor: fields["page_background_color"],
+		Locale:          fields["page_locale"],
+	}
+	if *page == (models.QueuePage{}) {
+		page = nil
+	}
+	return &models.Queue{
+		ID:                 queueID,
+		Name:               fields["name"],
+		Status:             fields["status"],
+		TargetURL:          fields["target_url"],
+		MaxActiveUsers:     integer("max_active_users"),
+		MaxQueueSize:       integer("max_queue_size"),
+		AdmissionRate:      rate,
+		SessionTimeout:     integer("session_timeout"),
+		HeartbeatInterval:  integer("heartbeat_interval"),
+		HeartbeatTimeout:   integer("heartbeat_timeout"),
+		ClientBinding:      fields["client_binding"],
+		IdentityPolicy:     fields["identity_policy"],
+		IdentityLimit:      integer("identity_limit"),
+		Challenge:          fields["challenge"],
+		MaintenanceMessage: fields["maintenance_message"],
+		OpensAt:            opensAt,
+		LotterySeedSHA256:  fields["lottery_seed_sha256"],
+		PreQueueWindow:     integer("prequeue_window"),
+		Page:               page,
+		CreatedAt:          parseMillis(fields["created_at"]),
+		UpdatedAt:          parseMillis(fields["updated_at"]),
+		Revision:           integer("revision"),
+	}, nil
+}
+
+func queueFields(queue *models.Queue) []interface{} {
+	var opensAt int64
+	if queue.OpensAt != nil {
+		opensAt = queue.OpensAt.UnixMilli()
+	}
+	var page models.QueuePage
+	if queue.Page != nil {
+		page = *queue.Page
+	}
+	return []interface{}{
+		"name", queue.Name,
+		"status", queue.Status,
+		"target_url", queue.TargetURL,
+		"max_active_users", queue.MaxActiveUsers,
+		"max_queue_size", queue.MaxQueueSize,
+		"admission_rate", strconv.FormatFloat(queue.AdmissionRate, 'f', -1, 64),
+		"session_timeout", queue.SessionTimeout,
+		"heartbeat_interval", queue.HeartbeatInterval,
+		"heartbeat_timeout", queue.HeartbeatTimeout,
+		"client_binding", queue.ClientBinding,
+		"identity_policy", queue.IdentityPolicy,
+		"identity_limit", queue.IdentityLimit,
+		"challenge", queue.Challenge,
+		"maintenance_message", queue.MaintenanceMessage,
+		"opens_at", opensAt,
+		"lottery_seed_sha256", queue.LotterySeedSHA256,
+		"prequeue_window", queue.PreQueueWindow,
+		"page_title", page.Title,
+		"page_message", page.Message,
+		"page_logo_url", page.LogoURL,
+		"page_primary_color", page.PrimaryColor,
+		"page_background_color", page.BackgroundColor,
+		"page_locale", page.Locale,
+		"created_at", queue.CreatedAt.UnixMilli(),
+		"updated_at", queue.UpdatedAt.UnixMilli(),
+	}
+}
@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/jawaracloud/waiting-room-demo/pkg/models"
+)
+
+func TestUpdateQueue(t *testing.T) {
+	s, _ := newTestStorage(t)
+	ctx := context.Background()
+	now := time.UnixMilli(1704067200000).UTC()
+	if _, err := s.CreateQueue(ctx, &models.Queue{ID: "q", Name: "Q", Status: models.QueueActive, AdmissionRate: 10, CreatedAt: now, UpdatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	old, err := s.GetQueue(ctx, "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renamed := *old
+	renamed.Name = "Renamed"
+	if ok, err := s.UpdateQueue(ctx, old, &renamed); err != nil || !ok {
+		t.Fatalf("UpdateQueue = %v, %v", ok, err)
+	}
+
+	// An update worked out from the same revision loses, rather than
+	// putting the old name back
+	paused := *old
+	paused.Status = models.QueuePaused
+	if ok, err := s.UpdateQueue(ctx, old, &paused); err != nil || ok {
+		t.Fatalf("stale UpdateQueue = %v, %v", ok, err)
+	}
+	current, err := s.GetQueue(ctx, "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Name != "Renamed" || current.Status != models.QueueActive || current.Revision != old.Revision+1 {
+		t.Fatalf("after a stale update: %+v", *current)
+	}
+
+	paused = *current
+	paused.Status = models.QueuePaused
+	if ok, err := s.UpdateQueue(ctx, current, &paused); err != nil || !ok {
+		t.Fatalf("UpdateQueue at the current revision = %v, %v", ok, err)
+	}
+	current, err = s.GetQueue(ctx, "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Name != "Renamed" || current.Status != models.QueuePaused {
+		t.Fatalf("after both updates: %+v", *current)
+	}
+}
+
+func TestUpdateQueueCallsLotteryOff(t *testing.T) {
+	s, _ := newTestStorage(t)
+	ctx := context.Background()
+	now := time.UnixMilli(1704067200000).UTC()
+	opensAt := now.Add(time.Hour)
+	if _, err := s.CreateQueue(ctx, &models.Queue{ID: "q", Status: models.QueueActive, AdmissionRate: 10, OpensAt: &opensAt}); err != nil {
+		t.Fatal(err)
+	}
+	params := EnqueueParams{PreQueue: true, OpensAt: opensAt}
+	for i, id := range []string{"early", "late"} {
+		if _, err := s.Enqueue(ctx, "q", id, 1-i, params, now.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	old, err := s.GetQueue(ctx, "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleared := *old
+	cleared.OpensAt = nil
+	if ok, err := s.UpdateQueue(ctx, old, &cleared); err != nil || !ok {
+		t.Fatalf("UpdateQueue = %v, %v", ok, err)
+	}
+
+	// An enqueue that read the configuration before the lottery was called
+	// off joins a lane too
+	if _, err := s.Enqueue(ctx, "q", "stale", 0, params, now.Add(2*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	for id, want := range map[string]PositionStatus{
+		"early": {Found: true, Priority: 1, Position: 1, LanePosition: 1, QueueLength: 3},
+		"late":  {Found: true, Priority: 0, Position: 2, LanePosition: 1, QueueLength: 3},
+		"stale": {Found: true, Priority: 0, Position: 3, LanePosition: 2, QueueLength: 3},
+	} {
+		status, err := s.PeekStatus(ctx, "q", id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *status != want {
+			t.Errorf("%s = %+v, want %+v", id, *status, want)
+		}
+	}
+}
+
+func TestPruneQueue(t *testing.T) {
+	s, _ := newTestStorage(t)
+	ctx := context.Background()
+	now := time.UnixMilli(1704067200000)
+	if _, err := s.CreateQueue(ctx, &models.Queue{ID: "configured", Status: models.QueueActive, AdmissionRate: 10}); err != nil {
+		t.Fatal(err)
+	}
+	enqueue(t, s, "implicit", 0, now, "a")
+	enqueue(t, s, "admitted", 0, now, "b")
+	if _, err := s.AllowNext(ctx, "admitted", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, queueID := range []string{"configured", "implicit", "admitted"} {
+		if pruned, err := s.PruneQueue(ctx, queueID); err != nil || pruned {
+			t.Fatalf("PruneQueue(%s) = %v, %v", queueID, pruned, err)
+		}
+	}
+
+	// Once its last position leaves, only the unconfigured queue goes
+	if _, err := s.Remove(ctx, "implicit", "a"); err != nil {
+		t.Fatal(err)
+	}
+	for queueID, want := range map[string]bool{"configured": false, "implicit": true} {
+		if pruned, err := s.PruneQueue(ctx, queueID); err != nil || pruned != want {
+			t.Fatalf("PruneQueue(%s) = %v, %v, want %v", queueID, pruned, err, want)
+		}
+	}
+	queues, err := s.Queues(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(queues)
+	if !equalIDs(queues, []string{"admitted", "configured"}) {
+		t.Fatalf("Queues = %v", queues)
+	}
+
+	// A later enqueue registers it again
+	enqueue(t, s, "implicit", 0, now, "b")
+	if queues, err = s.Queues(ctx); err != nil || len(queues) != 3 {
+		t.Fatalf("Queues = %v, %v", queues, err)
+	}
+}
@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// KeyRateLimit holds the sliding window of one rate limit for one client.
+func KeyRateLimit(name, identifier string) string {
+	return fmt.Sprintf("waiting_room:ratelimit:%s:%s", name, identifier)
+}
+
+// recordRequestScript keeps a sorted set of request timestamps in Unix
+// milliseconds, trimmed to the window. Rejected requests are not recorded,
+// so a client that keeps retrying is let back in as its window slides.
+const recordRequestScript = `
+	local now = tonumber(ARGV[1])
+	local window = tonumber(ARGV[2])
+	local limit = tonumber(ARGV[3])
+
+	redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+	local count = redis.call('ZCARD', KEYS[1])
+	local allowed = 0
+	if count < limit then
+		redis.call('ZADD', KEYS[1], now, ARGV[4])
+		count = count + 1
+		allowed = 1
+	end
+	redis.call('PEXPIRE', KEYS[1], window)
+
+	local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+	local reset = now + window
+	if #oldest > 0 then
+		reset = tonumber(oldest[2]) + window
+	end
+	return {allowed, count, reset}
+`
+
+// RecordRequest counts a request at now against the sliding window at key,
+// unless limit requests were already made within window. It returns whether
+// the request was allowed, how many requests the window now holds and when
+// the oldest of them leaves it.
+func (s *RedisStorage) RecordRequest(ctx context.Context, key string, limit int64, window time.Duration, now time.Time) (bool, int64, time.Time, error) {
+	res, err := s.client.Eval(ctx, recordRequestScript, []string{key},
+		now.UnixMilli(), window.Milliseconds(), limit, uuid.New().String(),
+	).Int64Slice()
+	if err != nil {
+		return false, 0, time.Time{}, err
+	}
+	if len(res) != 3 {
+		return false, 0, time.Time{}, fmt.Errorf("unexpected rate limit reply of length %d", len(res))
+	}
+	return res[0] == 1, res[1], time.UnixMilli(res[2]), nil
+}
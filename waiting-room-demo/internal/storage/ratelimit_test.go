@@ -0,0 +1,39 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRecordRequest(t *testing.T) {
+	s, _ := newTestStorage(t)
+	ctx := context.Background()
+	now := time.UnixMilli(1704067200000)
+	key := KeyRateLimit("status", "ip:192.0.2.1")
+
+	record := func(at time.Time) (bool, int64, time.Time) {
+		t.Helper()
+		allowed, count, reset, err := s.RecordRequest(ctx, key, 2, time.Minute, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return allowed, count, reset
+	}
+
+	for i, at := range []time.Time{now, now.Add(10 * time.Second)} {
+		if allowed, count, reset := record(at); !allowed || count != int64(i+1) || !reset.Equal(now.Add(time.Minute)) {
+			t.Fatalf("request %d: allowed %v, count %d, reset %v", i+1, allowed, count, reset)
+		}
+	}
+
+	// Rejected requests aren't recorded, so they don't push the reset back
+	if allowed, count, reset := record(now.Add(20 * time.Second)); allowed || count != 2 || !reset.Equal(now.Add(time.Minute)) {
+		t.Fatalf("request over the limit: allowed %v, count %d, reset %v", allowed, count, reset)
+	}
+
+	// Once the first request leaves the window, there is room for one more
+	if allowed, count, reset := record(now.Add(time.Minute + time.Millisecond)); !allowed || count != 2 || !reset.Equal(now.Add(70*time.Second)) {
+		t.Fatalf("request after the window slid: allowed %v, count %d, reset %v", allowed, count, reset)
+	}
+}
@@ -3,16 +3,120 @@ package storage
 import (
 	"context"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
-const (
-	KeyQueue     = "waiting_room:queue"
-	KeySessions  = "waiting_room:sessions"
-	KeyAllowedTS = "waiting_room:allowed_timestamp"
-)
+// NumLanes is the number of priority lanes; lane 0 is normal priority and
+// lane NumLanes-1 is admitted first.
+const NumLanes = 4
+
+// KeyQueues is the registry of every configured queue, and of every queue
+// that was never configured while it holds positions or sessions.
+const KeyQueues = "waiting_room:queues"
+
+// Per-queue keys use a {queue_id} hash tag so that all keys touched by a
+// single Lua script land in the same slot.
+func KeyLane(queueID string, priority int) string {
+	return fmt.Sprintf("waiting_room:{%s}:lane:%d", queueID, priority)
+}
+
+func KeyAdmitted(queueID string) string {
+	return fmt.Sprintf("waiting_room:{%s}:admitted", queueID)
+}
+
+// KeyLaneDepartures counts the positions ever admitted from each lane, so a
+// lane position read earlier can be moved on without reading it again.
+func KeyLaneDepartures(queueID string) string {
+	return fmt.Sprintf("waiting_room:{%s}:lane_departures", queueID)
+}
+
+func KeyPositions(queueID string) string {
+	return fmt.Sprintf("waiting_room:{%s}:positions", queueID)
+}
+
+// KeyHeartbeats indexes every position, waiting or admitted, by its last
+// heartbeat in Unix milliseconds.
+func KeyHeartbeats(queueID string) string {
+	return fmt.Sprintf("waiting_room:{%s}:heartbeats", queueID)
+}
+
+// KeyClient maps a client key to the position it last enqueued, so that the
+// client can resume it.
+func KeyClient(queueID, clientKey string) string {
+	return fmt.Sprintf("waiting_room:{%s}:client:%s", queueID, clientKey)
+}
+
+// KeyIdentity holds the positions an identity has enqueued under a queue's
+// identity policy.
+func KeyIdentity(queueID, policy, identityKey string) string {
+	return fmt.Sprintf("waiting_room:{%s}:identity:%s:%s", queueID, policy, identityKey)
+}
+
+// KeyIdentityStats counts enqueues from identities that already held a
+// position, in fields such as resumed:fingerprint and rejected:ip.
+func KeyIdentityStats(queueID string) string {
+	return fmt.Sprintf("waiting_room:{%s}:identity_stats", queueID)
+}
+
+// clientRetention is how long a client key or identity is remembered after
+// its last enqueue. Positions waiting longer than this can't be resumed, nor
+// do they count against an identity limit.
+const clientRetention = 24 * time.Hour
+
+// laneKeys returns the lane keys from lane 0 to the highest lane.
+func laneKeys(queueID string) []string {
+	keys := make([]string, NumLanes)
+	for i := range keys {
+		keys[i] = KeyLane(queueID, i)
+	}
+	return keys
+}
+
+// PositionStatus describes where a position currently stands.
+type PositionStatus struct {
+	Found        bool
+	Admitted     bool
+	PreQueue     bool // waiting for the lottery draw, with no position yet
+	Priority     int
+	Position     int64 // 1-based across all lanes, 0 once admitted
+	LanePosition int64 // 1-based within the position's lane, 0 once admitted
+	QueueLength  int64 // users still waiting across all lanes, or in the pre-queue
+	Departed     int64 // positions admitted from the lane so far, as of LanePosition
+}
+
+// EnqueueParams configures how a position joins a queue.
+type EnqueueParams struct {
+	MaxSize  int64     // users allowed to wait at once, 0 for unlimited
+	PreQueue bool      // join the lottery pre-queue, if it hasn't closed yet
+	OpensAt  time.Time // lottery opening; positions in the lanes never score earlier
+
+	// A client's earlier position is resumed instead of adding a new one if
+	// it was last seen at or after ResumeAfter. No ClientKey, no resuming.
+	ClientKey   string
+	ResumeAfter time.Time
+
+	// An identity already holding IdentityLimit live positions under the
+	// queue's identity policy is turned away, or given the one furthest along
+	// back with IdentityResume. No IdentityKey, no limit.
+	IdentityPolicy string
+	IdentityKey    string
+	IdentityLimit  int64
+	IdentityResume bool
+}
+
+// EnqueueResult is the outcome of an enqueue.
+type EnqueueResult struct {
+	Added       bool   // false if the queue was full
+	Resumed     bool   // an earlier position of the client was returned
+	Duplicate   bool   // the identity already held as many positions as allowed
+	PositionID  string // the position added or resumed
+	Priority    int    // its priority, which a resumed position keeps
+	QueueLength int64  // users waiting
+}
 
 type RedisStorage struct {
 	client *redis.Client
@@ -30,99 +134,371 @@ func NewRedisStorage(addr string) (*RedisStorage, error) {
 	return &RedisStorage{client: client}, nil
 }
 
-// Enqueue adds a user to the queue and returns the current queue size
-func (s *RedisStorage) Enqueue(ctx context.Context, queueID string, score int64) (int64, error) {
+// Enqueue adds a user to the lane for its priority, or to the lottery pre-queue.
+// When params.MaxSize is positive and the queue already holds that many, the
+// user isn't added; the check and the insert are atomic. A client whose
+// earlier position is still live gets that position back instead, whether or
+// not the queue is full, and so does an identity at its limit under an
+// identity policy that resumes; under other policies it isn't added.
+func (s *RedisStorage) Enqueue(ctx context.Context, queueID, positionID string, priority int, params EnqueueParams, enqueuedAt time.Time) (*EnqueueResult, error) {
 	script := `
-		redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1])
-		redis.call('HSET', KEYS[2], ARGV[1], ARGV[2])
-		return redis.call('ZCARD', KEYS[1])
+		local priority = tonumber(ARGV[2])
+		local max_size = tonumber(ARGV[5])
+
+		local total = redis.call('ZCARD', KEYS[7])
+		for i = 1, 4 do
+			total = total + redis.call('ZCARD', KEYS[i])
+		end
+
+		if ARGV[8] ~= '' then
+			local existing = redis.call('GET', KEYS[9])
+			local existing_priority = existing and redis.call('HGET', KEYS[5], existing)
+			local seen = existing and redis.call('ZSCORE', KEYS[6], existing)
+			if existing_priority and seen and tonumber(seen) >= tonumber(ARGV[9]) then
+				redis.call('ZADD', KEYS[6], ARGV[4], existing)
+				redis.call('PEXPIRE', KEYS[9], ARGV[10])
+				redis.call('HINCRBY', KEYS[11], 'resumed:client', 1)
+				return {2, total, existing, tonumber(existing_priority)}
+			end
+		end
+
+		if ARGV[11] ~= '' then
+			local live = {}
+			for _, id in ipairs(redis.call('SMEMBERS', KEYS[10])) do
+				if redis.call('HEXISTS', KEYS[5], id) == 1 then
+					live[#live + 1] = id
+				else
+					redis.call('SREM', KEYS[10], id)
+				end
+			end
+			if #live >= tonumber(ARGV[12]) then
+				if ARGV[13] == '1' then
+					-- The position furthest along is given back: admitted
+					-- ones first, then by lane from the highest, then by
+					-- place in the lane or pre-queue, then by ID
+					local function precedes(a, b)
+						for i = 1, #a do
+							if a[i] ~= b[i] then return a[i] < b[i] end
+						end
+						return false
+					end
+					local pick, pick_priority, pick_rank
+					for _, id in ipairs(live) do
+						local priority = tonumber(redis.call('HGET', KEYS[5], id))
+						local score = redis.call('ZSCORE', KEYS[priority + 1], id) or redis.call('ZSCORE', KEYS[7], id)
+						local rank = {score and 1 or 0, -priority, tonumber(score) or 0, id}
+						if not pick_rank or precedes(rank, pick_rank) then
+							pick, pick_priority, pick_rank = id, priority, rank
+						end
+					end
+					redis.call('ZADD', KEYS[6], ARGV[4], pick)
+					redis.call('PEXPIRE', KEYS[10], ARGV[10])
+					redis.call('HINCRBY', KEYS[11], 'resumed:' .. ARGV[14], 1)
+					return {2, total, pick, pick_priority}
+				end
+				redis.call('HINCRBY', KEYS[11], 'rejected:' .. ARGV[14], 1)
+				return {3, total}
+			end
+		end
+
+		if max_size > 0 and total >= max_size then
+			return {0, total}
+		end
+
+		-- The configuration is read again in case the lottery was called off
+		local lottery = ARGV[6] == '1' and (tonumber(redis.call('HGET', KEYS[12], 'opens_at')) or 0) > 0
+		if lottery and not redis.call('HGET', KEYS[8], 'state') then
+			redis.call('ZADD', KEYS[7], ARGV[3], ARGV[1])
+		elseif tonumber(ARGV[7]) > tonumber(ARGV[3]) then
+			redis.call('ZADD', KEYS[priority + 1], ARGV[7], ARGV[1])
+		else
+			redis.call('ZADD', KEYS[priority + 1], ARGV[3], ARGV[1])
+		end
+		redis.call('HSET', KEYS[5], ARGV[1], priority)
+		redis.call('ZADD', KEYS[6], ARGV[4], ARGV[1])
+		if ARGV[8] ~= '' then
+			redis.call('SET', KEYS[9], ARGV[1], 'PX', ARGV[10])
+		end
+		if ARGV[11] ~= '' then
+			redis.call('SADD', KEYS[10], ARGV[1])
+			redis.call('PEXPIRE', KEYS[10], ARGV[10])
+		end
+		return {1, total + 1}
 	`
-	res, err := s.client.Eval(ctx, script, []string{KeyQueue, KeySessions}, queueID, score).Int64()
+	keys := append(laneKeys(queueID), KeyPositions(queueID), KeyHeartbeats(queueID), KeyPreQueue(queueID), KeyLottery(queueID),
+		KeyClient(queueID, params.ClientKey), KeyIdentity(queueID, params.IdentityPolicy, params.IdentityKey), KeyIdentityStats(queueID),
+		KeyQueueConfig(queueID))
+	preQueue, opensAt, identityResume := 0, int64(0), 0
+	if params.PreQueue {
+		preQueue = 1
+	}
+	if params.IdentityResume {
+		identityResume = 1
+	}
+	if !params.OpensAt.IsZero() {
+		opensAt = params.OpensAt.UnixMicro()
+	}
+	// Lane scores are microseconds so that they stay exact as float64.
+	res, err := s.client.Eval(ctx, script, keys, positionID, priority, enqueuedAt.UnixMicro(), enqueuedAt.UnixMilli(),
+		params.MaxSize, preQueue, opensAt, params.ClientKey, params.ResumeAfter.UnixMilli(), clientRetention.Milliseconds(),
+		params.IdentityKey, params.IdentityLimit, identityResume, params.IdentityPolicy).Slice()
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	return res, nil
+
+	result := &EnqueueResult{PositionID: positionID, Priority: priority, QueueLength: res[1].(int64)}
+	switch res[0].(int64) {
+	case 0:
+		return result, nil
+	case 2:
+		result.Added, result.Resumed = true, true
+		result.PositionID, result.Priority = res[2].(string), int(res[3].(int64))
+		return result, nil
+	case 3:
+		result.Duplicate = true
+		return result, nil
+	}
+	result.Added = true
+
+	if err := s.client.SAdd(ctx, KeyQueues, queueID).Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
-// GetStatus checks if user is allowed or returns their position
-func (s *RedisStorage) GetStatus(ctx context.Context, queueID string, currentTime int64) (bool, int64, int64, error) {
+// IdentityStats returns how many enqueues from identities that already held a
+// position got it back and how many were turned away, by kind of identity.
+func (s *RedisStorage) IdentityStats(ctx context.Context, queueID string) (resumed, rejected map[string]int64, err error) {
+	fields, err := s.client.HGetAll(ctx, KeyIdentityStats(queueID)).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resumed, rejected = make(map[string]int64), make(map[string]int64)
+	for field, value := range fields {
+		count, _ := strconv.ParseInt(value, 10, 64)
+		if kind, ok := strings.CutPrefix(field, "resumed:"); ok {
+			resumed[kind] = count
+		} else if kind, ok := strings.CutPrefix(field, "rejected:"); ok {
+			rejected[kind] = count
+		}
+	}
+	return resumed, rejected, nil
+}
+
+// Queues returns the IDs of all known queues
+func (s *RedisStorage) Queues(ctx context.Context) ([]string, error) {
+	return s.client.SMembers(ctx, KeyQueues).Result()
+}
+
+// idleQueueScript reports whether a queue is unconfigured and holds no
+// positions or sessions. With ARGV[1] set, it also drops the admission
+// bookkeeping such a queue keeps between rounds.
+const idleQueueScript = `
+	if redis.call('EXISTS', KEYS[1]) == 1 or redis.call('HLEN', KEYS[2]) > 0 or redis.call('ZCARD', KEYS[3]) > 0
+		or redis.call('ZCARD', KEYS[4]) > 0 or redis.call('ZCARD', KEYS[5]) > 0 then
+		return 0
+	end
+	if ARGV[1] == '1' then
+		redis.call('DEL', KEYS[6], KEYS[7], KEYS[8])
+	end
+	return 1
+`
+
+// PruneQueue drops a queue that was never configured from the registry once
+// it holds no positions or sessions, and reports whether it did. The
+// registry lives apart from the queue's keys, so the queue is checked again
+// after it is dropped, and put back if a position was enqueued meanwhile.
+func (s *RedisStorage) PruneQueue(ctx context.Context, queueID string) (bool, error) {
+	keys := []string{
+		KeyQueueConfig(queueID), KeyPositions(queueID), KeyHeartbeats(queueID), KeyAdmitted(queueID), KeyActiveSessions(queueID),
+		KeyAdmission(queueID), KeyLaneDepartures(queueID), KeyIdentityStats(queueID),
+	}
+	idle, err := s.client.Eval(ctx, idleQueueScript, keys, 1).Int64()
+	if err != nil || idle == 0 {
+		return false, err
+	}
+	if err := s.client.SRem(ctx, KeyQueues, queueID).Err(); err != nil {
+		return false, err
+	}
+
+	idle, err = s.client.Eval(ctx, idleQueueScript, keys, 0).Int64()
+	if err != nil || idle == 0 {
+		// Keep the queue unless it is known to be idle
+		if addErr := s.client.SAdd(ctx, KeyQueues, queueID).Err(); addErr != nil {
+			return false, addErr
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// GetStatus refreshes the user's heartbeat and reports whether they are admitted or where they wait
+func (s *RedisStorage) GetStatus(ctx context.Context, queueID, positionID string, now time.Time) (*PositionStatus, error) {
+	return s.positionStatus(ctx, queueID, positionID, now.UnixMilli())
+}
+
+// PeekStatus reports where a position stands without counting as a heartbeat
+func (s *RedisStorage) PeekStatus(ctx context.Context, queueID, positionID string) (*PositionStatus, error) {
+	return s.positionStatus(ctx, queueID, positionID, 0)
+}
+
+// positionStatus looks a position up, refreshing its heartbeat to
+// lastSeenMillis unless that is 0
+func (s *RedisStorage) positionStatus(ctx context.Context, queueID, positionID string, lastSeenMillis int64) (*PositionStatus, error) {
 	script := `
-		local queue_id = ARGV[1]
-		local current_time = tonumber(ARGV[2])
-		local allowed_ts = tonumber(redis.call('GET', KEYS[1]) or 0)
-		local score = redis.call('ZSCORE', KEYS[2], queue_id)
+		local position_id = ARGV[1]
+		local priority = redis.call('HGET', KEYS[7], position_id)
+		if not priority then return {-1} end
+		priority = tonumber(priority)
+
+		if ARGV[2] ~= '0' then
+			redis.call('ZADD', KEYS[6], ARGV[2], position_id)
+		end
 
-		if not score then return {-1, 0} end
-		score = tonumber(score)
+		local total = 0
+		for i = 1, 4 do
+			total = total + redis.call('ZCARD', KEYS[i])
+		end
 
-		-- Update heartbeat in sessions hash
-		redis.call('HSET', KEYS[3], queue_id, current_time)
+		if redis.call('ZSCORE', KEYS[5], position_id) then
+			return {0, 0, priority, total} -- Admitted
+		end
 
-		local total = redis.call('ZCARD', KEYS[2])
-		if score <= allowed_ts then
-			return {0, total} -- Allowed
-		else
-			local rank = redis.call('ZRANK', KEYS[2], queue_id)
-			return {rank + 1, total} -- Position
+		local rank = redis.call('ZRANK', KEYS[priority + 1], position_id)
+		if not rank then
+			if redis.call('ZSCORE', KEYS[8], position_id) then
+				return {-2, 0, priority, redis.call('ZCARD', KEYS[8])} -- Waiting for the lottery
+			end
+			return {-1}
 		end
+
+		local ahead = 0
+		for i = priority + 2, 4 do
+			ahead = ahead + redis.call('ZCARD', KEYS[i])
+		end
+		local departed = tonumber(redis.call('HGET', KEYS[9], priority)) or 0
+		return {ahead + rank + 1, rank + 1, priority, total, departed}
 	`
-	res, err := s.client.Eval(ctx, script, []string{KeyAllowedTS, KeyQueue, KeySessions}, queueID, currentTime).Int64Slice()
+	keys := append(laneKeys(queueID), KeyAdmitted(queueID), KeyHeartbeats(queueID), KeyPositions(queueID), KeyPreQueue(queueID),
+		KeyLaneDepartures(queueID))
+	res, err := s.client.Eval(ctx, script, keys, positionID, lastSeenMillis).Int64Slice()
 	if err != nil {
-		return false, 0, 0, err
+		return nil, err
 	}
 
-	if res[0] == -1 {
-		return false, -1, 0, nil
+	switch res[0] {
+	case -1:
+		return &PositionStatus{}, nil
+	case -2:
+		return &PositionStatus{Found: true, PreQueue: true, Priority: int(res[2]), QueueLength: res[3]}, nil
+	}
+	status := &PositionStatus{
+		Found:        true,
+		Admitted:     res[0] == 0,
+		Position:     res[0],
+		LanePosition: res[1],
+		Priority:     int(res[2]),
+		QueueLength:  res[3],
 	}
-	if res[0] == 0 {
-		return true, 0, res[1], nil
+	if len(res) > 4 {
+		status.Departed = res[4]
 	}
-	return false, res[0], res[1], nil
+	return status, nil
 }
 
-// AllowNext increments the allowed timestamp to the score of the Nth user
-func (s *RedisStorage) AllowNext(ctx context.Context, n int64) (int64, error) {
-	// Get the score of the Nth user in the queue
-	vals, err := s.client.ZRangeWithScores(ctx, KeyQueue, n-1, n-1).Result()
-	if err != nil || len(vals) == 0 {
-		return 0, err
-	}
+// Lanes is a snapshot of a queue's lanes.
+type Lanes struct {
+	Waiting  [NumLanes]int64 // positions in each lane
+	Departed [NumLanes]int64 // positions admitted from each lane so far
+	PreQueue int64           // positions waiting for the lottery draw
+}
 
-	newAllowedTS := int64(vals[0].Score)
-	err = s.client.Set(ctx, KeyAllowedTS, newAllowedTS, 0).Err()
+// GetLanes reads a queue's lane lengths and departure counts in one
+// transaction, so they agree with each other.
+func (s *RedisStorage) GetLanes(ctx context.Context, queueID string) (*Lanes, error) {
+	var waiting [NumLanes]*redis.IntCmd
+	var departed *redis.SliceCmd
+	var prequeue *redis.IntCmd
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range laneKeys(queueID) {
+			waiting[i] = pipe.ZCard(ctx, key)
+		}
+		departed = pipe.HMGet(ctx, KeyLaneDepartures(queueID), "0", "1", "2", "3")
+		prequeue = pipe.ZCard(ctx, KeyPreQueue(queueID))
+		return nil
+	})
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	return newAllowedTS, nil
+	lanes := &Lanes{PreQueue: prequeue.Val()}
+	for i := range waiting {
+		lanes.Waiting[i] = waiting[i].Val()
+		if count, ok := departed.Val()[i].(string); ok {
+			lanes.Departed[i], _ = strconv.ParseInt(count, 10, 64)
+		}
+	}
+	return lanes, nil
 }
 
-// CleanupStaleSessions removes users who haven't heartbeated for more than the timeout
-func (s *RedisStorage) CleanupStaleSessions(ctx context.Context, timeoutSeconds int64) (int64, error) {
-	// This is a bit complex for a single Lua script if the set is huge.
-	// We'll do it in Go for now or a multi-step Lua.
-	// For the demo, let's keep it simple.
-
-	now := time.Now().UnixNano()
-	timeoutNano := timeoutSeconds * 1e9
-	threshold := now - timeoutNano
-
-	// Get all sessions
-	sessions, err := s.client.HGetAll(ctx, KeySessions).Result()
+// AllowNext admits the next n waiting users in priority order, bypassing the
+// admission token bucket
+func (s *RedisStorage) AllowNext(ctx context.Context, queueID string, n int64) (*Admission, error) {
+	script := popLanesLua + throughputLua + `
+		local admitted, count = pop_lanes(1, tonumber(ARGV[1]), 0, KEYS[5], KEYS[7], KEYS[8], ARGV[2])
+		record_throughput(KEYS[6], tonumber(ARGV[2]), count)
+		table.insert(admitted, 1, count_waiting(1))
+		return admitted
+	`
+	keys := append(laneKeys(queueID), KeyAdmitted(queueID), KeyThroughput(queueID), KeyLaneDepartures(queueID), KeyLotteryArrivals(queueID))
+	res, err := s.client.Eval(ctx, script, keys, n, time.Now().UnixMilli()).Slice()
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
+	return parseAdmission(res)
+}
 
-	removed := int64(0)
-	for queueID, lastSeenStr := range sessions {
-		var lastSeen int64
-		fmt.Sscanf(lastSeenStr, "%d", &lastSeen)
-		if lastSeen < threshold {
-			s.client.ZRem(ctx, KeyQueue, queueID)
-			s.client.HDel(ctx, KeySessions, queueID)
-			removed++
-		}
+// Remove deletes a position, waiting or admitted, and reports whether it existed
+func (s *RedisStorage) Remove(ctx context.Context, queueID, positionID string) (bool, error) {
+	script := `
+		local existed = redis.call('HDEL', KEYS[6], ARGV[1])
+		for i = 1, 5 do
+			redis.call('ZREM', KEYS[i], ARGV[1])
+		end
+		redis.call('ZREM', KEYS[7], ARGV[1])
+		redis.call('ZREM', KEYS[8], ARGV[1])
+		redis.call('HDEL', KEYS[9], ARGV[1])
+		return existed
+	`
+	keys := append(laneKeys(queueID), KeyAdmitted(queueID), KeyPositions(queueID), KeyHeartbeats(queueID), KeyPreQueue(queueID),
+		KeyLotteryArrivals(queueID))
+	res, err := s.client.Eval(ctx, script, keys, positionID).Int64()
+	if err != nil {
+		return false, err
 	}
+	return res == 1, nil
+}
+
+// ExpirePositions removes up to limit positions, waiting or admitted, whose
+// last heartbeat is older than cutoff and returns their IDs. Selection and
+// removal happen in one script, so a heartbeat arriving mid-sweep either
+// keeps its position or finds it already gone.
+func (s *RedisStorage) ExpirePositions(ctx context.Context, queueID string, cutoff time.Time, limit int64) ([]string, error) {
+	script := `
+		local expired = redis.call('ZRANGEBYSCORE', KEYS[7], '-inf', '(' .. ARGV[1], 'LIMIT', 0, ARGV[2])
+		if #expired == 0 then return expired end
 
-	return removed, nil
+		for i = 1, 5 do
+			redis.call('ZREM', KEYS[i], unpack(expired))
+		end
+		redis.call('HDEL', KEYS[6], unpack(expired))
+		redis.call('ZREM', KEYS[7], unpack(expired))
+		redis.call('ZREM', KEYS[8], unpack(expired))
+		redis.call('HDEL', KEYS[9], unpack(expired))
+		return expired
+	`
+	keys := append(laneKeys(queueID), KeyAdmitted(queueID), KeyPositions(queueID), KeyHeartbeats(queueID), KeyPreQueue(queueID),
+		KeyLotteryArrivals(queueID))
+	return s.client.Eval(ctx, script, keys, cutoff.UnixMilli(), limit).StringSlice()
 }
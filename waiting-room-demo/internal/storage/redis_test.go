@@ -0,0 +1,407 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/jawaracloud/waiting-room-demo/pkg/models"
+)
+
+// newTestStorage returns a RedisStorage backed by an in-memory server, which
+// runs the Lua scripts as DragonFlyDB would.
+func newTestStorage(t *testing.T) (*RedisStorage, *miniredis.Miniredis) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	s, err := NewRedisStorage(server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.client.Close() })
+	return s, server
+}
+
+// enqueue adds positions to a queue's lane for priority, a microsecond apart
+// from at, and fails the test on error.
+func enqueue(t *testing.T, s *RedisStorage, queueID string, priority int, at time.Time, positionIDs ...string) {
+	t.Helper()
+	for i, id := range positionIDs {
+		res, err := s.Enqueue(context.Background(), queueID, id, priority, EnqueueParams{}, at.Add(time.Duration(i)*time.Microsecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !res.Added {
+			t.Fatalf("enqueue %s: not added", id)
+		}
+	}
+}
+
+func admittedIDs(admission *Admission) []string {
+	ids := make([]string, len(admission.Admitted))
+	for i, p := range admission.Admitted {
+		ids[i] = p.PositionID
+	}
+	return ids
+}
+
+func equalIDs(got, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPositionStatus(t *testing.T) {
+	s, _ := newTestStorage(t)
+	ctx := context.Background()
+	now := time.UnixMilli(1704067200000)
+	enqueue(t, s, "q", 0, now, "n1", "n2")
+	enqueue(t, s, "q", 2, now, "h1")
+
+	status, err := s.GetStatus(ctx, "q", "n2", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := PositionStatus{Found: true, Priority: 0, Position: 3, LanePosition: 2, QueueLength: 3}
+	if *status != want {
+		t.Fatalf("GetStatus = %+v, want %+v", *status, want)
+	}
+
+	if _, err := s.AllowNext(ctx, "q", 1); err != nil {
+		t.Fatal(err)
+	}
+	status, err = s.PeekStatus(ctx, "q", "h1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Found || !status.Admitted {
+		t.Fatalf("PeekStatus after admission = %+v", *status)
+	}
+
+	status, err = s.PeekStatus(ctx, "q", "missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Found {
+		t.Fatalf("PeekStatus of an unknown position = %+v", *status)
+	}
+}
+
+func TestExpirePositions(t *testing.T) {
+	s, _ := newTestStorage(t)
+	ctx := context.Background()
+	now := time.UnixMilli(1704067200000)
+	enqueue(t, s, "q", 0, now, "stale", "fresh", "peeked")
+	enqueue(t, s, "q", 1, now, "admitted")
+	if _, err := s.AllowNext(ctx, "q", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// A status request counts as a heartbeat, a peek does not
+	if _, err := s.GetStatus(ctx, "q", "fresh", now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.PeekStatus(ctx, "q", "peeked"); err != nil {
+		t.Fatal(err)
+	}
+
+	expired, err := s.ExpirePositions(ctx, "q", now.Add(30*time.Second), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(expired)
+	if !equalIDs(expired, []string{"admitted", "peeked", "stale"}) {
+		t.Fatalf("expired %v, want admitted, peeked and stale", expired)
+	}
+	for _, id := range []string{"stale", "peeked", "admitted"} {
+		status, err := s.PeekStatus(ctx, "q", id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Found {
+			t.Errorf("%s still found after expiry", id)
+		}
+	}
+	status, err := s.PeekStatus(ctx, "q", "fresh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (PositionStatus{Found: true, Position: 1, LanePosition: 1, QueueLength: 1}); *status != want {
+		t.Fatalf("fresh position = %+v, want %+v", *status, want)
+	}
+}
+
+func TestExpirePositionsLimit(t *testing.T) {
+	s, _ := newTestStorage(t)
+	ctx := context.Background()
+	now := time.UnixMilli(1704067200000)
+	enqueue(t, s, "q", 0, now, "a", "b", "c")
+
+	cutoff := now.Add(time.Minute)
+	expired, err := s.ExpirePositions(ctx, "q", cutoff, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 2 {
+		t.Fatalf("first batch expired %v, want 2 positions", expired)
+	}
+	expired, err = s.ExpirePositions(ctx, "q", cutoff, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 1 {
+		t.Fatalf("second batch expired %v, want the last position", expired)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	s, _ := newTestStorage(t)
+	ctx := context.Background()
+	now := time.UnixMilli(1704067200000)
+	enqueue(t, s, "q", 0, now, "a")
+
+	for _, want := range []bool{true, false} {
+		existed, err := s.Remove(ctx, "q", "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if existed != want {
+			t.Fatalf("Remove = %v, want %v", existed, want)
+		}
+	}
+	expired, err := s.ExpirePositions(ctx, "q", now.Add(time.Hour), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 0 {
+		t.Fatalf("removed position left a heartbeat: expired %v", expired)
+	}
+}
+
+func TestLaneDepartures(t *testing.T) {
+	s, _ := newTestStorage(t)
+	ctx := context.Background()
+	now := time.UnixMilli(1704067200000)
+	enqueue(t, s, "q", 0, now, "n1", "n2", "n3")
+	enqueue(t, s, "q", 1, now, "h1")
+
+	before, err := s.PeekStatus(ctx, "q", "n3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AllowNext(ctx, "q", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	lanes, err := s.GetLanes(ctx, "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Lanes{Waiting: [NumLanes]int64{2}, Departed: [NumLanes]int64{1, 1}}
+	if *lanes != want {
+		t.Fatalf("GetLanes = %+v, want %+v", *lanes, want)
+	}
+
+	// The lane position read before, moved on by the departures since, is
+	// the one read now
+	after, err := s.PeekStatus(ctx, "q", "n3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved := before.LanePosition - (lanes.Departed[0] - before.Departed); moved != after.LanePosition || after.Departed != 1 {
+		t.Fatalf("lane position %d moved on to %d, read %+v", before.LanePosition, moved, *after)
+	}
+}
+
+func TestEnqueueMaxSize(t *testing.T) {
+	s, _ := newTestStorage(t)
+	ctx := context.Background()
+	now := time.UnixMilli(1704067200000)
+	params := EnqueueParams{MaxSize: 2}
+
+	for i, id := range []string{"a", "b", "c"} {
+		res, err := s.Enqueue(ctx, "q", id, i%2, params, now.Add(time.Duration(i)*time.Microsecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wantAdded := i < 2; res.Added != wantAdded || res.QueueLength != int64(min(i+1, 2)) {
+			t.Fatalf("enqueue %s = %+v, want added %v", id, *res, wantAdded)
+		}
+	}
+
+	// Admitted users no longer count against the limit
+	if _, err := s.AllowNext(ctx, "q", 1); err != nil {
+		t.Fatal(err)
+	}
+	res, err := s.Enqueue(ctx, "q", "c", 0, params, now.Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Added || res.QueueLength != 2 {
+		t.Fatalf("enqueue after an admission = %+v", *res)
+	}
+}
+
+func TestEnqueueResume(t *testing.T) {
+	s, _ := newTestStorage(t)
+	ctx := context.Background()
+	now := time.UnixMilli(1704067200000)
+	params := func(clientKey string, at time.Time) EnqueueParams {
+		return EnqueueParams{MaxSize: 1, ClientKey: clientKey, ResumeAfter: at.Add(-time.Minute)}
+	}
+
+	if _, err := s.Enqueue(ctx, "q", "first", 1, params("client", now), now); err != nil {
+		t.Fatal(err)
+	}
+
+	// The client gets its position and priority back, full queue or not
+	at := now.Add(30 * time.Second)
+	res, err := s.Enqueue(ctx, "q", "second", 0, params("client", at), at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := EnqueueResult{Added: true, Resumed: true, PositionID: "first", Priority: 1, QueueLength: 1}
+	if *res != want {
+		t.Fatalf("enqueue again = %+v, want %+v", *res, want)
+	}
+	res, err = s.Enqueue(ctx, "q", "other", 0, params("other", at), at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Added {
+		t.Fatalf("another client resumed or joined a full queue: %+v", *res)
+	}
+
+	// Resuming counts as a heartbeat
+	expired, err := s.ExpirePositions(ctx, "q", now.Add(time.Second), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 0 {
+		t.Fatalf("resumed position expired: %v", expired)
+	}
+
+	// A position that left isn't resumed
+	if _, err := s.Remove(ctx, "q", "first"); err != nil {
+		t.Fatal(err)
+	}
+	res, err = s.Enqueue(ctx, "q", "third", 0, params("client", at), at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (EnqueueResult{Added: true, PositionID: "third", QueueLength: 1}); *res != want {
+		t.Fatalf("enqueue after leaving = %+v, want %+v", *res, want)
+	}
+
+	// Nor is one last seen before the grace period, so the client is turned
+	// away from the full queue
+	at = at.Add(2 * time.Minute)
+	res, err = s.Enqueue(ctx, "q", "fourth", 0, params("client", at), at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Added || res.Resumed {
+		t.Fatalf("enqueue after the grace period = %+v", *res)
+	}
+}
+
+func TestEnqueueIdentity(t *testing.T) {
+	s, _ := newTestStorage(t)
+	ctx := context.Background()
+	now := time.UnixMilli(1704067200000)
+	byIP := EnqueueParams{IdentityPolicy: models.IdentityIP, IdentityKey: "ip-hash", IdentityLimit: 2}
+
+	for i, id := range []string{"a", "b", "c"} {
+		res, err := s.Enqueue(ctx, "q", id, 0, byIP, now.Add(time.Duration(i)*time.Microsecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wantDuplicate := i == 2; res.Duplicate != wantDuplicate || res.Added == wantDuplicate {
+			t.Fatalf("enqueue %s = %+v, want duplicate %v", id, *res, wantDuplicate)
+		}
+	}
+
+	// A position that left frees its place under the limit
+	if _, err := s.Remove(ctx, "q", "a"); err != nil {
+		t.Fatal(err)
+	}
+	res, err := s.Enqueue(ctx, "q", "e", 0, byIP, now.Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Added || res.Duplicate {
+		t.Fatalf("enqueue after a position left = %+v", *res)
+	}
+
+	// Under the fingerprint policy the identity gets its position back
+	byFingerprint := EnqueueParams{IdentityPolicy: models.IdentityFingerprint, IdentityKey: "fp-hash", IdentityLimit: 1, IdentityResume: true}
+	enqueue(t, s, "q", 2, now, "d")
+	if _, err := s.Enqueue(ctx, "q", "held", 3, byFingerprint, now); err != nil {
+		t.Fatal(err)
+	}
+	res, err = s.Enqueue(ctx, "q", "again", 0, byFingerprint, now.Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := EnqueueResult{Added: true, Resumed: true, PositionID: "held", Priority: 3, QueueLength: 4}
+	if *res != want {
+		t.Fatalf("enqueue again = %+v, want %+v", *res, want)
+	}
+
+	resumed, rejected, err := s.IdentityStats(ctx, "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resumed) != 1 || resumed[models.IdentityFingerprint] != 1 || len(rejected) != 1 || rejected[models.IdentityIP] != 1 {
+		t.Fatalf("IdentityStats = %v, %v", resumed, rejected)
+	}
+}
+
+func TestEnqueueIdentityResumeOrder(t *testing.T) {
+	s, _ := newTestStorage(t)
+	ctx := context.Background()
+	now := time.UnixMilli(1704067200000)
+	params := EnqueueParams{IdentityPolicy: models.IdentityIP, IdentityKey: "ip-hash", IdentityLimit: 3, IdentityResume: true}
+
+	add := func(id string, priority int, at time.Time) {
+		t.Helper()
+		res, err := s.Enqueue(ctx, "q", id, priority, params, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !res.Added || res.Resumed {
+			t.Fatalf("enqueue %s = %+v", id, *res)
+		}
+	}
+	add("z", 0, now)
+	add("x", 0, now.Add(time.Microsecond))
+	if _, err := s.AllowNext(ctx, "q", 1); err != nil {
+		t.Fatal(err)
+	}
+	add("y", 3, now.Add(2*time.Microsecond))
+
+	// The admitted position comes first, then the highest lane, then the
+	// earliest in the lane, whatever order the identity set holds them in
+	for _, want := range []string{"z", "y", "x"} {
+		for range 3 {
+			res, err := s.Enqueue(ctx, "q", "again", 0, params, now.Add(time.Second))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !res.Resumed || res.PositionID != want {
+				t.Fatalf("enqueue again = %+v, want %s resumed", *res, want)
+			}
+		}
+		if _, err := s.Remove(ctx, "q", want); err != nil {
+			t.Fatal(err)
+		}
+		add("w"+want, 0, now.Add(time.Minute))
+	}
+}
@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// KeyRevoked marks a revoked token by its jti, or every token of a position or
+// session by its ID. Token IDs are UUIDs, so the key is global rather than
+// per queue.
+func KeyRevoked(tokenID string) string {
+	return fmt.Sprintf("waiting_room:revoked:%s", tokenID)
+}
+
+// KeyRetired marks a token that has been refreshed, holding the time in Unix
+// milliseconds from which it no longer works.
+func KeyRetired(tokenID string) string {
+	return fmt.Sprintf("waiting_room:retired:%s", tokenID)
+}
+
+// RevokeToken records a revoked token ID with the reason, until ttl elapses
+func (s *RedisStorage) RevokeToken(ctx context.Context, tokenID, reason string, ttl time.Duration) error {
+	return s.client.Set(ctx, KeyRevoked(tokenID), reason, ttl).Err()
+}
+
+// RetireToken marks a token as replaced, to be treated as revoked once grace
+// has passed. The mark is kept until ttl elapses. It reports false if the
+// token had already been retired.
+func (s *RedisStorage) RetireToken(ctx context.Context, tokenID string, grace, ttl time.Duration) (bool, error) {
+	return s.client.SetNX(ctx, KeyRetired(tokenID), time.Now().Add(grace).UnixMilli(), ttl).Result()
+}
+
+// IsTokenRevoked reports whether a token ID, or the position or session ID it
+// was issued for, has been revoked, or the token was retired and its grace
+// period is over
+func (s *RedisStorage) IsTokenRevoked(ctx context.Context, tokenID, ownerID string) (bool, error) {
+	pipe := s.client.Pipeline()
+	revoked := pipe.Exists(ctx, KeyRevoked(tokenID), KeyRevoked(ownerID))
+	retired := pipe.Get(ctx, KeyRetired(tokenID))
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return false, err
+	}
+	if revoked.Val() > 0 {
+		return true, nil
+	}
+	revokeAt, err := retired.Int64()
+	return err == nil && time.Now().UnixMilli() >= revokeAt, nil
+}
@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRevokeToken(t *testing.T) {
+	s, server := newTestStorage(t)
+	ctx := context.Background()
+
+	if err := s.RevokeToken(ctx, "jti-1", "abuse", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RevokeToken(ctx, "position-2", "abuse", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		tokenID, ownerID string
+		want             bool
+	}{
+		{"jti-1", "position-1", true},  // the token itself
+		{"jti-2", "position-2", true},  // every token of the position
+		{"jti-3", "position-3", false}, // neither
+	} {
+		revoked, err := s.IsTokenRevoked(ctx, tc.tokenID, tc.ownerID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if revoked != tc.want {
+			t.Errorf("IsTokenRevoked(%s, %s) = %v, want %v", tc.tokenID, tc.ownerID, revoked, tc.want)
+		}
+	}
+
+	// Revocations are only kept as long as the tokens could be used
+	server.FastForward(time.Minute)
+	revoked, err := s.IsTokenRevoked(ctx, "jti-1", "position-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revoked {
+		t.Error("revocation outlived its TTL")
+	}
+}
+
+func TestRetireToken(t *testing.T) {
+	s, _ := newTestStorage(t)
+	ctx := context.Background()
+
+	retired, err := s.RetireToken(ctx, "jti-1", time.Hour, 2*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !retired {
+		t.Fatal("first retirement reported as a repeat")
+	}
+	retired, err = s.RetireToken(ctx, "jti-1", time.Hour, 2*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retired {
+		t.Error("token retired twice")
+	}
+
+	// A retired token keeps working through its grace period
+	revoked, err := s.IsTokenRevoked(ctx, "jti-1", "position-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revoked {
+		t.Error("retired token revoked within its grace period")
+	}
+
+	if _, err := s.RetireToken(ctx, "jti-2", 0, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	revoked, err = s.IsTokenRevoked(ctx, "jti-2", "position-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !revoked {
+		t.Error("retired token still works after its grace period")
+	}
+}
@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jawaracloud/waiting-room-demo/pkg/models"
+	"github.com/redis/go-redis/v9"
+)
+
+// KeyActiveSessions indexes the queue's live sessions, scored by expiry in
+// Unix milliseconds.
+func KeyActiveSessions(queueID string) string {
+	return fmt.Sprintf("waiting_room:{%s}:active_sessions", queueID)
+}
+
+func KeySession(queueID, sessionID string) string {
+	return fmt.Sprintf("waiting_room:{%s}:session:%s", queueID, sessionID)
+}
+
+// sessionRetention is how long a session hash outlives its expiry, so that
+// the expiry sweep can still report on it.
+const sessionRetention = 10 * time.Minute
+
+// KeyPositionSession maps an admitted position to the session it started.
+func KeyPositionSession(queueID, positionID string) string {
+	return fmt.Sprintf("waiting_room:{%s}:position_session:%s", queueID, positionID)
+}
+
+// StartSession turns an admitted position into an active session. If the
+// position already started a session, that session's ID is returned instead
+// and the new one is discarded. It returns "" if the position is not admitted.
+func (s *RedisStorage) StartSession(ctx context.Context, session *models.Session) (string, error) {
+	script := `
+		local existing = redis.call('GET', KEYS[1])
+		if existing then return existing end
+		if redis.call('ZREM', KEYS[2], ARGV[1]) == 0 then return '' end
+
+		local ttl = tonumber(ARGV[5]) - tonumber(ARGV[4])
+		redis.call('HSET', KEYS[4],
+			'queue_id', ARGV[6],
+			'position_id', ARGV[1],
+			'token', ARGV[3],
+			'status', 'active',
+			'started_at', ARGV[4],
+			'expires_at', ARGV[5],
+			'last_activity', ARGV[4],
+			'page_views', 0
+		)
+		redis.call('PEXPIRE', KEYS[4], ttl + tonumber(ARGV[7]))
+		redis.call('SET', KEYS[1], ARGV[2], 'PX', ttl)
+		redis.call('ZADD', KEYS[3], ARGV[5], ARGV[2])
+
+		-- The position has left the queue for good
+		redis.call('HDEL', KEYS[5], ARGV[1])
+		redis.call('ZREM', KEYS[6], ARGV[1])
+		return ARGV[2]
+	`
+	q := session.QueueID
+	keys := []string{
+		KeyPositionSession(q, session.PositionID), KeyAdmitted(q), KeyActiveSessions(q),
+		KeySession(q, session.ID), KeyPositions(q), KeyHeartbeats(q),
+	}
+	return s.client.Eval(ctx, script, keys,
+		session.PositionID, session.ID, session.Token,
+		session.StartedAt.UnixMilli(), session.ExpiresAt.UnixMilli(), q, sessionRetention.Milliseconds(),
+	).Text()
+}
+
+// PositionSession returns the ID of the session a position started, or "" if none
+func (s *RedisStorage) PositionSession(ctx context.Context, queueID, positionID string) (string, error) {
+	id, err := s.client.Get(ctx, KeyPositionSession(queueID, positionID)).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return id, err
+}
+
+// GetSession loads a session, returning nil once it has expired
+func (s *RedisStorage) GetSession(ctx context.Context, queueID, sessionID string) (*models.Session, error) {
+	fields, err := s.client.HGetAll(ctx, KeySession(queueID, sessionID)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	session := sessionFromHash(sessionID, fields)
+	if session == nil || session.Status == models.SessionExpired ||
+		(session.Status == models.SessionActive && !time.Now().Before(session.ExpiresAt)) {
+		return nil, nil
+	}
+	return session, nil
+}
+
+func sessionFromHash(sessionID string, fields map[string]string) *models.Session {
+	if len(fields) == 0 {
+		return nil
+	}
+
+	pageViews, _ := strconv.ParseInt(fields["page_views"], 10, 64)
+	return &models.Session{
+		ID:           sessionID,
+		QueueID:      fields["queue_id"],
+		PositionID:   fields["position_id"],
+		Status:       fields["status"],
+		Token:        fields["token"],
+		StartedAt:    parseMillis(fields["started_at"]),
+		ExpiresAt:    parseMillis(fields["expires_at"]),
+		LastActivity: parseMillis(fields["last_activity"]),
+		PageViews:    pageViews,
+	}
+}
+
+// RecordSessionActivity counts a page view on an active session and returns
+// the new total, or -1 if the session is gone or no longer active
+func (s *RedisStorage) RecordSessionActivity(ctx context.Context, queueID, sessionID string, now time.Time) (int64, error) {
+	script := `
+		local state = redis.call('HMGET', KEYS[1], 'status', 'expires_at')
+		if state[1] ~= 'active' or tonumber(state[2]) <= tonumber(ARGV[1]) then return -1 end
+		redis.call('HSET', KEYS[1], 'last_activity', ARGV[1])
+		return redis.call('HINCRBY', KEYS[1], 'page_views', 1)
+	`
+	return s.client.Eval(ctx, script, []string{KeySession(queueID, sessionID)}, now.UnixMilli()).Int64()
+}
+
+// ExtendSession moves an active session's expiry to session.ExpiresAt and
+// stores session.Token as the token that now goes with it. It reports whether
+// the session was active.
+func (s *RedisStorage) ExtendSession(ctx context.Context, session *models.Session) (bool, error) {
+	script := `
+		local state = redis.call('HMGET', KEYS[1], 'status', 'expires_at')
+		if state[1] ~= 'active' or tonumber(state[2]) <= tonumber(ARGV[3]) then return 0 end
+
+		local ttl = tonumber(ARGV[2]) - tonumber(ARGV[3])
+		redis.call('HSET', KEYS[1], 'expires_at', ARGV[2], 'token', ARGV[4])
+		redis.call('PEXPIRE', KEYS[1], ttl + tonumber(ARGV[5]))
+		redis.call('ZADD', KEYS[2], 'XX', ARGV[2], ARGV[1])
+		redis.call('PEXPIRE', KEYS[3], ttl)
+		return 1
+	`
+	q := session.QueueID
+	keys := []string{KeySession(q, session.ID), KeyActiveSessions(q), KeyPositionSession(q, session.PositionID)}
+	res, err := s.client.Eval(ctx, script, keys,
+		session.ID, session.ExpiresAt.UnixMilli(), time.Now().UnixMilli(), session.Token, sessionRetention.Milliseconds(),
+	).Int64()
+	if err != nil {
+		return false, err
+	}
+	return res == 1, nil
+}
+
+// EndSession marks an active session with a final status and frees its slot.
+// It reports whether the session was active.
+func (s *RedisStorage) EndSession(ctx context.Context, queueID, sessionID, status string) (bool, error) {
+	script := `
+		local state = redis.call('HMGET', KEYS[1], 'status', 'expires_at')
+		if state[1] ~= 'active' or tonumber(state[2]) <= tonumber(ARGV[3]) then return 0 end
+		redis.call('HSET', KEYS[1], 'status', ARGV[2])
+		redis.call('ZREM', KEYS[2], ARGV[1])
+		return 1
+	`
+	keys := []string{KeySession(queueID, sessionID), KeyActiveSessions(queueID)}
+	res, err := s.client.Eval(ctx, script, keys, sessionID, status, time.Now().UnixMilli()).Int64()
+	if err != nil {
+		return false, err
+	}
+	return res == 1, nil
+}
+
+// ExpireSessions drops up to limit sessions whose expiry has passed from the
+// active index, marks them expired and returns them
+func (s *RedisStorage) ExpireSessions(ctx context.Context, queueID string, now time.Time, limit int64) ([]*models.Session, error) {
+	script := `
+		local expired = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+		if #expired > 0 then
+			redis.call('ZREM', KEYS[1], unpack(expired))
+		end
+		return expired
+	`
+	ids, err := s.client.Eval(ctx, script, []string{KeyActiveSessions(queueID)}, now.UnixMilli(), limit).StringSlice()
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+
+	// The session hashes are kept for sessionRetention past expiry, so they
+	// can still be marked and read here
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = KeySession(queueID, id)
+	}
+	mark := `
+		for i = 1, #KEYS do
+			if redis.call('EXISTS', KEYS[i]) == 1 then
+				redis.call('HSET', KEYS[i], 'status', 'expired')
+			end
+		end
+		return 0
+	`
+	if err := s.client.Eval(ctx, mark, keys).Err(); err != nil {
+		return nil, err
+	}
+
+	pipe := s.client.Pipeline()
+	reads := make([]*redis.MapStringStringCmd, len(keys))
+	for i, key := range keys {
+		reads[i] = pipe.HGetAll(ctx, key)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	sessions := make([]*models.Session, 0, len(ids))
+	for i, id := range ids {
+		session := sessionFromHash(id, reads[i].Val())
+		if session == nil {
+			session = &models.Session{ID: id, QueueID: queueID}
+		}
+		session.Status = models.SessionExpired
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+func parseMillis(v string) time.Time {
+	ms, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jawaracloud/waiting-room-demo/pkg/models"
+)
+
+func TestStartSession(t *testing.T) {
+	s, _ := newTestStorage(t)
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Millisecond)
+	enqueue(t, s, "q", 0, now, "admitted", "waiting")
+	if _, err := s.AllowNext(ctx, "q", 1); err != nil {
+		t.Fatal(err)
+	}
+	session := func(sessionID, positionID string) *models.Session {
+		return &models.Session{ID: sessionID, QueueID: "q", PositionID: positionID, StartedAt: now, ExpiresAt: now.Add(time.Hour)}
+	}
+
+	id, err := s.StartSession(ctx, session("s1", "admitted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "s1" {
+		t.Fatalf("StartSession = %q, want s1", id)
+	}
+
+	// Starting again returns the first session
+	id, err = s.StartSession(ctx, session("s2", "admitted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "s1" {
+		t.Fatalf("second StartSession = %q, want s1", id)
+	}
+
+	id, err = s.StartSession(ctx, session("s3", "waiting"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "" {
+		t.Fatalf("StartSession for a waiting position = %q, want none", id)
+	}
+
+	// The position has left the queue, heartbeat included
+	status, err := s.PeekStatus(ctx, "q", "admitted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Found {
+		t.Fatalf("position still found after its session started: %+v", *status)
+	}
+	expired, err := s.ExpirePositions(ctx, "q", now.Add(time.Hour), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalIDs(expired, []string{"waiting"}) {
+		t.Fatalf("expired %v, want only the waiting position", expired)
+	}
+
+	got, err := s.GetSession(ctx, "q", "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.PositionID != "admitted" || got.Status != models.SessionActive || !got.ExpiresAt.Equal(now.Add(time.Hour)) {
+		t.Fatalf("GetSession = %+v", got)
+	}
+}
@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Admissions are counted in ThroughputBucket wide buckets, of which the last
+// ThroughputWindow are kept.
+const (
+	ThroughputBucket = 5 * time.Second
+	ThroughputWindow = 5 * time.Minute
+)
+
+// KeyThroughput counts admissions per bucket, keyed by the bucket's start in
+// Unix seconds.
+func KeyThroughput(queueID string) string {
+	return fmt.Sprintf("waiting_room:{%s}:throughput", queueID)
+}
+
+// throughputLua defines record_throughput, which adds count admissions at now
+// (Unix milliseconds) to the throughput key and drops buckets that have left
+// the window.
+var throughputLua = fmt.Sprintf(`
+	local function record_throughput(key, now, count)
+		if count == 0 then return end
+		local bucket = math.floor(now / 1000 / %[1]d) * %[1]d
+		redis.call('HINCRBY', key, bucket, count)
+		for _, field in ipairs(redis.call('HKEYS', key)) do
+			if tonumber(field) < bucket - %[2]d then
+				redis.call('HDEL', key, field)
+			end
+		end
+		redis.call('EXPIRE', key, %[2]d)
+	end
+`, int(ThroughputBucket/time.Second), int(ThroughputWindow/time.Second))
+
+// Throughput returns the admissions counted in each bucket of the window,
+// keyed by the bucket's start time in Unix seconds, and whether the queue
+// has ever admitted anyone.
+func (s *RedisStorage) Throughput(ctx context.Context, queueID string) (map[int64]int64, bool, error) {
+	pipe := s.client.Pipeline()
+	counts := pipe.HGetAll(ctx, KeyThroughput(queueID))
+	departures := pipe.Exists(ctx, KeyLaneDepartures(queueID))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, false, err
+	}
+
+	fields := counts.Val()
+	buckets := make(map[int64]int64, len(fields))
+	for field, value := range fields {
+		start, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			continue
+		}
+		buckets[start], _ = strconv.ParseInt(value, 10, 64)
+	}
+	return buckets, departures.Val() > 0, nil
+}
+
+// QueueCounts returns how many users are waiting in a queue, including its
+// lottery pre-queue, and how many hold an admission slot, admitted or in a
+// live session.
+func (s *RedisStorage) QueueCounts(ctx context.Context, queueID string, now time.Time) (waiting, active int64, err error) {
+	pipe := s.client.Pipeline()
+	lanes := make([]*redis.IntCmd, 0, NumLanes+1)
+	for _, key := range laneKeys(queueID) {
+		lanes = append(lanes, pipe.ZCard(ctx, key))
+	}
+	lanes = append(lanes, pipe.ZCard(ctx, KeyPreQueue(queueID)))
+	admitted := pipe.ZCard(ctx, KeyAdmitted(queueID))
+	sessions := pipe.ZCount(ctx, KeyActiveSessions(queueID), "("+strconv.FormatInt(now.UnixMilli(), 10), "+inf")
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, 0, err
+	}
+
+	for _, lane := range lanes {
+		waiting += lane.Val()
+	}
+	return waiting, admitted.Val() + sessions.Val(), nil
+}
@@ -0,0 +1,130 @@
+package token
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net"
+	"net/http"
+
+	"github.com/jawaracloud/waiting-room-demo/pkg/models"
+)
+
+var ErrClientMismatch = models.NewError(models.CodeClientMismatch, "Token was issued to a different client")
+
+// Client identifies the caller a token is issued to or presented by.
+type Client struct {
+	IP        string
+	UserAgent string
+	UserID    string // the site's own ID for the user, if it sent one; not part of bindings
+}
+
+// ClientFromRequest identifies the caller of a request for token binding.
+// RemoteAddr has already been rewritten by the RealIP middleware when behind a
+// trusted proxy.
+func ClientFromRequest(r *http.Request) Client {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return Client{IP: ip, UserAgent: r.UserAgent()}
+}
+
+// ValidBinding reports whether mode is a known client binding mode.
+func ValidBinding(mode string) bool {
+	switch mode {
+	case models.BindingNone, models.BindingIP, models.BindingSubnet, models.BindingUserAgent, models.BindingTolerant:
+		return true
+	}
+	return false
+}
+
+// Bind fingerprints a client for the given binding mode.
+func (s *Service) Bind(mode string, client Client) models.ClientBinding {
+	binding := models.ClientBinding{Binding: mode}
+	switch mode {
+	case models.BindingIP:
+		binding.IPHash = s.hash(client.IP)
+	case models.BindingSubnet:
+		binding.IPHash = s.hash(subnet(client.IP))
+	case models.BindingUserAgent:
+		binding.UAHash = s.hash(client.UserAgent)
+	case models.BindingTolerant:
+		binding.IPHash = s.hash(subnet(client.IP))
+		binding.UAHash = s.hash(client.UserAgent)
+	}
+	return binding
+}
+
+// ClientKey fingerprints a client across enqueues by its IP address,
+// User-Agent and user ID, salted like bindings.
+func (s *Service) ClientKey(client Client) string {
+	return s.hash(client.IP + "\n" + client.UserAgent + "\n" + client.UserID)
+}
+
+// IdentityKey fingerprints the identity a client holds positions as under an
+// identity policy, salted like bindings. It's empty under no policy, or when
+// the policy needs a user ID and the client sent none.
+func (s *Service) IdentityKey(policy string, client Client) string {
+	switch policy {
+	case models.IdentityIP:
+		return s.hash(client.IP)
+	case models.IdentityUserID:
+		if client.UserID != "" {
+			return s.hash(client.UserID)
+		}
+	case models.IdentityFingerprint:
+		return s.hash(client.IP + "\n" + client.UserAgent)
+	}
+	return ""
+}
+
+// checkBinding verifies that client matches the fingerprint in a token. In
+// tolerant mode one matching half is enough.
+func (s *Service) checkBinding(binding models.ClientBinding, client Client) error {
+	if binding.Binding == models.BindingNone {
+		return nil
+	}
+
+	expected := s.Bind(binding.Binding, client)
+	ipMatch := binding.IPHash != "" && equal(binding.IPHash, expected.IPHash)
+	uaMatch := binding.UAHash != "" && equal(binding.UAHash, expected.UAHash)
+
+	var ok bool
+	switch binding.Binding {
+	case models.BindingIP, models.BindingSubnet:
+		ok = ipMatch
+	case models.BindingUserAgent:
+		ok = uaMatch
+	case models.BindingTolerant:
+		ok = ipMatch || uaMatch
+	}
+	if !ok {
+		return ErrClientMismatch
+	}
+	return nil
+}
+
+func (s *Service) hash(value string) string {
+	mac := hmac.New(sha256.New, []byte(s.config.IPSalt))
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func equal(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// subnet returns the /24 of an IPv4 address or the /64 of an IPv6 address.
+// Unparseable addresses are returned unchanged.
+func subnet(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return parsed.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
@@ -0,0 +1,94 @@
+package token
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"time"
+
+	"github.com/jawaracloud/waiting-room-demo/pkg/models"
+)
+
+// Cookies browser clients keep their tokens in
+const (
+	QueueCookie   = "waiting_room_queue"
+	SessionCookie = "waiting_room_session"
+)
+
+// CSRFHeader carries the CSRF token on state-changing requests authenticated
+// with a cookie.
+const CSRFHeader = "X-CSRF-Token"
+
+var ErrCSRF = models.NewError(models.CodeForbidden, "Missing or invalid CSRF token")
+
+// CookieConfig holds token cookie configuration.
+type CookieConfig struct {
+	Domain   string // Domain session cookies are set for, e.g. example.com so the origin site can read them; empty for this host only
+	Insecure bool   // Leave out the Secure attribute on plain HTTP requests, for local development
+	CSRFKey  []byte // Key CSRF tokens are derived with, the same on every replica
+}
+
+// QueueCookie returns an HttpOnly cookie holding a queue token, scoped to
+// path on this host only.
+func (s *Service) QueueCookie(r *http.Request, tokenString, path string, expiresAt time.Time) *http.Cookie {
+	return s.cookie(r, QueueCookie, tokenString, path, "", expiresAt)
+}
+
+// SessionCookie returns an HttpOnly cookie holding a session token, for the
+// whole site and the configured cookie domain.
+func (s *Service) SessionCookie(r *http.Request, tokenString string, expiresAt time.Time) *http.Cookie {
+	return s.cookie(r, SessionCookie, tokenString, "/", s.config.Cookie.Domain, expiresAt)
+}
+
+// ClearQueueCookie returns a cookie deleting the queue cookie at path.
+func (s *Service) ClearQueueCookie(r *http.Request, path string) *http.Cookie {
+	cookie := s.cookie(r, QueueCookie, "", path, "", time.Time{})
+	cookie.MaxAge = -1
+	return cookie
+}
+
+// ClearSessionCookie returns a cookie deleting the session cookie.
+func (s *Service) ClearSessionCookie(r *http.Request) *http.Cookie {
+	cookie := s.cookie(r, SessionCookie, "", "/", s.config.Cookie.Domain, time.Time{})
+	cookie.MaxAge = -1
+	return cookie
+}
+
+func (s *Service) cookie(r *http.Request, name, value, path, domain string, expiresAt time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Domain:   domain,
+		Expires:  expiresAt,
+		HttpOnly: true,
+		Secure:   !s.config.Cookie.Insecure || secure(r),
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// CSRFToken returns the CSRF token for requests made with the cookies of a
+// position and the session it is admitted to. Cookies are sent by the browser
+// on requests other sites start, this token only by the client it was given to.
+// It is keyed with a secret of its own, as position IDs are no secret.
+func (s *Service) CSRFToken(positionID string) string {
+	mac := hmac.New(sha256.New, s.config.Cookie.CSRFKey)
+	mac.Write([]byte("csrf:" + positionID))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// CheckCSRF verifies the CSRF token sent with a request made with a
+// position's cookies.
+func (s *Service) CheckCSRF(positionID, csrfToken string) error {
+	if csrfToken == "" || !equal(csrfToken, s.CSRFToken(positionID)) {
+		return ErrCSRF
+	}
+	return nil
+}
+
+// secure reports whether the client connected over HTTPS, directly or through
+// a TLS-terminating proxy.
+func secure(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
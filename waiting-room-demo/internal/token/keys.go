@@ -0,0 +1,292 @@
+package token
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrKeyNotFound = errors.New("signing key not found")
+	ErrNoActiveKey = errors.New("no active signing key")
+)
+
+// KeyManager holds the RSA keys tokens are signed and verified with. Exactly
+// one key is active for signing; the others are kept so that tokens signed
+// before a rotation keep validating until they expire.
+type KeyManager struct {
+	mu          sync.RWMutex
+	private     map[string]*rsa.PrivateKey
+	public      map[string]*rsa.PublicKey
+	activeKeyID string
+}
+
+// NewKeyManager creates an empty key manager.
+func NewKeyManager() *KeyManager {
+	return &KeyManager{
+		private: make(map[string]*rsa.PrivateKey),
+		public:  make(map[string]*rsa.PublicKey),
+	}
+}
+
+// KeySource describes where LoadKeys finds its keys.
+type KeySource struct {
+	// Dir holds one PEM file per key, named <kid>.pem. Files with only a
+	// public key are used for verification.
+	Dir string
+	// PrivateKeyPEM is a single PEM-encoded private key, used when Dir is empty.
+	PrivateKeyPEM string
+	// ActiveKeyID selects the signing key. It defaults to the last key ID in
+	// Dir in lexical order, so date-based IDs rotate by adding a file.
+	ActiveKeyID string
+}
+
+// LoadKeys builds a key manager from a key directory or a PEM string.
+func LoadKeys(source KeySource) (*KeyManager, error) {
+	km := NewKeyManager()
+
+	switch {
+	case source.Dir != "":
+		if err := km.loadDir(source.Dir); err != nil {
+			return nil, err
+		}
+	case source.PrivateKeyPEM != "":
+		if source.ActiveKeyID == "" {
+			return nil, errors.New("a key ID is required with a PEM private key")
+		}
+		key, err := parsePrivateKey([]byte(source.PrivateKeyPEM))
+		if err != nil {
+			return nil, err
+		}
+		km.AddKey(source.ActiveKeyID, key)
+	default:
+		return nil, errors.New("no key source configured")
+	}
+
+	activeKeyID := source.ActiveKeyID
+	if activeKeyID == "" {
+		activeKeyID = km.lastPrivateKeyID()
+	}
+	if err := km.SetActive(activeKeyID); err != nil {
+		return nil, err
+	}
+	return km, nil
+}
+
+// GenerateKeys creates a key manager with a fresh 2048-bit key. Tokens signed
+// with it do not survive a restart, so it is only meant for development.
+func GenerateKeys(keyID string) (*KeyManager, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	km := NewKeyManager()
+	km.AddKey(keyID, key)
+	if err := km.SetActive(keyID); err != nil {
+		return nil, err
+	}
+	return km, nil
+}
+
+func (km *KeyManager) loadDir(dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("no .pem keys in %s", dir)
+	}
+
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		keyID := strings.TrimSuffix(filepath.Base(path), ".pem")
+
+		if key, err := parsePrivateKey(data); err == nil {
+			km.AddKey(keyID, key)
+			continue
+		}
+		pub, err := parsePublicKey(data)
+		if err != nil {
+			return fmt.Errorf("key %s: %w", path, err)
+		}
+		km.AddPublicKey(keyID, pub)
+	}
+	return nil
+}
+
+func (km *KeyManager) lastPrivateKeyID() string {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+
+	last := ""
+	for keyID := range km.private {
+		if keyID > last {
+			last = keyID
+		}
+	}
+	return last
+}
+
+// AddKey registers a private key. It can sign once made active.
+func (km *KeyManager) AddKey(keyID string, key *rsa.PrivateKey) {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+	km.private[keyID] = key
+	km.public[keyID] = &key.PublicKey
+}
+
+// AddPublicKey registers a key that is only used to verify tokens.
+func (km *KeyManager) AddPublicKey(keyID string, key *rsa.PublicKey) {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+	km.public[keyID] = key
+}
+
+// SetActive selects the key new tokens are signed with.
+func (km *KeyManager) SetActive(keyID string) error {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+	if _, ok := km.private[keyID]; !ok {
+		return fmt.Errorf("%w: %q", ErrKeyNotFound, keyID)
+	}
+	km.activeKeyID = keyID
+	return nil
+}
+
+// RotateKey makes a new key active. The previous keys remain valid for verification.
+func (km *KeyManager) RotateKey(keyID string, key *rsa.PrivateKey) {
+	km.AddKey(keyID, key)
+	km.mu.Lock()
+	km.activeKeyID = keyID
+	km.mu.Unlock()
+}
+
+// SigningKey returns the active key and its ID.
+func (km *KeyManager) SigningKey() (string, *rsa.PrivateKey, error) {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+	key, ok := km.private[km.activeKeyID]
+	if !ok {
+		return "", nil, ErrNoActiveKey
+	}
+	return km.activeKeyID, key, nil
+}
+
+// PublicKey returns the verification key for a key ID.
+func (km *KeyManager) PublicKey(keyID string) (*rsa.PublicKey, error) {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+	key, ok := km.public[keyID]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return key, nil
+}
+
+// JWK is an RSA public key in JSON Web Key form (RFC 7517).
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	N         string `json:"n"`
+	E         string `json:"e"`
+}
+
+// JWKS is the document served at /.well-known/jwks.json.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns every verification key, active key first, so that origins can
+// validate tokens offline.
+func (km *KeyManager) JWKS() JWKS {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+
+	keyIDs := make([]string, 0, len(km.public))
+	for keyID := range km.public {
+		keyIDs = append(keyIDs, keyID)
+	}
+	sort.Slice(keyIDs, func(i, j int) bool {
+		if keyIDs[i] == km.activeKeyID || keyIDs[j] == km.activeKeyID {
+			return keyIDs[i] == km.activeKeyID
+		}
+		return keyIDs[i] > keyIDs[j]
+	})
+
+	set := JWKS{Keys: make([]JWK, 0, len(keyIDs))}
+	for _, keyID := range keyIDs {
+		key := km.public[keyID]
+		set.Keys = append(set.Keys, JWK{
+			KeyType:   "RSA",
+			Use:       "sig",
+			Algorithm: "RS256",
+			KeyID:     keyID,
+			N:         base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	return set
+}
+
+func parsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("not an RSA private key")
+		}
+		return rsaKey, nil
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+}
+
+func parsePublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("not an RSA public key")
+		}
+		return rsaKey, nil
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+}
@@ -0,0 +1,308 @@
+// Package token issues and validates the JWTs handed to waiting-room clients.
+package token
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/jawaracloud/waiting-room-demo/pkg/models"
+)
+
+var (
+	ErrInvalidToken = models.NewError(models.CodeUnauthorized, "Missing or invalid token")
+	ErrExpiredToken = models.NewError(models.CodeTokenExpired, "Token has expired")
+	ErrRevokedToken = models.NewError(models.CodeTokenRevoked, "Token has been revoked")
+
+	// Only the first refresh of a token gets a successor, so a leaked token
+	// can't be used to fork the position or session it stands for.
+	ErrTokenRefreshed = models.NewError(models.CodeTokenRevoked, "Token has already been refreshed")
+)
+
+// RevocationStore records revoked and refreshed token IDs until the tokens
+// would have expired anyway. A position or session ID revokes every token
+// issued for it.
+type RevocationStore interface {
+	RevokeToken(ctx context.Context, tokenID, reason string, ttl time.Duration) error
+	RetireToken(ctx context.Context, tokenID string, grace, ttl time.Duration) (bool, error)
+	IsTokenRevoked(ctx context.Context, tokenID, ownerID string) (bool, error)
+}
+
+// Config holds token signing configuration.
+type Config struct {
+	Keys          *KeyManager
+	QueueTTL      time.Duration
+	SessionTTL    time.Duration
+	RefreshWindow time.Duration // how close to expiry a token can be refreshed
+	RefreshGrace  time.Duration // how long a refreshed token keeps working
+	IPSalt        string
+	Cookie        CookieConfig
+}
+
+// Service signs and validates queue and session tokens.
+type Service struct {
+	revocations RevocationStore
+	config      Config
+}
+
+// NewService creates a token service.
+func NewService(revocations RevocationStore, config Config) *Service {
+	return &Service{revocations: revocations, config: config}
+}
+
+// IssueQueueToken signs a queue token for a position, bound to the client as
+// described by binding, and returns it with its expiry.
+func (s *Service) IssueQueueToken(queueID, positionID string, priority int, binding models.ClientBinding, issuedAt time.Time) (string, time.Time, error) {
+	return s.issueQueueToken(positionID, queueID, positionID, priority, binding, issuedAt)
+}
+
+// ReissueQueueToken signs another queue token for a position whose client
+// lost the first one. It gets a new jti, so refreshes of either token don't
+// affect the other.
+func (s *Service) ReissueQueueToken(queueID, positionID string, priority int, binding models.ClientBinding, issuedAt time.Time) (string, time.Time, error) {
+	return s.issueQueueToken(uuid.New().String(), queueID, positionID, priority, binding, issuedAt)
+}
+
+func (s *Service) issueQueueToken(tokenID, queueID, positionID string, priority int, binding models.ClientBinding, issuedAt time.Time) (string, time.Time, error) {
+	expiresAt := issuedAt.Add(s.config.QueueTTL)
+
+	signed, err := s.sign(models.QueueToken{
+		Type:          models.TokenTypeQueue,
+		PositionID:    positionID,
+		QueueID:       queueID,
+		Priority:      priority,
+		IssuedAt:      issuedAt.UnixNano(),
+		ClientBinding: binding,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        tokenID,
+			Subject:   queueID,
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return signed, expiresAt, nil
+}
+
+// IssueSessionToken signs a session token for an admitted position and
+// returns it with its expiry. The session keeps the queue token's binding and
+// lasts ttl, or the configured SessionTTL when ttl is zero.
+func (s *Service) IssueSessionToken(queueID, sessionID, positionID string, binding models.ClientBinding, ttl time.Duration, issuedAt time.Time) (string, time.Time, error) {
+	if ttl <= 0 {
+		ttl = s.config.SessionTTL
+	}
+	expiresAt := issuedAt.Add(ttl)
+
+	signed, err := s.sign(models.SessionToken{
+		Type:          models.TokenTypeSession,
+		SessionID:     sessionID,
+		PositionID:    positionID,
+		QueueID:       queueID,
+		ClientBinding: binding,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        sessionID,
+			Subject:   queueID,
+			IssuedAt:  jwt.NewNumericDate(issuedAt),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return signed, expiresAt, nil
+}
+
+// ValidateQueueToken verifies a queue token, checks it hasn't been revoked
+// and is presented by the client it was bound to, and returns its claims.
+func (s *Service) ValidateQueueToken(ctx context.Context, tokenString string, client Client) (*models.QueueToken, error) {
+	claims := &models.QueueToken{}
+	if err := s.parse(tokenString, claims); err != nil {
+		return nil, err
+	}
+	if claims.Type != models.TokenTypeQueue {
+		return nil, ErrInvalidToken
+	}
+	if err := s.checkBinding(claims.ClientBinding, client); err != nil {
+		return nil, err
+	}
+	if err := s.checkRevoked(ctx, claims.ID, claims.PositionID); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// ValidateSessionToken verifies a session token, checks it hasn't been
+// revoked and is presented by the client it was bound to, and returns its
+// claims.
+func (s *Service) ValidateSessionToken(ctx context.Context, tokenString string, client Client) (*models.SessionToken, error) {
+	claims := &models.SessionToken{}
+	if err := s.parse(tokenString, claims); err != nil {
+		return nil, err
+	}
+	if claims.Type != models.TokenTypeSession {
+		return nil, ErrInvalidToken
+	}
+	if err := s.checkBinding(claims.ClientBinding, client); err != nil {
+		return nil, err
+	}
+	if err := s.checkRevoked(ctx, claims.ID, claims.SessionID); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// Subject verifies a queue or session token's signature and expiry, without
+// the revocation and binding checks, and returns what it stands for, e.g.
+// "position:<id>". It is for telling callers apart cheaply, not for
+// authorizing them.
+func (s *Service) Subject(tokenString string) (string, bool) {
+	claims := &models.SessionToken{} // a queue token's claims are a subset
+	if err := s.parse(tokenString, claims); err != nil {
+		return "", false
+	}
+	switch {
+	case claims.Type == models.TokenTypeQueue && claims.PositionID != "":
+		return "position:" + claims.PositionID, true
+	case claims.Type == models.TokenTypeSession && claims.SessionID != "":
+		return "session:" + claims.SessionID, true
+	}
+	return "", false
+}
+
+// Refreshable reports whether a token expiring at expiresAt is within the
+// refresh window.
+func (s *Service) Refreshable(expiresAt time.Time) bool {
+	return time.Until(expiresAt) <= s.config.RefreshWindow
+}
+
+// RefreshQueueToken re-signs a validated queue token for the same position
+// and binding with a new jti and a full queue token lifetime. The old token
+// keeps working for the refresh grace period, so requests already in flight
+// with it succeed, but it can't be refreshed again.
+func (s *Service) RefreshQueueToken(ctx context.Context, claims *models.QueueToken, now time.Time) (string, time.Time, error) {
+	if err := s.retire(ctx, claims.RegisteredClaims); err != nil {
+		return "", time.Time{}, err
+	}
+
+	expiresAt := now.Add(s.config.QueueTTL)
+	refreshed := *claims
+	refreshed.RegisteredClaims.ID = uuid.New().String()
+	refreshed.RegisteredClaims.ExpiresAt = jwt.NewNumericDate(expiresAt)
+
+	signed, err := s.sign(refreshed)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return signed, expiresAt, nil
+}
+
+// RefreshSessionToken re-signs a validated session token for the same
+// session and binding with a new jti, sliding its expiry forward by the
+// lifetime the token was issued with. The old token stays valid until the
+// caller retires it with RetireSessionToken, once the session itself has been
+// extended.
+func (s *Service) RefreshSessionToken(claims *models.SessionToken, now time.Time) (string, time.Time, error) {
+	ttl := s.config.SessionTTL
+	if claims.IssuedAt != nil {
+		ttl = claims.ExpiresAt.Sub(claims.IssuedAt.Time)
+	}
+	expiresAt := now.Add(ttl)
+	refreshed := *claims
+	refreshed.RegisteredClaims.ID = uuid.New().String()
+	refreshed.RegisteredClaims.IssuedAt = jwt.NewNumericDate(now)
+	refreshed.RegisteredClaims.ExpiresAt = jwt.NewNumericDate(expiresAt)
+
+	signed, err := s.sign(refreshed)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return signed, expiresAt, nil
+}
+
+// RetireSessionToken retires a session token that has been refreshed, as
+// RefreshQueueToken does for queue tokens.
+func (s *Service) RetireSessionToken(ctx context.Context, claims *models.SessionToken) error {
+	return s.retire(ctx, claims.RegisteredClaims)
+}
+
+// retire marks a token that is being refreshed to stop working once the
+// grace period is over. It fails if the token was refreshed before.
+func (s *Service) retire(ctx context.Context, claims jwt.RegisteredClaims) error {
+	ttl := max(time.Until(claims.ExpiresAt.Time), s.config.RefreshGrace, time.Second)
+	retired, err := s.revocations.RetireToken(ctx, claims.ID, s.config.RefreshGrace, ttl)
+	if err != nil {
+		return err
+	}
+	if !retired {
+		return ErrTokenRefreshed
+	}
+	return nil
+}
+
+// RevokeQueueToken revokes every queue token of a position. Their issue time
+// isn't known here, so the revocation is kept for a full queue token lifetime.
+func (s *Service) RevokeQueueToken(ctx context.Context, positionID, reason string) error {
+	return s.revocations.RevokeToken(ctx, positionID, reason, s.config.QueueTTL)
+}
+
+// RevokeSessionToken revokes every token of a session for the rest of its
+// lifetime.
+func (s *Service) RevokeSessionToken(ctx context.Context, sessionID string, expiresAt time.Time, reason string) error {
+	ttl := time.Until(expiresAt)
+	if ttl <= 0 {
+		return nil
+	}
+	return s.revocations.RevokeToken(ctx, sessionID, reason, ttl)
+}
+
+// checkRevoked fails if a token, or the position or session it was issued
+// for, has been revoked. Until a token is first refreshed its jti is the
+// position or session ID.
+func (s *Service) checkRevoked(ctx context.Context, tokenID, ownerID string) error {
+	revoked, err := s.revocations.IsTokenRevoked(ctx, tokenID, ownerID)
+	if err != nil {
+		return err
+	}
+	if revoked {
+		return ErrRevokedToken
+	}
+	return nil
+}
+
+// JWKS returns the public keys tokens can be verified with.
+func (s *Service) JWKS() JWKS {
+	return s.config.Keys.JWKS()
+}
+
+func (s *Service) sign(claims jwt.Claims) (string, error) {
+	keyID, key, err := s.config.Keys.SigningKey()
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = keyID
+	return token.SignedString(key)
+}
+
+// parse verifies a token against the key named by its kid header, which may
+// be a previous key still valid after a rotation.
+func (s *Service) parse(tokenString string, claims jwt.Claims) error {
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		keyID, ok := token.Header["kid"].(string)
+		if !ok {
+			return nil, ErrKeyNotFound
+		}
+		return s.config.Keys.PublicKey(keyID)
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()}))
+
+	switch {
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return ErrExpiredToken
+	case err != nil || !token.Valid:
+		return ErrInvalidToken
+	}
+	return nil
+}
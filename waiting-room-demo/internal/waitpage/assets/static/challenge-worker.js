@@ -0,0 +1,121 @@
+// Challenge solver, run as a Web Worker by challenge.js. For a hashcash
+// challenge it counts up from 0 until the SHA-256 hash of nonce:solution
+// starts with the required number of zero bits. SHA-256 is computed here
+// rather than with SubtleCrypto, which is slower per hash and missing on
+// plain http.
+(function () {
+  'use strict';
+
+  var K = [
+    0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5, 0x3956c25b, 0x59f111f1, 0x923f82a4, 0xab1c5ed5,
+    0xd807aa98, 0x12835b01, 0x243185be, 0x550c7dc3, 0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174,
+    0xe49b69c1, 0xefbe4786, 0x0fc19dc6, 0x240ca1cc, 0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da,
+    0x983e5152, 0xa831c66d, 0xb00327c8, 0xbf597fc7, 0xc6e00bf3, 0xd5a79147, 0x06ca6351, 0x14292967,
+    0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13, 0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85,
+    0xa2bfe8a1, 0xa81a664b, 0xc24b8b70, 0xc76c51a3, 0xd192e819, 0xd6990624, 0xf40e3585, 0x106aa070,
+    0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5, 0x391c0cb3, 0x4ed8aa4a, 0x5b9cca4f, 0x682e6ff3,
+    0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208, 0x90befffa, 0xa4506ceb, 0xbef9a3f7, 0xc67178f2
+  ];
+
+  var w = new Int32Array(64);
+  var h = new Int32Array(8);
+
+  // Nonces are well under this, leaving room for the solution and padding
+  var buffer = new Uint8Array(1024);
+
+  function rotr(x, n) {
+    return (x >>> n) | (x << (32 - n));
+  }
+
+  // sha256 hashes the first length bytes of buffer, padding them in place, and
+  // returns the digest as eight 32-bit words
+  function sha256(length) {
+    var end = (length + 9 + 63) & ~63;
+    buffer[length] = 0x80;
+    buffer.fill(0, length + 1, end - 4);
+    // Messages are short, so only the low word of the bit length is set
+    var bitLength = length * 8;
+    buffer[end - 4] = bitLength >>> 24;
+    buffer[end - 3] = bitLength >>> 16;
+    buffer[end - 2] = bitLength >>> 8;
+    buffer[end - 1] = bitLength;
+
+    h[0] = 0x6a09e667;
+    h[1] = 0xbb67ae85;
+    h[2] = 0x3c6ef372;
+    h[3] = 0xa54ff53a;
+    h[4] = 0x510e527f;
+    h[5] = 0x9b05688c;
+    h[6] = 0x1f83d9ab;
+    h[7] = 0x5be0cd19;
+    for (var block = 0; block < end; block += 64) {
+      var t;
+      for (t = 0; t < 16; t++) {
+        var j = block + t * 4;
+        w[t] = (buffer[j] << 24) | (buffer[j + 1] << 16) | (buffer[j + 2] << 8) | buffer[j + 3];
+      }
+      for (t = 16; t < 64; t++) {
+        var s0 = rotr(w[t - 15], 7) ^ rotr(w[t - 15], 18) ^ (w[t - 15] >>> 3);
+        var s1 = rotr(w[t - 2], 17) ^ rotr(w[t - 2], 19) ^ (w[t - 2] >>> 10);
+        w[t] = w[t - 16] + s0 + w[t - 7] + s1;
+      }
+
+      var a = h[0], b = h[1], c = h[2], d = h[3], e = h[4], f = h[5], g = h[6], k = h[7];
+      for (t = 0; t < 64; t++) {
+        var t1 = (k + (rotr(e, 6) ^ rotr(e, 11) ^ rotr(e, 25)) + ((e & f) ^ (~e & g)) + K[t] + w[t]) | 0;
+        var t2 = ((rotr(a, 2) ^ rotr(a, 13) ^ rotr(a, 22)) + ((a & b) ^ (a & c) ^ (b & c))) | 0;
+        k = g;
+        g = f;
+        f = e;
+        e = (d + t1) | 0;
+        d = c;
+        c = b;
+        b = a;
+        a = (t1 + t2) | 0;
+      }
+      h[0] += a;
+      h[1] += b;
+      h[2] += c;
+      h[3] += d;
+      h[4] += e;
+      h[5] += f;
+      h[6] += g;
+      h[7] += k;
+    }
+    return h;
+  }
+
+  function leadingZeros(digest) {
+    var zeros = 0;
+    for (var i = 0; i < digest.length; i++) {
+      if (digest[i] !== 0) {
+        return zeros + Math.clz32(digest[i]);
+      }
+      zeros += 32;
+    }
+    return zeros;
+  }
+
+  function hashcash(nonce, difficulty) {
+    var prefix = nonce + ':';
+    for (var i = 0; i < prefix.length; i++) {
+      buffer[i] = prefix.charCodeAt(i);
+    }
+    for (var n = 0; ; n++) {
+      var solution = String(n);
+      for (var j = 0; j < solution.length; j++) {
+        buffer[prefix.length + j] = solution.charCodeAt(j);
+      }
+      if (leadingZeros(sha256(prefix.length + solution.length)) >= difficulty) {
+        return solution;
+      }
+    }
+  }
+
+  self.onmessage = function (event) {
+    if (event.data.type !== 'hashcash') {
+      throw new Error('unsupported challenge type ' + event.data.type);
+    }
+    self.postMessage({ solution: hashcash(event.data.nonce, event.data.difficulty) });
+  };
+})();
@@ -0,0 +1,34 @@
+// Challenge page client: solves the queue's challenge in a Web Worker, so the
+// page stays responsive, then reloads the page with the solution in a cookie
+// for the server to check before it lets the visitor join the queue.
+(function () {
+  'use strict';
+
+  var config = JSON.parse(document.getElementById('wr-challenge').textContent);
+
+  function fail() {
+    var el = document.getElementById('wr-state');
+    el.textContent = config.strings.unsupported;
+    el.hidden = false;
+  }
+
+  var worker;
+  try {
+    worker = new Worker(config.worker_url);
+  } catch (e) {
+    fail();
+    return;
+  }
+
+  worker.onmessage = function (event) {
+    var cookie = config.cookie + '=' + config.nonce + ':' + event.data.solution +
+      '; Path=/; Max-Age=' + config.max_age_seconds + '; SameSite=Lax';
+    if (window.location.protocol === 'https:') {
+      cookie += '; Secure';
+    }
+    document.cookie = cookie;
+    window.location.reload();
+  };
+  worker.onerror = fail;
+  worker.postMessage({ type: config.type, nonce: config.nonce, difficulty: config.difficulty });
+})();
@@ -0,0 +1,170 @@
+// Waiting page client: keeps the position alive with heartbeats and shows
+// live updates, over the WebSocket or, if that fails, HTTP heartbeats. The
+// page works without it by refreshing itself.
+(function () {
+  'use strict';
+
+  var config = JSON.parse(document.getElementById('wr-config').textContent);
+  var strings = config.strings;
+  var interval = config.heartbeat_interval_seconds * 1000;
+  var timer = null;
+  var done = false;
+
+  function text(id, value) {
+    var el = document.getElementById(id);
+    if (el) {
+      el.textContent = value;
+    }
+  }
+
+  function format(template, value) {
+    return template.replace('%d', value);
+  }
+
+  // Mirrors the server's wait text, so updates read like the first render
+  function waitText(seconds) {
+    if (seconds <= 0) {
+      return strings.wait_unknown;
+    }
+    if (seconds < 60) {
+      return strings.wait_soon;
+    }
+    var minutes = Math.ceil(seconds / 60);
+    if (minutes < 2) {
+      return strings.wait_minute;
+    }
+    if (minutes < 60) {
+      return format(strings.wait_minutes, minutes);
+    }
+    return format(format(strings.wait_hours, Math.floor(minutes / 60)), minutes % 60);
+  }
+
+  function update(data) {
+    if (Boolean(data.prequeue) !== config.prequeue) {
+      // The lottery was drawn; the page has a different layout now
+      reload();
+      return;
+    }
+    text('wr-position', data.position);
+    text('wr-queue-length', data.queue_length);
+    text('wr-wait', waitText(data.estimated_wait_seconds));
+    var onHold = document.getElementById('wr-on-hold');
+    if (onHold) {
+      onHold.hidden = data.queue_status !== 'paused' && data.queue_status !== 'maintenance';
+    }
+  }
+
+  // The server sets the session cookie and sends the visitor on when the page
+  // is reloaded after admission, and rejoins them after expiry
+  function reload() {
+    if (done) {
+      return;
+    }
+    done = true;
+    clearInterval(timer);
+    window.location.reload();
+  }
+
+  function finish(message) {
+    text('wr-state', message);
+    reload();
+  }
+
+  function connect() {
+    var scheme = window.location.protocol === 'https:' ? 'wss://' : 'ws://';
+    var socket;
+    try {
+      socket = new WebSocket(scheme + window.location.host + config.socket_url +
+        '?token=' + encodeURIComponent(config.token));
+    } catch (e) {
+      poll();
+      return;
+    }
+    var opened = false;
+
+    socket.onopen = function () {
+      opened = true;
+      timer = setInterval(function () {
+        socket.send(JSON.stringify({ type: 'heartbeat' }));
+      }, interval);
+    };
+    socket.onmessage = function (event) {
+      var msg = JSON.parse(event.data);
+      switch (msg.type) {
+        case 'position_update':
+          update(msg.data);
+          break;
+        case 'admitted':
+          finish(strings.admitted);
+          break;
+        case 'expired':
+          finish(strings.expired);
+          break;
+      }
+    };
+    socket.onclose = function () {
+      clearInterval(timer);
+      if (done) {
+        return;
+      }
+      if (opened) {
+        // Dropped mid-wait: the refreshed page picks up where this one was
+        reload();
+      } else {
+        poll();
+      }
+    };
+  }
+
+  // HTTP heartbeats, for networks that block WebSockets
+  function poll() {
+    function beat() {
+      fetch(config.heartbeat_url, {
+        method: 'POST',
+        headers: {
+          'Authorization': 'Bearer ' + config.token,
+          'Content-Type': 'application/json'
+        },
+        body: JSON.stringify({ timestamp: Date.now() })
+      }).then(function (response) {
+        if (response.status === 410 || response.status === 404) {
+          finish(strings.expired);
+          return null;
+        }
+        return response.ok ? response.json() : null;
+      }).then(function (data) {
+        if (!data) {
+          return;
+        }
+        if (data.admitted) {
+          finish(strings.admitted);
+        } else {
+          update(data);
+        }
+      }).catch(function () {
+        // Try again on the next beat
+      });
+    }
+
+    timer = setInterval(beat, interval);
+    document.addEventListener('visibilitychange', function () {
+      if (document.visibilityState === 'visible' && !done) {
+        beat();
+      }
+    });
+  }
+
+  var opensAt = document.getElementById('wr-opens-at');
+  if (opensAt) {
+    opensAt.textContent = new Date(opensAt.getAttribute('datetime')).toLocaleTimeString([], {
+      hour: '2-digit',
+      minute: '2-digit'
+    });
+  }
+
+  if ('WebSocket' in window) {
+    connect();
+  } else {
+    poll();
+  }
+})();
@@ -0,0 +1,215 @@
+package waitpage
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jawaracloud/waiting-room-demo/internal/middleware"
+	"github.com/jawaracloud/waiting-room-demo/internal/queue"
+	"github.com/jawaracloud/waiting-room-demo/internal/token"
+	"github.com/jawaracloud/waiting-room-demo/pkg/models"
+)
+
+var errNoTarget = models.NewError(models.CodeInternalError, "Queue has no target_url to send admitted visitors to")
+
+// ChallengeCookie carries a solved challenge, as nonce:solution, from the
+// challenge page back to the room.
+const ChallengeCookie = "wr_challenge"
+
+// Room admits browsers through a queue, keeping their tokens in cookies and
+// showing them the waiting page until it's their turn.
+type Room struct {
+	queue             *queue.Service
+	tokens            *token.Service
+	pages             *Pages
+	limits            *middleware.RateLimiter
+	heartbeatInterval time.Duration
+}
+
+// NewRoom creates a room. New visitors are counted against the limiter's
+// "enqueue" limit. The waiting page refreshes every heartbeatInterval for
+// queues that don't set their own.
+func NewRoom(queueService *queue.Service, tokenService *token.Service, pages *Pages, limits *middleware.RateLimiter, heartbeatInterval time.Duration) *Room {
+	return &Room{
+		queue:             queueService,
+		tokens:            tokenService,
+		pages:             pages,
+		limits:            limits,
+		heartbeatInterval: heartbeatInterval,
+	}
+}
+
+// RegisterRoutes registers the standalone waiting page and its assets.
+func (room *Room) RegisterRoutes(r chi.Router) {
+	r.Get("/queues/{queue_id}", room.WaitingPage)
+	r.Handle("/static/*", room.pages.Static())
+}
+
+// WaitingPage handles GET /waiting-room/queues/{queue_id}, the waiting page
+// for sites that link visitors to it instead of running behind the gateway.
+// Admitted visitors are redirected to the queue's target_url with their
+// session cookie set.
+func (room *Room) WaitingPage(w http.ResponseWriter, r *http.Request) {
+	queueID := chi.URLParam(r, "queue_id")
+	if !room.Admit(w, r, queueID, r.URL.Path) {
+		return
+	}
+
+	q, err := room.queue.Queue(r.Context(), queueID)
+	if err != nil && !errors.Is(err, queue.ErrQueueNotFound) {
+		room.Error(w, r, queueID, err)
+		return
+	}
+	if q == nil || q.TargetURL == "" {
+		room.Error(w, r, queueID, errNoTarget)
+		return
+	}
+	http.Redirect(w, r, q.TargetURL, http.StatusSeeOther)
+}
+
+// Admit reports whether a request may go on to what it asked for: it carries
+// a valid session cookie, which counts as activity on the session, or the
+// visitor has just been admitted and is given one. Otherwise Admit writes the
+// response itself, enqueueing new visitors and showing the waiting page to
+// everyone in line. The queue cookie is scoped to cookiePath, the session
+// cookie to the whole site and the configured cookie domain.
+func (room *Room) Admit(w http.ResponseWriter, r *http.Request, queueID, cookiePath string) bool {
+	if cookie, err := r.Cookie(token.SessionCookie); err == nil {
+		if err := room.recordActivity(r.Context(), r, queueID, cookie.Value); err == nil {
+			return true
+		} else if !isDomainError(err) {
+			room.Error(w, r, queueID, err)
+			return false
+		}
+		http.SetCookie(w, room.tokens.ClearSessionCookie(r))
+	}
+
+	cookie, err := r.Cookie(token.QueueCookie)
+	if err != nil {
+		room.join(w, r, queueID, cookiePath)
+		return false
+	}
+	status, err := room.queue.CheckStatus(r.Context(), queueID, cookie.Value, token.ClientFromRequest(r))
+	switch {
+	case err != nil && !isDomainError(err):
+		room.Error(w, r, queueID, err)
+	case err != nil || !status.InQueue:
+		// The position expired or the token is no good, so start over
+		http.SetCookie(w, room.tokens.ClearQueueCookie(r, cookiePath))
+		room.join(w, r, queueID, cookiePath)
+	case status.Session != nil:
+		// Admitted: this request starts the session, so it goes through too
+		http.SetCookie(w, room.tokens.ClearQueueCookie(r, cookiePath))
+		http.SetCookie(w, room.tokens.SessionCookie(r, status.Session.Token, status.Session.ExpiresAt))
+		return true
+	default:
+		room.waiting(w, r, status, cookie.Value)
+	}
+	return false
+}
+
+// Error shows err as a page, themed for the queue if it has been configured.
+func (room *Room) Error(w http.ResponseWriter, r *http.Request, queueID string, err error) {
+	q, _ := room.queue.Queue(r.Context(), queueID)
+	room.pages.Error(w, r, queueID, q, err)
+}
+
+// join enqueues a new visitor and shows them the waiting page. For queues
+// that require a challenge, visitors first get the challenge page, until they
+// come back with a solution.
+func (room *Room) join(w http.ResponseWriter, r *http.Request, queueID, cookiePath string) {
+	q, err := room.queue.Queue(r.Context(), queueID)
+	if err != nil && !errors.Is(err, queue.ErrQueueNotFound) {
+		room.Error(w, r, queueID, err)
+		return
+	}
+	var solution *models.ChallengeSolution
+	if q != nil && q.Challenge != "" {
+		if solution = challengeSolution(r); solution == nil {
+			room.challenge(w, r, q)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: ChallengeCookie, Path: "/", MaxAge: -1})
+	}
+
+	if err := room.limits.Check(w, r, "enqueue"); err != nil {
+		room.Error(w, r, queueID, err)
+		return
+	}
+	tokenString, status, err := room.queue.Enqueue(r.Context(), queueID, models.PriorityNormal, token.ClientFromRequest(r), solution)
+	if isChallengeError(err) {
+		// Expired or already used: solve a new one
+		room.challenge(w, r, q)
+		return
+	}
+	if err != nil {
+		room.Error(w, r, queueID, err)
+		return
+	}
+	http.SetCookie(w, room.tokens.QueueCookie(r, tokenString, cookiePath, status.ExpiresAt))
+	room.waiting(w, r, status, tokenString)
+}
+
+// challenge shows the challenge page with a new challenge for q.
+func (room *Room) challenge(w http.ResponseWriter, r *http.Request, q *models.Queue) {
+	if err := room.limits.Check(w, r, "challenge"); err != nil {
+		room.Error(w, r, q.ID, err)
+		return
+	}
+	challenge, err := room.queue.IssueChallenge(r.Context(), q.ID)
+	if err != nil {
+		room.Error(w, r, q.ID, err)
+		return
+	}
+	room.pages.Challenge(w, r, q, challenge)
+}
+
+func (room *Room) waiting(w http.ResponseWriter, r *http.Request, status *models.QueueStatus, tokenString string) {
+	refresh := status.HeartbeatInterval
+	if refresh <= 0 {
+		refresh = room.heartbeatInterval
+	}
+	q, _ := room.queue.Queue(r.Context(), status.QueueID)
+	room.pages.Waiting(w, r, q, status, tokenString, refresh)
+}
+
+// recordActivity validates a session token for a queue and counts the
+// request as activity on its session.
+func (room *Room) recordActivity(ctx context.Context, r *http.Request, queueID, tokenString string) error {
+	claims, err := room.tokens.ValidateSessionToken(ctx, tokenString, token.ClientFromRequest(r))
+	if err != nil {
+		return err
+	}
+	if claims.QueueID != queueID {
+		return queue.ErrWrongQueue
+	}
+	_, err = room.queue.RecordActivity(ctx, claims)
+	return err
+}
+
+// challengeSolution reads the solution in the ChallengeCookie, if any.
+func challengeSolution(r *http.Request) *models.ChallengeSolution {
+	cookie, err := r.Cookie(ChallengeCookie)
+	if err != nil {
+		return nil
+	}
+	i := strings.LastIndexByte(cookie.Value, ':')
+	if i < 0 {
+		return nil
+	}
+	return &models.ChallengeSolution{Nonce: cookie.Value[:i], Solution: cookie.Value[i+1:]}
+}
+
+func isChallengeError(err error) bool {
+	var domainErr *models.Error
+	return errors.As(err, &domainErr) && domainErr.Code == models.CodeChallengeFailed
+}
+
+func isDomainError(err error) bool {
+	var domainErr *models.Error
+	return errors.As(err, &domainErr)
+}
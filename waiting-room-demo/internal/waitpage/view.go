@@ -0,0 +1,104 @@
+package waitpage
+
+import (
+	"fmt"
+
+	"github.com/jawaracloud/waiting-room-demo/pkg/models"
+)
+
+// View is the data templates are executed with.
+type View struct {
+	QueueID string
+	Name    string           // The queue's name
+	Lang    string           // Locale the page is written in
+	Static  string           // URL path of the page assets
+	Page    models.QueuePage // The queue's theme; zero fields use the defaults
+
+	// Waiting page
+	Status  *models.QueueStatus
+	Refresh int64        // Seconds between refreshes without JavaScript
+	Client  clientConfig // Read by waiting.js
+
+	// Challenge page
+	Challenge challengeConfig // Read by challenge.js
+
+	// Error page
+	Message    string
+	RetryAfter int64 // Seconds until the page tries again, 0 for never
+	RequestID  string
+
+	messages catalog
+	fallback catalog
+}
+
+// clientConfig configures the waiting page script.
+type clientConfig struct {
+	Token             string            `json:"token"`
+	SocketURL         string            `json:"socket_url"`
+	HeartbeatURL      string            `json:"heartbeat_url"`
+	HeartbeatInterval int64             `json:"heartbeat_interval_seconds"`
+	PreQueue          bool              `json:"prequeue"`
+	Strings           map[string]string `json:"strings"`
+}
+
+// challengeConfig configures the challenge page script.
+type challengeConfig struct {
+	Type       string            `json:"type"`
+	Nonce      string            `json:"nonce"`
+	Difficulty int               `json:"difficulty"`
+	WorkerURL  string            `json:"worker_url"`
+	Cookie     string            `json:"cookie"`
+	MaxAge     int64             `json:"max_age_seconds"`
+	Strings    map[string]string `json:"strings"`
+}
+
+// T translates key into the page's locale, formatting args into it.
+func (v *View) T(key string, args ...any) string {
+	message, ok := v.messages[key]
+	if !ok {
+		if message, ok = v.fallback[key]; !ok {
+			return key
+		}
+	}
+	if len(args) == 0 {
+		return message
+	}
+	return fmt.Sprintf(message, args...)
+}
+
+// Title is the page title, the queue's own if it has one.
+func (v *View) Title() string {
+	if v.Page.Title != "" {
+		return v.Page.Title
+	}
+	if v.Status != nil && v.Status.PreQueue {
+		return v.T("prequeue_title")
+	}
+	return v.T("title")
+}
+
+// Wait describes an estimated wait, rounded up to whole minutes. waiting.js
+// mirrors it for live updates.
+func (v *View) Wait(seconds int64) string {
+	minutes := (seconds + 59) / 60
+	switch {
+	case seconds <= 0:
+		return v.T("wait_unknown")
+	case seconds < 60:
+		return v.T("wait_soon")
+	case minutes < 2:
+		return v.T("wait_minute")
+	case minutes < 60:
+		return v.T("wait_minutes", minutes)
+	}
+	return v.T("wait_hours", minutes/60, minutes%60)
+}
+
+// OnHold reports whether the queue has stopped admitting for now.
+func (v *View) OnHold() bool {
+	switch v.Status.QueueState {
+	case models.QueuePaused, models.QueueMaintenance:
+		return true
+	}
+	return false
+}
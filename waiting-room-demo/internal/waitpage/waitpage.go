@@ -0,0 +1,307 @@
+// Package waitpage serves the HTML waiting page visitors see while they wait
+// in a queue. Its templates, script, styles and translations are embedded in
+// the binary, and can be overridden for every queue or for one.
+package waitpage
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/jawaracloud/waiting-room-demo/internal/apierror"
+	"github.com/jawaracloud/waiting-room-demo/pkg/models"
+)
+
+// Prefix is where the waiting room's own pages and assets are served, kept
+// clear of the paths of a site behind the gateway.
+const (
+	Prefix     = "/waiting-room"
+	StaticPath = Prefix + "/static"
+)
+
+// defaultLocale is used when neither the queue nor the visitor asks for a
+// locale there is a catalog for, and fills in strings a catalog lacks.
+const defaultLocale = "en"
+
+// Directories of an override directory that aren't per-queue templates
+const (
+	localesDir = "locales"
+	staticDir  = "static"
+)
+
+//go:embed assets
+var assets embed.FS
+
+var errPage = models.NewError(models.CodeInternalError, "Something went wrong, please try again later")
+
+// clientStrings are the messages waiting.js shows as the page updates.
+var clientStrings = []string{"wait_unknown", "wait_soon", "wait_minute", "wait_minutes", "wait_hours", "admitted", "expired"}
+
+// catalog maps message keys to translated format strings.
+type catalog map[string]string
+
+// Pages renders the waiting and error pages.
+type Pages struct {
+	shared   *template.Template
+	queues   map[string]*template.Template
+	catalogs map[string]catalog
+	static   fs.FS
+}
+
+// New loads the embedded pages, overridden by the files in dir if it isn't
+// empty:
+//
+//	dir/*.html            templates for every queue
+//	dir/<queue_id>/*.html templates for one queue
+//	dir/locales/<tag>.json translations, merged over the built-in ones
+//	dir/static/*          assets, served in place of the built-in ones
+//
+// Override templates redefine templates by name, such as "logo" or "theme".
+// Everything is read once, at startup.
+func New(dir string) (*Pages, error) {
+	base, err := template.ParseFS(assets, "assets/templates/*.html")
+	if err != nil {
+		return nil, err
+	}
+	catalogs := make(map[string]catalog)
+	if err := loadCatalogs(catalogs, assets, "assets/locales"); err != nil {
+		return nil, err
+	}
+	static, err := fs.Sub(assets, "assets/static")
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Pages{
+		shared:   base,
+		queues:   make(map[string]*template.Template),
+		catalogs: catalogs,
+		static:   static,
+	}
+	if dir == "" {
+		return p, nil
+	}
+
+	root := os.DirFS(dir)
+	if p.shared, err = overlay(base, root, "*.html"); err != nil {
+		return nil, err
+	}
+	if err := loadCatalogs(catalogs, root, localesDir); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if _, err := fs.Stat(root, staticDir); err == nil {
+		upper, _ := fs.Sub(root, staticDir)
+		p.static = layeredFS{upper: upper, lower: static}
+	}
+
+	entries, err := fs.ReadDir(root, ".")
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name() == localesDir || entry.Name() == staticDir {
+			continue
+		}
+		t, err := overlay(p.shared, root, entry.Name()+"/*.html")
+		if err != nil {
+			return nil, err
+		}
+		p.queues[entry.Name()] = t
+	}
+	return p, nil
+}
+
+// overlay parses the templates matching pattern over a copy of base.
+func overlay(base *template.Template, fsys fs.FS, pattern string) (*template.Template, error) {
+	matches, err := fs.Glob(fsys, pattern)
+	if err != nil || len(matches) == 0 {
+		return base, err
+	}
+	t, err := base.Clone()
+	if err != nil {
+		return nil, err
+	}
+	return t.ParseFS(fsys, pattern)
+}
+
+// loadCatalogs merges the <tag>.json files in dir into catalogs.
+func loadCatalogs(catalogs map[string]catalog, fsys fs.FS, dir string) error {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		tag, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		data, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		var messages catalog
+		if err := json.Unmarshal(data, &messages); err != nil {
+			return fmt.Errorf("locale %s: %w", entry.Name(), err)
+		}
+		tag = strings.ToLower(tag)
+		if catalogs[tag] == nil {
+			catalogs[tag] = make(catalog)
+		}
+		for key, message := range messages {
+			catalogs[tag][key] = message
+		}
+	}
+	return nil
+}
+
+// Static serves the page assets under StaticPath.
+func (p *Pages) Static() http.Handler {
+	files := http.StripPrefix(StaticPath, http.FileServer(http.FS(p.static)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		files.ServeHTTP(w, r)
+	})
+}
+
+// Waiting writes the waiting page for a position. Without JavaScript the page
+// refreshes itself every refresh; the script instead keeps it up to date over
+// the WebSocket, authenticated with token.
+func (p *Pages) Waiting(w http.ResponseWriter, r *http.Request, queue *models.Queue, status *models.QueueStatus, token string, refresh time.Duration) {
+	v := p.view(r, status.QueueID, queue)
+	v.Status = status
+	v.Refresh = int64(refresh / time.Second)
+
+	messages := make(map[string]string)
+	for _, key := range clientStrings {
+		messages[key] = v.T(key)
+	}
+	v.Client = clientConfig{
+		Token:             token,
+		SocketURL:         "/ws/queues/" + status.QueueID,
+		HeartbeatURL:      "/api/v1/queues/" + status.QueueID + "/heartbeat",
+		HeartbeatInterval: v.Refresh,
+		PreQueue:          status.PreQueue,
+		Strings:           messages,
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	p.render(w, http.StatusOK, status.QueueID, "waiting", v)
+}
+
+// Challenge writes the page that solves a challenge before joining a queue.
+// Its script solves the challenge in a Web Worker, then reloads the page with
+// the solution in the ChallengeCookie. Without JavaScript there is no joining
+// a queue that requires a challenge.
+func (p *Pages) Challenge(w http.ResponseWriter, r *http.Request, queue *models.Queue, challenge *models.Challenge) {
+	v := p.view(r, queue.ID, queue)
+	v.Challenge = challengeConfig{
+		Type:       challenge.Type,
+		Nonce:      challenge.Nonce,
+		Difficulty: challenge.Difficulty,
+		WorkerURL:  StaticPath + "/challenge-worker.js",
+		Cookie:     ChallengeCookie,
+		MaxAge:     max(int64(time.Until(challenge.ExpiresAt)/time.Second), 1),
+		Strings:    map[string]string{"unsupported": v.T("challenge_unsupported")},
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	p.render(w, http.StatusOK, queue.ID, "challenge", v)
+}
+
+// Error writes err as a page with the HTTP status apierror gives its code.
+// Errors other than *models.Error are logged and shown as a generic error.
+// Errors with a retry hint send Retry-After and refresh the page once it has
+// passed.
+func (p *Pages) Error(w http.ResponseWriter, r *http.Request, queueID string, queue *models.Queue, err error) {
+	v := p.view(r, queueID, queue)
+	v.RequestID = middleware.GetReqID(r.Context())
+
+	var domainErr *models.Error
+	if !errors.As(err, &domainErr) || domainErr.Code == models.CodeInternalError {
+		log.Printf("waiting page error: %v request_id=%s", err, v.RequestID)
+		domainErr = errPage
+	}
+	v.Message = domainErr.Message
+	v.RetryAfter, _ = domainErr.Details["retry_after_seconds"].(int64)
+
+	if v.RetryAfter > 0 {
+		w.Header().Set("Retry-After", fmt.Sprint(v.RetryAfter))
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	p.render(w, apierror.Status(domainErr.Code), queueID, "error", v)
+}
+
+func (p *Pages) render(w http.ResponseWriter, status int, queueID, name string, v *View) {
+	t, ok := p.queues[queueID]
+	if !ok {
+		t = p.shared
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := t.ExecuteTemplate(w, name, v); err != nil {
+		log.Printf("writing %s page for queue %s: %v", name, queueID, err)
+	}
+}
+
+func (p *Pages) view(r *http.Request, queueID string, queue *models.Queue) *View {
+	v := &View{
+		QueueID: queueID,
+		Name:    queueID,
+		Static:  StaticPath,
+	}
+	if queue != nil {
+		v.Name = queue.Name
+		if queue.Page != nil {
+			v.Page = *queue.Page
+		}
+	}
+	v.Lang = p.locale(v.Page.Locale, r.Header.Get("Accept-Language"))
+	v.messages = p.catalogs[v.Lang]
+	v.fallback = p.catalogs[defaultLocale]
+	return v
+}
+
+// locale picks the queue's locale if there is a catalog for it, then the
+// first of the visitor's languages there is one for.
+func (p *Pages) locale(queueLocale, acceptLanguage string) string {
+	candidates := []string{queueLocale}
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, _, _ := strings.Cut(part, ";")
+		candidates = append(candidates, strings.TrimSpace(tag))
+	}
+	for _, tag := range candidates {
+		tag = strings.ToLower(tag)
+		if _, ok := p.catalogs[tag]; ok && tag != "" {
+			return tag
+		}
+		if base, _, ok := strings.Cut(tag, "-"); ok {
+			if _, ok := p.catalogs[base]; ok {
+				return base
+			}
+		}
+	}
+	return defaultLocale
+}
+
+// layeredFS serves files from upper, falling back to lower.
+type layeredFS struct {
+	upper, lower fs.FS
+}
+
+func (l layeredFS) Open(name string) (fs.File, error) {
+	f, err := l.upper.Open(name)
+	if err == nil {
+		return f, nil
+	}
+	return l.lower.Open(name)
+}
@@ -0,0 +1,62 @@
+package models
+
+// Error codes returned to clients, see docs/API.md
+const (
+	CodeInvalidRequest   = "INVALID_REQUEST"
+	CodeUnauthorized     = "UNAUTHORIZED"
+	CodeTokenExpired     = "TOKEN_EXPIRED"
+	CodeTokenRevoked     = "TOKEN_REVOKED"
+	CodeForbidden        = "FORBIDDEN"
+	CodeClientMismatch   = "CLIENT_MISMATCH"
+	CodeNotFound         = "NOT_FOUND"
+	CodeQueueExists      = "QUEUE_EXISTS"
+	CodeUpdateConflict   = "UPDATE_CONFLICT"
+	CodeQueueClosed      = "QUEUE_CLOSED"
+	CodeMethodNotAllowed = "METHOD_NOT_ALLOWED"
+	CodePositionExpired  = "POSITION_EXPIRED"
+	CodeSessionExpired   = "SESSION_EXPIRED"
+	CodeRateLimited      = "RATE_LIMITED"
+	CodeQueueFull        = "QUEUE_FULL"
+	CodeMaintenanceMode  = "MAINTENANCE_MODE"
+	CodeQueueNotOpen     = "QUEUE_NOT_OPEN"
+	CodeAlreadyQueued    = "ALREADY_QUEUED"
+	CodeChallengeFailed  = "CHALLENGE_FAILED"
+	CodeInternalError    = "INTERNAL_ERROR"
+)
+
+// Error is a domain error carrying a stable code clients can branch on
+type Error struct {
+	Code    string
+	Message string         // Safe to show to clients
+	Details map[string]any // Optional context, e.g. the position ID
+	base    *Error
+}
+
+// NewError creates a domain error, typically a package-level sentinel
+func NewError(code, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Unwrap returns the sentinel an error with details was derived from, so
+// errors.Is keeps matching it
+func (e *Error) Unwrap() error {
+	if e.base == nil {
+		return nil
+	}
+	return e.base
+}
+
+// WithDetails returns a copy of the error carrying details
+func (e *Error) WithDetails(details map[string]any) *Error {
+	return &Error{Code: e.Code, Message: e.Message, Details: details, base: e}
+}
+
+// WithMessage returns a copy of the error with a different client-facing
+// message, e.g. one configured by an operator
+func (e *Error) WithMessage(message string) *Error {
+	return &Error{Code: e.Code, Message: message, Details: e.Details, base: e}
+}
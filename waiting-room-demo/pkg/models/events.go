@@ -0,0 +1,106 @@
+package models
+
+import "time"
+
+// Event subjects, see docs/NATS_EVENTS.md
+const (
+	EventPositionEnqueued  = "waitingroom.position.enqueued.v1"
+	EventPositionAdmitted  = "waitingroom.position.admitted.v1"
+	EventPositionExpired   = "waitingroom.position.expired.v1"
+	EventPositionCancelled = "waitingroom.position.cancelled.v1"
+	EventSessionStarted    = "waitingroom.session.started.v1"
+	EventSessionExpired    = "waitingroom.session.expired.v1"
+	EventSessionTerminated = "waitingroom.session.terminated.v1"
+	EventQueueCreated      = "waitingroom.queue.created.v1"
+	EventQueueUpdated      = "waitingroom.queue.updated.v1"
+	EventQueuePaused       = "waitingroom.queue.paused.v1"
+	EventQueueResumed      = "waitingroom.queue.resumed.v1"
+	EventQueueMaintenance  = "waitingroom.queue.maintenance.v1"
+	EventQueueClosed       = "waitingroom.queue.closed.v1"
+	EventQueueLotteryDrawn = "waitingroom.queue.lottery_drawn.v1"
+)
+
+// Reasons carried by expiry and termination events
+const (
+	ReasonHeartbeatTimeout = "heartbeat_timeout"
+	ReasonCancelled        = "cancelled"
+	ReasonAdminRevoked     = "admin_revoked"
+	ReasonSessionTimeout   = "session_timeout"
+	ReasonExpired          = "expired" // the position is gone for a reason no longer known
+)
+
+// PositionEnqueuedData is the payload of EventPositionEnqueued
+type PositionEnqueuedData struct {
+	PositionID  string `json:"position_id"`
+	Priority    int    `json:"priority"`
+	IPAddress   string `json:"ip_address,omitempty"` // Masked
+	UserAgent   string `json:"user_agent,omitempty"` // Truncated
+	QueueLength int64  `json:"queue_length"`
+}
+
+// PositionAdmittedData is the payload of EventPositionAdmitted
+type PositionAdmittedData struct {
+	PositionID  string `json:"position_id"`
+	Priority    int    `json:"priority"`
+	WaitTime    int64  `json:"wait_time_seconds"`
+	QueueLength int64  `json:"queue_length_after"`
+}
+
+// PositionExpiredData is the payload of EventPositionExpired and EventPositionCancelled
+type PositionExpiredData struct {
+	PositionID string `json:"position_id"`
+	Reason     string `json:"reason"` // heartbeat_timeout, cancelled, admin_revoked
+}
+
+// SessionStartedData is the payload of EventSessionStarted
+type SessionStartedData struct {
+	SessionID  string    `json:"session_id"`
+	PositionID string    `json:"position_id"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// SessionExpiredData is the payload of EventSessionExpired
+type SessionExpiredData struct {
+	SessionID  string `json:"session_id"`
+	PositionID string `json:"position_id"`
+	Duration   int64  `json:"duration_seconds"`
+	PageViews  int64  `json:"page_views"`
+	Reason     string `json:"reason"`
+}
+
+// SessionTerminatedData is the payload of EventSessionTerminated
+type SessionTerminatedData struct {
+	SessionID    string    `json:"session_id"`
+	PositionID   string    `json:"position_id"`
+	Reason       string    `json:"reason"`
+	TerminatedAt time.Time `json:"terminated_at"`
+}
+
+// QueueUpdatedData is the payload of EventQueueUpdated
+type QueueUpdatedData struct {
+	QueueID string            `json:"queue_id"`
+	Changes map[string]Change `json:"changes"`
+}
+
+// Change is a configuration field's value before and after an update
+type Change struct {
+	OldValue any `json:"old_value"`
+	NewValue any `json:"new_value"`
+}
+
+// QueueStatusData is the payload of the queue status events
+type QueueStatusData struct {
+	QueueID        string `json:"queue_id"`
+	Status         string `json:"status"`
+	PreviousStatus string `json:"previous_status"`
+}
+
+// LotteryDrawnData is the payload of EventQueueLotteryDrawn
+type LotteryDrawnData struct {
+	QueueID    string    `json:"queue_id"`
+	SeedSHA256 string    `json:"seed_sha256,omitempty"`
+	Seed       string    `json:"seed"`
+	Algorithm  string    `json:"algorithm"`
+	CohortSize int64     `json:"cohort_size"`
+	DrawnAt    time.Time `json:"drawn_at"`
+}
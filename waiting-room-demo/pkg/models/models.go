@@ -1,26 +1,159 @@
 package models
 
-import "github.com/golang-jwt/jwt/v5"
+import (
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Priority lanes, admitted from highest to lowest
+const (
+	PriorityNormal   = 0
+	PriorityElevated = 1
+	PriorityVIP      = 2
+	PriorityPremium  = 3
+)
+
+// Token types carried in the "typ" claim
+const (
+	TokenTypeQueue   = "queue"
+	TokenTypeSession = "session"
+)
+
+// Session statuses
+const (
+	SessionActive     = "active"
+	SessionExpired    = "expired"
+	SessionTerminated = "terminated"
+)
+
+// Client binding modes
+const (
+	BindingNone      = ""         // Token works from any client
+	BindingIP        = "ip"       // Exact client IP
+	BindingSubnet    = "subnet"   // Client IP's /24 (IPv4) or /64 (IPv6)
+	BindingUserAgent = "ua"       // User-Agent only
+	BindingTolerant  = "tolerant" // Subnet or User-Agent, so network switches keep working
+)
+
+// ClientBinding ties a token to a salted fingerprint of the client it was issued to
+type ClientBinding struct {
+	Binding string `json:"bind,omitempty"`
+	IPHash  string `json:"ip_hash,omitempty"`
+	UAHash  string `json:"ua_hash,omitempty"`
+}
 
 // QueueToken claims for JWT
 type QueueToken struct {
-	QueueID   string `json:"queue_id"`
-	IssuedAt  int64  `json:"issued_at"`
-	ExpiresAt int64  `json:"expires_at"`
+	Type       string `json:"typ"`
+	PositionID string `json:"position_id"`
+	QueueID    string `json:"queue_id"`
+	Priority   int    `json:"priority"`
+	IssuedAt   int64  `json:"issued_at"`
+	ExpiresAt  int64  `json:"expires_at"`
+	ClientBinding
+	jwt.RegisteredClaims
+}
+
+// SessionToken claims for JWT, issued once a position is admitted
+type SessionToken struct {
+	Type       string `json:"typ"`
+	SessionID  string `json:"session_id"`
+	PositionID string `json:"position_id"`
+	QueueID    string `json:"queue_id"`
+	ClientBinding
 	jwt.RegisteredClaims
 }
 
 // QueueStatus represents the current status of a user in the queue
 type QueueStatus struct {
-	InQueue      bool   `json:"in_queue"`
-	Position     int64  `json:"position"`
-	TotalInQueue int64  `json:"total_in_queue"`
-	Allowed      bool   `json:"allowed"`
-	TargetURL    string `json:"target_url,omitempty"`
-	WaitTimeEst  int64  `json:"wait_time_est_seconds"` // Estimated wait time
+	PositionID   string    `json:"position_id,omitempty"`
+	QueueID      string    `json:"queue_id,omitempty"`
+	InQueue      bool      `json:"in_queue"`
+	Priority     int       `json:"priority"`
+	Position     int64     `json:"position"`      // Position across all priority lanes
+	LanePosition int64     `json:"lane_position"` // Position within the user's priority lane
+	TotalInQueue int64     `json:"total_in_queue"`
+	Allowed      bool      `json:"allowed"`
+	TargetURL    string    `json:"target_url,omitempty"`
+	WaitTimeEst  int64     `json:"wait_time_est_seconds"` // Estimated wait time
+	WaitTimeMin  int64     `json:"wait_time_min_seconds"` // Low end of the estimate's confidence range
+	WaitTimeMax  int64     `json:"wait_time_max_seconds"` // High end of the estimate's confidence range
+	ExpiresAt    time.Time `json:"expires_at,omitempty"`
+	Session      *Session  `json:"session,omitempty"` // Set once the user is admitted
+	Resumed      bool      `json:"resumed,omitempty"` // Enqueue returned the client's earlier position
+
+	QueueState string     `json:"queue_status,omitempty"` // The queue's status, e.g. paused
+	PreQueue   bool       `json:"prequeue,omitempty"`     // Waiting for the lottery draw, with no position yet
+	OpensAt    *time.Time `json:"opens_at,omitempty"`     // When the lottery is drawn
+
+	// The queue's heartbeat settings, for the HTTP layer to pass on
+	HeartbeatInterval time.Duration `json:"-"`
+	HeartbeatTimeout  time.Duration `json:"-"`
+	// Positions admitted from the lane when LanePosition was read, for the
+	// hub to move the position on from there
+	LaneDeparted int64 `json:"-"`
+}
+
+// QueueStats summarises a queue for operators
+type QueueStats struct {
+	QueueID           string  `json:"queue_id"`
+	Status            string  `json:"status"`
+	CurrentWaiting    int64   `json:"current_waiting"`
+	CurrentActive     int64   `json:"current_active"` // Admitted users and live sessions
+	AdmissionRate     float64 `json:"admission_rate_actual"`
+	AdmissionRateLow  float64 `json:"admission_rate_low"`
+	AdmissionRateHigh float64 `json:"admission_rate_high"`
+	RateObserved      bool    `json:"admission_rate_observed"` // False while the configured rate stands in
+	WaitTimeEst       int64   `json:"wait_time_est_seconds"`   // For a user joining now
+	WaitTimeMin       int64   `json:"wait_time_min_seconds"`
+	WaitTimeMax       int64   `json:"wait_time_max_seconds"`
+
+	Identity IdentityStats `json:"identity"`
+}
+
+// IdentityStats counts enqueues from identities that already held a position,
+// by kind of identity: ip, user_id, fingerprint, or client for resumes
+type IdentityStats struct {
+	Policy   string           `json:"policy,omitempty"`
+	Limit    int64            `json:"limit,omitempty"`
+	Resumed  map[string]int64 `json:"resumed"`  // Given their existing position back
+	Rejected map[string]int64 `json:"rejected"` // Turned away with ALREADY_QUEUED
+}
+
+// Session represents an admitted user on the protected site
+type Session struct {
+	ID           string    `json:"session_id"`
+	QueueID      string    `json:"queue_id"`
+	PositionID   string    `json:"position_id"`
+	Status       string    `json:"status"`
+	Token        string    `json:"-"`
+	StartedAt    time.Time `json:"started_at"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	LastActivity time.Time `json:"last_activity"`
+	PageViews    int64     `json:"page_views"`
 }
 
 // HeartbeatRequest from client
 type HeartbeatRequest struct {
 	Token string `json:"token"`
 }
+
+// Challenge types
+const (
+	ChallengeHashcash = "hashcash" // Find a suffix whose SHA-256 hash starts with Difficulty zero bits
+)
+
+// Challenge is a puzzle a client must solve before it may enqueue
+type Challenge struct {
+	Type       string    `json:"type"`
+	Nonce      string    `json:"nonce"`      // Signed by the server, and single-use
+	Difficulty int       `json:"difficulty"` // Meaning depends on the type
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// ChallengeSolution is a client's answer to a Challenge
+type ChallengeSolution struct {
+	Nonce    string `json:"nonce"`
+	Solution string `json:"solution"`
+}
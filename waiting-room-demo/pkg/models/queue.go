@@ -0,0 +1,155 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Queue statuses
+const (
+	QueueActive      = "active"      // Accepting and admitting users
+	QueuePaused      = "paused"      // Accepting users, admissions frozen
+	QueueMaintenance = "maintenance" // Rejecting new users, admissions frozen
+	QueueClosed      = "closed"      // Final; rejecting new users, admissions stopped
+)
+
+// Identity policies, limiting the positions one identity can hold at once
+const (
+	IdentityNone        = ""            // Any number of positions
+	IdentityIP          = "ip"          // Up to IdentityLimit positions per client IP
+	IdentityUserID      = "user_id"     // One position per metadata.user_id, which is then required
+	IdentityFingerprint = "fingerprint" // One position per IP address and User-Agent
+)
+
+// Queue is the configuration of a waiting room queue
+type Queue struct {
+	ID                 string     `json:"id"`
+	Name               string     `json:"name"`
+	Status             string     `json:"status"`
+	TargetURL          string     `json:"target_url,omitempty"` // Where admitted users are sent
+	MaxActiveUsers     int64      `json:"max_active_users"`     // 0 for unlimited
+	MaxQueueSize       int64      `json:"max_queue_size"`       // 0 for unlimited
+	AdmissionRate      float64    `json:"admission_rate"`       // Users admitted per second
+	SessionTimeout     int64      `json:"session_timeout_seconds"`
+	HeartbeatInterval  int64      `json:"heartbeat_interval_seconds"`
+	HeartbeatTimeout   int64      `json:"heartbeat_timeout_seconds"`
+	ClientBinding      string     `json:"client_binding,omitempty"`
+	IdentityPolicy     string     `json:"identity_policy,omitempty"`
+	IdentityLimit      int64      `json:"identity_limit,omitempty"`          // Positions per IP under the ip policy
+	Challenge          string     `json:"challenge,omitempty"`               // Challenge type enqueues must solve, such as hashcash
+	MaintenanceMessage string     `json:"maintenance_message,omitempty"`     // Shown to users turned away during maintenance
+	OpensAt            *time.Time `json:"opens_at,omitempty"`                // Lottery opening; arrivals before it are drawn in random order
+	LotterySeedSHA256  string     `json:"lottery_seed_sha256,omitempty"`     // Commitment to the lottery seed, set with opens_at
+	PreQueueWindow     int64      `json:"prequeue_window_seconds,omitempty"` // How long before the opening arrivals are let in, 0 for any time
+	Page               *QueuePage `json:"page,omitempty"`                    // Waiting page theme
+	CreatedAt          time.Time  `json:"created_at"`
+	UpdatedAt          time.Time  `json:"updated_at"`
+	Revision           int64      `json:"-"` // Bumped by every update, so concurrent updates can't overwrite each other
+}
+
+// QueuePage themes a queue's waiting page. Empty fields keep the defaults
+type QueuePage struct {
+	Title           string `json:"title,omitempty"`            // Heading, in place of the localized default
+	Message         string `json:"message,omitempty"`          // Shown under the heading
+	LogoURL         string `json:"logo_url,omitempty"`         // Absolute http(s) URL or a path on this host
+	PrimaryColor    string `json:"primary_color,omitempty"`    // Hex color, e.g. #1a73e8
+	BackgroundColor string `json:"background_color,omitempty"` // Hex color
+	Locale          string `json:"locale,omitempty"`           // e.g. en or id; the visitor's Accept-Language when empty
+}
+
+// SessionTTL is how long sessions started from the queue last
+func (q *Queue) SessionTTL() time.Duration {
+	return time.Duration(q.SessionTimeout) * time.Second
+}
+
+// HeartbeatIntervalDuration is how often clients should send heartbeats
+func (q *Queue) HeartbeatIntervalDuration() time.Duration {
+	return time.Duration(q.HeartbeatInterval) * time.Second
+}
+
+// HeartbeatTimeoutDuration is how long a position survives without a heartbeat
+func (q *Queue) HeartbeatTimeoutDuration() time.Duration {
+	return time.Duration(q.HeartbeatTimeout) * time.Second
+}
+
+// PreQueueOpensAt is when arrivals start being let into the lottery pre-queue,
+// zero if they are let in any time before the opening
+func (q *Queue) PreQueueOpensAt() time.Time {
+	if q.OpensAt == nil || q.PreQueueWindow == 0 {
+		return time.Time{}
+	}
+	return q.OpensAt.Add(-time.Duration(q.PreQueueWindow) * time.Second)
+}
+
+// Admits reports whether waiting users are being admitted
+func (q *Queue) Admits() bool {
+	return q.Status == QueueActive
+}
+
+// QueueCreate is a new queue's configuration; fields left out take the server
+// defaults
+type QueueCreate struct {
+	ID string `json:"id"`
+	QueueUpdate
+}
+
+// QueueUpdate is a partial update of a queue's configuration; nil fields are
+// left unchanged
+type QueueUpdate struct {
+	Name               *string             `json:"name"`
+	Status             *string             `json:"status"`
+	TargetURL          *string             `json:"target_url"`
+	MaxActiveUsers     *int64              `json:"max_active_users"`
+	MaxQueueSize       *int64              `json:"max_queue_size"`
+	AdmissionRate      *float64            `json:"admission_rate"`
+	SessionTimeout     *int64              `json:"session_timeout_seconds"`
+	HeartbeatInterval  *int64              `json:"heartbeat_interval_seconds"`
+	HeartbeatTimeout   *int64              `json:"heartbeat_timeout_seconds"`
+	ClientBinding      *string             `json:"client_binding"`
+	IdentityPolicy     *string             `json:"identity_policy"`
+	IdentityLimit      *int64              `json:"identity_limit"`
+	Challenge          *string             `json:"challenge"`
+	MaintenanceMessage *string             `json:"maintenance_message"`
+	OpensAt            Nullable[time.Time] `json:"opens_at"` // null calls the lottery off
+	PreQueueWindow     *int64              `json:"prequeue_window_seconds"`
+	Page               *QueuePage          `json:"page"` // Replaces the whole theme; an empty object clears it
+}
+
+// Nullable is a JSON field that can be left out, set, or set to null to
+// clear it
+type Nullable[T any] struct {
+	Set   bool // present in the JSON, even if null
+	Value *T   // nil for null
+}
+
+func (n *Nullable[T]) UnmarshalJSON(data []byte) error {
+	n.Set = true
+	if string(data) == "null" {
+		n.Value = nil
+		return nil
+	}
+	n.Value = new(T)
+	return json.Unmarshal(data, n.Value)
+}
+
+// Lottery draw states
+const (
+	LotteryPending = "pending" // arrivals are joining the pre-queue
+	LotteryDrawing = "drawing" // the pre-queue is closed and the cohort is being drawn
+	LotteryDrawn   = "drawn"
+)
+
+// Lottery is the audit record of a queue's pre-queue lottery. Order lists the
+// cohort's position IDs in drawn order, which is ascending
+// HMAC-SHA256(seed, position_id) with the hex-decoded seed as the key
+type Lottery struct {
+	QueueID    string     `json:"queue_id"`
+	State      string     `json:"state"`
+	OpensAt    time.Time  `json:"opens_at"`
+	SeedSHA256 string     `json:"seed_sha256,omitempty"` // Hex SHA-256 of the seed bytes, published when opens_at is set
+	Seed       string     `json:"seed,omitempty"`        // Hex, revealed once drawn
+	Algorithm  string     `json:"algorithm,omitempty"`
+	CohortSize int64      `json:"cohort_size"`
+	DrawnAt    *time.Time `json:"drawn_at,omitempty"`
+	Order      []string   `json:"order,omitempty"`
+}
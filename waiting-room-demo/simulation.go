@@ -5,18 +5,27 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/http/cookiejar"
 	"os"
 	"sync"
 	"time"
-
-	"github.com/jawaracloud/waiting-room-demo/pkg/models"
 )
 
 var (
 	BaseURL = getEnv("BASE_URL", "http://localhost:8080")
+	QueueID = getEnv("QUEUE_ID", "demo")
 	Users   = 50
 )
 
+// queueResponse is the part of the enqueue and heartbeat responses the
+// simulated users look at.
+type queueResponse struct {
+	Position    int64  `json:"position"`
+	QueueLength int64  `json:"queue_length"`
+	Admitted    bool   `json:"admitted"`
+	CSRFToken   string `json:"csrf_token"`
+}
+
 func getEnv(key, fallback string) string {
 	if value, ok := os.LookupEnv(key); ok {
 		return value
@@ -41,54 +50,65 @@ func main() {
 	fmt.Printf("Simulation finished in %v\n", time.Since(startTime))
 }
 
+// simulateUser behaves like a browser: its tokens live in cookies, and it
+// only handles the CSRF token the API returns.
 func simulateUser(id int) {
 	start := time.Now()
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar, Timeout: 10 * time.Second}
+	queueURL := BaseURL + "/api/v1/queues/" + QueueID
+
 	// 1. Enqueue
-	resp, err := http.Post(BaseURL+"/enqueue", "application/json", nil)
-	if err != nil {
+	var status queueResponse
+	if err := post(client, queueURL+"/enqueue", "", map[string]any{"token_transport": "cookie"}, &status); err != nil {
 		fmt.Printf("User %d: Enqueue failed: %v\n", id, err)
 		return
 	}
-	defer resp.Body.Close()
-
-	token := resp.Header.Get("X-Queue-Token")
-	var status models.QueueStatus
-	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
-		fmt.Printf("User %d: Failed to decode status: %v\n", id, err)
-		return
-	}
+	csrfToken := status.CSRFToken
 
 	fmt.Printf("User %d: Enqueued. Position: %d\n", id, status.Position)
 
-	if status.Allowed {
-		fmt.Printf("User %d: ALLOWED IMMEDIATELY! Time: %v\n", id, time.Since(start))
-		return
-	}
-
 	// 2. Heartbeat until allowed
 	ticker := time.NewTicker(2 * time.Second)
 	defer ticker.Stop()
 
 	for range ticker.C {
-		reqBody, _ := json.Marshal(models.HeartbeatRequest{Token: token})
-		resp, err := http.Post(BaseURL+"/status", "application/json", bytes.NewBuffer(reqBody))
-		if err != nil {
-			fmt.Printf("User %d: Status check failed: %v\n", id, err)
+		var current queueResponse
+		if err := post(client, queueURL+"/heartbeat", csrfToken, map[string]any{"timestamp": time.Now().UnixMilli()}, &current); err != nil {
+			fmt.Printf("User %d: Heartbeat failed: %v\n", id, err)
 			continue
 		}
 
-		var currentStatus models.QueueStatus
-		if err := json.NewDecoder(resp.Body).Decode(&currentStatus); err != nil {
-			resp.Body.Close()
-			continue
-		}
-		resp.Body.Close()
-
-		if currentStatus.Allowed {
+		if current.Admitted {
 			fmt.Printf("User %d: ALLOWED! Time to entry: %v\n", id, time.Since(start))
 			return
 		}
 
-		fmt.Printf("User %d: Still waiting. Position: %d/%d\n", id, currentStatus.Position, currentStatus.TotalInQueue)
+		fmt.Printf("User %d: Still waiting. Position: %d/%d\n", id, current.Position, current.QueueLength)
+	}
+}
+
+func post(client *http.Client, url, csrfToken string, body, v any) error {
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if csrfToken != "" {
+		req.Header.Set("X-CSRF-Token", csrfToken)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s", resp.Status)
 	}
+	return json.NewDecoder(resp.Body).Decode(v)
 }